@@ -0,0 +1,366 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bp-server/internal/auth"
+	"bp-server/internal/db"
+	"bp-server/internal/dumps"
+	"bp-server/internal/email"
+	"bp-server/internal/processor"
+	"bp-server/internal/retention"
+	"bp-server/internal/stats"
+	"bp-server/internal/symbols"
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+// commands 是一次性执行的维护命令，用法: bp-server [-c config] <command> [args...]
+var commands = map[string]command{
+	"convert-symbols": {
+		usage: "convert stored symbol files to the configured symbol_store/compress method",
+		run: func(args []string) error {
+			n, err := symbols.ConvertStore()
+			fmt.Printf("Converted %d symbol files\n", n)
+			return err
+		},
+	},
+	"migrate": {
+		usage: "apply pending database migrations, -status only lists them",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+			status := flags.Bool("status", false, "list pending migrations")
+			flags.Parse(args)
+			pending, err := db.PendingMigrations()
+			if err != nil {
+				return err
+			}
+			current, _ := db.SchemaVersion()
+			fmt.Printf("Schema version %d, latest %d\n", current, db.LatestSchemaVersion())
+			for _, m := range pending {
+				fmt.Printf("Pending: %s\n", m)
+			}
+			if *status || len(pending) == 0 {
+				return nil
+			}
+			if err = db.Migrate(); err != nil {
+				return err
+			}
+			fmt.Printf("Applied %d migrations\n", len(pending))
+			return nil
+		},
+	},
+	"convert-dumps": {
+		usage: "convert stored dump files to the configured dump_store/compress method",
+		run: func(args []string) error {
+			n, err := dumps.ConvertStore()
+			fmt.Printf("Converted %d dumps\n", n)
+			return err
+		},
+	},
+	"gc-symbols": {
+		usage: "remove symbol files not kept by symbol_store/gc, -dry-run only lists them",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("gc-symbols", flag.ExitOnError)
+			dryRun := flags.Bool("dry-run", false, "list symbols that would be removed")
+			flags.Parse(args)
+			deletions, err := symbols.GC(*dryRun)
+			var total int64
+			for _, d := range deletions {
+				fmt.Printf("%s/%s\t%d\n", d.Entry, d.DebugID, d.Size)
+				total += d.Size
+			}
+			if *dryRun {
+				fmt.Printf("Would remove %d symbol directories, %d bytes\n", len(deletions), total)
+			} else {
+				fmt.Printf("Removed %d symbol directories, %d bytes\n", len(deletions), total)
+			}
+			return err
+		},
+	},
+	"reprocess-signatures": {
+		usage: "regroup processed dumps with the current signature rules, -program limits it to one program, -dry-run only lists them",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("reprocess-signatures", flag.ExitOnError)
+			program := flags.String("program", "", "only reprocess dumps of this program")
+			dryRun := flags.Bool("dry-run", false, "list dumps that would be regrouped")
+			flags.Parse(args)
+			regrouped, err := processor.ReprocessSignatures(*program, *dryRun)
+			for _, r := range regrouped {
+				fmt.Printf("%d\t%s\t%s\t->\t%s\n", r.Dump.ID, r.Dump.Program, r.OldSignature, r.Signature)
+			}
+			if *dryRun {
+				fmt.Printf("Would regroup %d dumps\n", len(regrouped))
+			} else {
+				fmt.Printf("Regrouped %d dumps\n", len(regrouped))
+			}
+			return err
+		},
+	},
+	"reprocess-failed": {
+		usage: "queue the dumps the stackwalker failed on again, -program limits it to one program",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("reprocess-failed", flag.ExitOnError)
+			program := flags.String("program", "", "only reprocess dumps of this program")
+			flags.Parse(args)
+			n, err := db.ResetFailedDumps(*program)
+			fmt.Printf("Queued %d failed dumps, the running server processes them within a minute\n", n)
+			return err
+		},
+	},
+	"rebuild-stats": {
+		usage: "rebuild the daily crash statistics of the dashboard from all dumps",
+		run: func(args []string) error {
+			days, err := stats.Rollup(true)
+			fmt.Printf("Rebuilt crash statistics of %d days\n", days)
+			return err
+		},
+	},
+	"send-digest": {
+		usage: "send the email digest of a day (default yesterday), -to sends it only to the given addresses, -dry-run prints it",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("send-digest", flag.ExitOnError)
+			day := flags.String("day", stats.Day(time.Now().AddDate(0, 0, -1)), "day of the digest, 2006-01-02")
+			to := flags.String("to", "", "comma separated addresses, instead of the configured recipients")
+			dryRun := flags.Bool("dry-run", false, "print the emails instead of sending them")
+			flags.Parse(args)
+			var addrs []string
+			if *to != "" {
+				addrs = strings.Split(*to, ",")
+			}
+			var out io.Writer
+			if *dryRun {
+				out = os.Stdout
+			}
+			sent, err := email.SendDigest(*day, addrs, out)
+			if !*dryRun {
+				fmt.Printf("Sent digest of %s to %d recipients\n", *day, len(sent))
+			}
+			return err
+		},
+	},
+	"set-user": {
+		usage: "create a view server account or change its password, -password - reads it from stdin, -disable blocks the account",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("set-user", flag.ExitOnError)
+			name := flags.String("name", "", "user name")
+			password := flags.String("password", "", "new password, - to read it from stdin, empty to keep it")
+			disable := flags.Bool("disable", false, "disable the account and end its sessions")
+			flags.Parse(args)
+			if *password == "-" {
+				line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+				if err != nil && err != io.EOF {
+					return err
+				}
+				*password = strings.TrimRight(line, "\r\n")
+			}
+			user, err := auth.SetUser(*name, *password, *disable)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Saved user '%s', disabled: %v\n", user.Username, user.Disabled)
+			return nil
+		},
+	},
+	"list-users": {
+		usage: "list the view server accounts and their roles",
+		run: func(args []string) error {
+			users, err := db.QueryUsers()
+			if err != nil {
+				return err
+			}
+			grants, err := db.QueryAllGrants()
+			for _, u := range users {
+				lastLogin := "-"
+				if u.LastLogin != nil {
+					lastLogin = u.LastLogin.Format(time.RFC3339)
+				}
+				roles := make([]string, 0, len(grants[u.ID]))
+				for _, g := range grants[u.ID] {
+					roles = append(roles, g.Program+"="+g.Role)
+				}
+				fmt.Printf("%s\tdisabled:%v\tlast login:%s\troles:%s\n", u.Username, u.Disabled, lastLogin, strings.Join(roles, ","))
+			}
+			return err
+		},
+	},
+	"grant": {
+		usage: "give a user a role (viewer, triager, admin) on a program or * for all programs, -role none revokes it",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("grant", flag.ExitOnError)
+			name := flags.String("name", "", "user name")
+			program := flags.String("program", db.AllPrograms, "program name, * for all programs")
+			role := flags.String("role", db.RoleViewer, "viewer, triager, admin or none")
+			flags.Parse(args)
+			if err := auth.SetGrant(*name, *program, *role); err != nil {
+				return err
+			}
+			if *role == "none" || *role == "" {
+				fmt.Printf("Revoked the role of '%s' on '%s'\n", *name, *program)
+			} else {
+				fmt.Printf("Granted '%s' role '%s' on '%s'\n", *name, *role, *program)
+			}
+			return nil
+		},
+	},
+	"add-upload-key": {
+		usage: "create an API key for the upload port, -program and -perm take comma separated lists",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("add-upload-key", flag.ExitOnError)
+			name := flags.String("name", "", "what the key is for, e.g. the CI job using it")
+			programs := flags.String("program", "", "programs the key may upload for, * for all programs")
+			perms := flags.String("perm", db.UploadDump, "dump, symbol or dump,symbol")
+			flags.Parse(args)
+			key, secret, err := auth.NewUploadKey(*name, strings.Split(*programs, ","), strings.Split(*perms, ","), "cli")
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Created upload key %d '%s', it is shown only once:\n%s\n", key.ID, key.Name, secret)
+			return nil
+		},
+	},
+	"list-upload-keys": {
+		usage: "list the API keys of the upload port",
+		run: func(args []string) error {
+			keys, err := db.QueryUploadKeys()
+			for _, k := range keys {
+				perms := make([]string, 0, 2)
+				if k.Dump {
+					perms = append(perms, db.UploadDump)
+				}
+				if k.Symbol {
+					perms = append(perms, db.UploadSymbol)
+				}
+				lastUsed, state := "-", "active"
+				if k.LastUsed != nil {
+					lastUsed = k.LastUsed.Format(time.RFC3339)
+				}
+				if k.RevokedAt != nil {
+					state = "revoked " + k.RevokedAt.Format(time.RFC3339)
+				}
+				fmt.Printf("%d\t%s\t%s...\tprograms:%s\tperms:%s\tlast used:%s\t%s\n",
+					k.ID, k.Name, k.Prefix, k.Programs, strings.Join(perms, ","), lastUsed, state)
+			}
+			return err
+		},
+	},
+	"revoke-upload-key": {
+		usage: "revoke an API key of the upload port by its id",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("revoke-upload-key", flag.ExitOnError)
+			id := flags.Uint("id", 0, "key id, see list-upload-keys")
+			flags.Parse(args)
+			if err := auth.RevokeUploadKey(*id, "cli"); err != nil {
+				return err
+			}
+			fmt.Printf("Revoked upload key %d\n", *id)
+			return nil
+		},
+	},
+	"issue-upload-token": {
+		usage: "sign an upload token for a program version, to bake into its build",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("issue-upload-token", flag.ExitOnError)
+			program := flags.String("program", "", "program name")
+			version := flags.String("version", "", "program version")
+			hours := flags.Int("hours", 0, "hours the token is valid, 0 for <build_hours>")
+			flags.Parse(args)
+			ttl := auth.MaxBuildTTL()
+			if *hours > 0 {
+				ttl = time.Duration(*hours) * time.Hour
+			}
+			token, expires, err := auth.IssueUploadToken(*program, *version, ttl)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\nexpires at %s\n", token, expires.Format(time.RFC3339))
+			return nil
+		},
+	},
+	"cleanup-dumps": {
+		usage: "prune dumps according to the retention policy, -dry-run only lists them",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("cleanup-dumps", flag.ExitOnError)
+			dryRun := flags.Bool("dry-run", false, "list dumps that would be pruned")
+			flags.Parse(args)
+			pruned, err := retention.Cleanup(*dryRun)
+			var total int64
+			for _, p := range pruned {
+				fmt.Printf("%d\t%s\t%s\t%s\t%d\t%s\n", p.Dump.ID, p.Dump.Program, p.Dump.Version, p.Dump.Filename, p.Dump.Size, p.Reason)
+				total += p.Dump.Size
+			}
+			if *dryRun {
+				fmt.Printf("Would prune %d dumps, %d bytes\n", len(pruned), total)
+			} else {
+				fmt.Printf("Pruned %d dumps, %d bytes\n", len(pruned), total)
+			}
+			return err
+		},
+	},
+}
+
+func runCommand(name string, args []string) {
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s', available commands:\n", name)
+		names := make([]string, 0, len(commands))
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			fmt.Fprintf(os.Stderr, "  %-20s %s\n", n, commands[n].usage)
+		}
+		os.Exit(2)
+	}
+	// 启动时不会为维护命令迁移数据库，除了migrate都要求数据库已经是最新结构
+	if name != "migrate" {
+		if err := db.RequireLatestSchema(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+	if err := cmd.run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
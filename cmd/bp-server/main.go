@@ -32,13 +32,32 @@ package main
 
 import (
 	"bp-server/internal/app"
+	"bp-server/internal/auth"
+	"bp-server/internal/breakpad"
 	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/dumps"
+	"bp-server/internal/email"
+	"bp-server/internal/job"
+	"bp-server/internal/processor"
+	"bp-server/internal/retention"
 	"bp-server/internal/server"
+	"bp-server/internal/signature"
+	"bp-server/internal/similar"
+	"bp-server/internal/spike"
+	"bp-server/internal/stats"
+	"bp-server/internal/storage"
+	"bp-server/internal/symbols"
+	"bp-server/internal/tracker"
+	"bp-server/internal/usage"
+	"bp-server/internal/webhook"
 	"bytes"
+	"flag"
 	"fmt"
 	"path"
 	"strings"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/natefinch/lumberjack.v2"
@@ -47,11 +66,27 @@ import (
 var bpSvr *server.Server
 
 func initFunc() {
+	if err := db.RequireLatestSchema(); err != nil {
+		panic(err)
+	}
 	svr := server.New()
 	svr.Start()
+	webhook.Start()
+	email.Start()
+	processor.Start()
+	symbols.StartGC()
+	retention.Start()
+	stats.Start()
+	usage.Start()
+	spike.Start()
+	similar.Start()
+	tracker.Start()
+	auth.Start()
 }
 
 func uninitFunc() {
+	job.StopAll()
+	processor.Stop()
 	if bpSvr != nil {
 		bpSvr.Stop()
 		timer := time.NewTimer(time.Millisecond * 50)
@@ -132,7 +167,25 @@ func convertLogLevel(level string) logrus.Level {
 	}
 }
 
+// initPackages 用读取的配置初始化各个包，数据库和存储最先初始化
+func initPackages() {
+	storage.Init()
+	db.Init()
+	dumps.Init()
+	symbols.Init()
+	breakpad.Init()
+	signature.Init()
+	tracker.Init()
+	auth.Init()
+}
+
 func main() {
+	conf.Init()
 	initLogger()
+	initPackages()
+	if flag.NArg() > 0 {
+		runCommand(flag.Arg(0), flag.Args()[1:])
+		return
+	}
 	app.Run(initFunc, uninitFunc, dumpFunc)
 }
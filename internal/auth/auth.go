@@ -0,0 +1,316 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package auth
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/job"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// CookieName 是保存会话令牌的cookie
+	CookieName = "bp_session"
+	// CSRFField 和CSRFHeader 是提交CSRF令牌的表单字段和请求头
+	CSRFField  = "csrf_token"
+	CSRFHeader = "X-CSRF-Token"
+
+	defaultSessionHours = 168
+	minPassword         = 8
+	tokenBytes          = 32
+	pruneInterval       = time.Hour
+)
+
+// 认证方式
+const (
+	ViaSession = "session"
+	ViaProxy   = "proxy"
+	ViaBasic   = "basic"
+)
+
+var ErrInvalidLogin = errors.New("invalid username or password")
+
+var (
+	// proxyKey 用于生成反向代理认证的用户的CSRF令牌，每次启动重新生成
+	proxyKey = make([]byte, tokenBytes)
+	trusted  []*net.IPNet
+	// dummyHash 用于在用户名不存在时也做一次bcrypt比较，避免通过响应时间判断用户名是否存在
+	dummyHash = []byte("$2a$10$hxeVNVSsoekrTzdCeqFSfu0I5luS.tBtrxuagSiR59nmwAkmT3Hui")
+)
+
+func init() {
+	if _, err := rand.Read(proxyKey); err != nil {
+		logrus.Fatalf("Generate CSRF key failed: %v", err)
+	}
+}
+
+// Init 读取信任的反向代理地址和上传令牌的密钥
+func Init() {
+	for _, addr := range conf.Xml.Auth.Proxy.Trusted {
+		addr = strings.TrimSpace(addr)
+		if !strings.Contains(addr, "/") {
+			if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+				addr += "/32"
+			} else {
+				addr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			logrus.Fatalf("Parse <auth><proxy><trusted> '%s' failed: %v", addr, err)
+		}
+		trusted = append(trusted, network)
+	}
+	initTokenKeys()
+}
+
+// Identity 是一个请求的用户。CSRF是修改数据的请求需要提交的令牌，Basic认证的请求不会被浏览器自动带上，不需要令牌
+type Identity struct {
+	Username string
+	Via      string
+	CSRF     string
+	Perms    *Permissions
+}
+
+// CheckCSRF 判断请求提交的CSRF令牌是否正确
+func (id *Identity) CheckCSRF(token string) bool {
+	if id.CSRF == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(id.CSRF), []byte(token)) == 1
+}
+
+// CanLogout 判断用户能否在界面上退出登录，反向代理认证的用户要在代理上退出
+func (id *Identity) CanLogout() bool {
+	return id.Via == ViaSession
+}
+
+// Enabled 判断查看服务器是否需要登录
+func Enabled() bool {
+	return conf.Xml.Auth.Enable
+}
+
+// Start 定期删除过期的会话
+func Start() {
+	if !Enabled() {
+		return
+	}
+	job.Every("session cleanup", pruneInterval, func() {
+		if n, err := db.DeleteExpiredSessions(time.Now()); err == nil && n > 0 {
+			logrus.Infof("Deleted %d expired sessions", n)
+		}
+	})
+}
+
+// SessionDuration 是会话的有效时间
+func SessionDuration() time.Duration {
+	hours := conf.Xml.Auth.SessionHours
+	if hours <= 0 {
+		hours = defaultSessionHours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func sign(key []byte, message string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// HashPassword 返回密码的bcrypt哈希
+func HashPassword(password string) (string, error) {
+	if len(password) < minPassword {
+		return "", fmt.Errorf("password must have at least %d characters", minPassword)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// SetUser 创建账号，或者修改已有账号的密码和禁用状态，password为空时不修改密码
+func SetUser(username string, password string, disabled bool) (*db.User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, fmt.Errorf("empty username")
+	}
+	user, err := db.QueryUser(username)
+	if db.IsNotFound(err) {
+		if password == "" {
+			return nil, fmt.Errorf("a new user needs a password")
+		}
+		user = &db.User{Username: username}
+	} else if err != nil {
+		return nil, err
+	}
+	logout := disabled && !user.Disabled
+	if password != "" {
+		if user.PasswordHash, err = HashPassword(password); err != nil {
+			return nil, err
+		}
+		logout = true
+	}
+	user.Disabled = disabled
+	if err := db.SaveUser(user, logout && user.ID != 0); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Check 校验用户名和密码，被禁用的账号不能登录
+func Check(username string, password string) (*db.User, error) {
+	user, err := db.QueryUser(username)
+	if err != nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		if db.IsNotFound(err) {
+			return nil, ErrInvalidLogin
+		}
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil || user.Disabled {
+		return nil, ErrInvalidLogin
+	}
+	return user, nil
+}
+
+// Login 校验用户名和密码并创建会话，返回cookie里保存的令牌
+func Login(username string, password string) (*db.User, string, error) {
+	user, err := Check(username, password)
+	if err != nil {
+		return nil, "", err
+	}
+	raw := make([]byte, tokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	now := time.Now()
+	session := &db.Session{TokenHash: hashToken(token), UserID: user.ID, ExpiresAt: now.Add(SessionDuration()), CreatedAt: now}
+	if err := db.AddSession(session); err != nil {
+		return nil, "", err
+	}
+	logrus.Infof("User '%s' logged in", user.Username)
+	return user, token, nil
+}
+
+// Logout 删除令牌对应的会话
+func Logout(token string) error {
+	return db.DeleteSession(hashToken(token))
+}
+
+// TrustedProxy 判断请求是不是直接来自可信的反向代理
+func TrustedProxy(remoteIP string) bool {
+	ip := net.ParseIP(remoteIP)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate 依次用反向代理的请求头、HTTP Basic认证和会话cookie识别用户，没有登录时返回nil。
+// remoteIP是TCP连接的对端地址，不能用X-Forwarded-For之类可以伪造的值
+func Authenticate(req *http.Request, remoteIP string) (*Identity, error) {
+	if header := conf.Xml.Auth.Proxy.Header; header != "" && TrustedProxy(remoteIP) {
+		if username := strings.TrimSpace(req.Header.Get(header)); username != "" {
+			return proxyIdentity(username)
+		}
+	}
+	if username, password, ok := req.BasicAuth(); ok {
+		user, err := Check(username, password)
+		if err != nil {
+			return nil, err
+		}
+		return userIdentity(user, ViaBasic, "")
+	}
+	cookie, err := req.Cookie(CookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+	_, user, err := db.QuerySession(hashToken(cookie.Value), time.Now())
+	if err != nil {
+		if db.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// 会话的CSRF令牌用会话令牌签名，重启后仍然有效，不知道cookie的页面算不出来
+	return userIdentity(user, ViaSession, sign([]byte(cookie.Value), "csrf"))
+}
+
+func userIdentity(user *db.User, via string, csrf string) (*Identity, error) {
+	grants, err := db.QueryGrants(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Username: user.Username, Via: via, CSRF: csrf, Perms: NewPermissions(grants)}, nil
+}
+
+// proxyIdentity 返回反向代理认证的用户，同名的本地账号被禁用时当作没有登录
+func proxyIdentity(username string) (*Identity, error) {
+	csrf := sign(proxyKey, username)
+	user, err := db.QueryUser(username)
+	if db.IsNotFound(err) {
+		return &Identity{Username: username, Via: ViaProxy, CSRF: csrf, Perms: proxyPermissions()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, nil
+	}
+	return userIdentity(user, ViaProxy, csrf)
+}
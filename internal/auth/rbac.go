@@ -0,0 +1,131 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package auth
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Permissions 是一个用户在各个程序上的角色级别，nil表示没有开启登录，不限制
+type Permissions struct {
+	all      int
+	programs map[string]int
+}
+
+// NewPermissions 从账号的授权生成权限，同一个程序上取最高的角色
+func NewPermissions(grants []db.Grant) *Permissions {
+	p := &Permissions{programs: make(map[string]int)}
+	for _, g := range grants {
+		level := db.RoleLevel(g.Role)
+		if g.Program == db.AllPrograms {
+			if level > p.all {
+				p.all = level
+			}
+		} else if level > p.programs[g.Program] {
+			p.programs[g.Program] = level
+		}
+	}
+	return p
+}
+
+// proxyPermissions 是没有本地账号的反向代理用户的权限，所有程序上都是<auth><proxy><role>
+func proxyPermissions() *Permissions {
+	return &Permissions{all: db.RoleLevel(conf.Xml.Auth.Proxy.Role), programs: make(map[string]int)}
+}
+
+// Can 判断用户在程序上是否至少有role，program为空表示不属于任何程序，只看对所有程序的授权
+func (p *Permissions) Can(program string, role string) bool {
+	if p == nil {
+		return true
+	}
+	level := db.RoleLevel(role)
+	if level == 0 {
+		return false
+	}
+	return p.all >= level || (program != "" && p.programs[program] >= level)
+}
+
+// Global 判断用户是否在所有程序上都至少有role
+func (p *Permissions) Global(role string) bool {
+	return p.Can("", role)
+}
+
+// Programs 返回用户至少有role的程序，all为true时不限制程序
+func (p *Permissions) Programs(role string) (all bool, programs []string) {
+	if p.Global(role) {
+		return true, nil
+	}
+	level := db.RoleLevel(role)
+	programs = []string{}
+	for program, l := range p.programs {
+		if l >= level {
+			programs = append(programs, program)
+		}
+	}
+	sort.Strings(programs)
+	return false, programs
+}
+
+// SetGrant 设置账号在程序上的角色，program为db.AllPrograms时对所有程序生效，role为空时删除授权
+func SetGrant(username string, program string, role string) error {
+	program = strings.TrimSpace(program)
+	if program == "" {
+		return fmt.Errorf("empty program, use '%s' for all programs", db.AllPrograms)
+	}
+	if role == "none" {
+		role = ""
+	}
+	if role != "" && db.RoleLevel(role) == 0 {
+		return fmt.Errorf("invalid role '%s'", role)
+	}
+	user, err := db.QueryUser(username)
+	if err != nil {
+		if db.IsNotFound(err) {
+			return fmt.Errorf("user '%s' not found", username)
+		}
+		return err
+	}
+	if err := db.SetGrant(user.ID, program, role); err != nil {
+		return err
+	}
+	if role == "" {
+		logrus.Infof("Revoked grant of user '%s' on '%s'", username, program)
+	} else {
+		logrus.Infof("Granted %s on '%s' to user '%s'", role, program, username)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package auth
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// UploadKeyHeader 和UploadKeyField 是提交上传密钥的请求头和表单字段
+	UploadKeyHeader = "X-API-Key"
+	UploadKeyField  = "api_key"
+
+	uploadKeyPrefix = "bpk_"
+	// touchInterval 内重复使用密钥时不再更新使用时间，避免每次上传都写数据库
+	touchInterval = time.Minute
+)
+
+var (
+	ErrNoUploadKey      = errors.New("missing API key")
+	ErrInvalidUploadKey = errors.New("invalid or revoked API key")
+	ErrUploadDenied     = errors.New("API key is not allowed to upload this")
+)
+
+// UploadKeysEnabled 判断上传端口是否需要API密钥
+func UploadKeysEnabled() bool {
+	return conf.Xml.Auth.Upload.Enable
+}
+
+// NewUploadKey 创建上传密钥，返回保存的密钥和只在这时能拿到的密钥明文
+func NewUploadKey(name string, programs []string, permissions []string, by string) (*db.UploadKey, string, error) {
+	key := &db.UploadKey{Name: strings.TrimSpace(name), CreatedBy: by}
+	if key.Name == "" {
+		return nil, "", fmt.Errorf("empty key name")
+	}
+	cleaned := make([]string, 0, len(programs))
+	for _, p := range programs {
+		if p = strings.TrimSpace(p); p != "" {
+			cleaned = append(cleaned, p)
+		}
+	}
+	if len(cleaned) == 0 {
+		return nil, "", fmt.Errorf("no program, use '%s' for all programs", db.AllPrograms)
+	}
+	key.Programs = strings.Join(cleaned, ",")
+	for _, p := range permissions {
+		switch strings.TrimSpace(p) {
+		case db.UploadDump:
+			key.Dump = true
+		case db.UploadSymbol:
+			key.Symbol = true
+		case "":
+		default:
+			return nil, "", fmt.Errorf("invalid permission '%s', use '%s' or '%s'", p, db.UploadDump, db.UploadSymbol)
+		}
+	}
+	if !key.Dump && !key.Symbol {
+		return nil, "", fmt.Errorf("no permission, use '%s' and/or '%s'", db.UploadDump, db.UploadSymbol)
+	}
+	raw := make([]byte, tokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	secret := uploadKeyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	key.Prefix = secret[:len(uploadKeyPrefix)+6]
+	key.KeyHash = hashToken(secret)
+	if err := db.AddUploadKey(key); err != nil {
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+// RevokeUploadKey 吊销上传密钥，吊销后立即不能再使用
+func RevokeUploadKey(id uint, by string) error {
+	err := db.RevokeUploadKey(id, by, time.Now())
+	if db.IsNotFound(err) {
+		return fmt.Errorf("upload key %d not found or already revoked", id)
+	}
+	return err
+}
+
+// CheckUploadKey 校验密钥能否给程序上传permission类型的文件，并记录密钥的使用时间
+func CheckUploadKey(secret string, program string, permission string) (*db.UploadKey, error) {
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return nil, ErrNoUploadKey
+	}
+	key, err := db.QueryUploadKey(hashToken(secret))
+	if db.IsNotFound(err) {
+		return nil, ErrInvalidUploadKey
+	} else if err != nil {
+		return nil, err
+	}
+	if key.RevokedAt != nil {
+		return nil, ErrInvalidUploadKey
+	}
+	if !key.Allows(program, permission) {
+		return key, ErrUploadDenied
+	}
+	now := time.Now()
+	db.TouchUploadKey(key.ID, now, now.Add(-touchInterval))
+	return key, nil
+}
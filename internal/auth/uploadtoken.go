@@ -0,0 +1,171 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package auth
+
+import (
+	"bp-server/internal/conf"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// UploadTokenHeader 和UploadTokenField 是提交上传令牌的请求头和表单字段
+	UploadTokenHeader = "X-Upload-Token"
+	UploadTokenField  = "upload_token"
+
+	uploadTokenPrefix   = "bpt_"
+	minTokenSecret      = 32
+	defaultTokenMinutes = 60
+	defaultBuildHours   = 24 * 365
+)
+
+var (
+	ErrInvalidUploadToken = errors.New("invalid upload token")
+	ErrUploadTokenExpired = errors.New("upload token expired")
+	ErrTokenMismatch      = errors.New("upload token is for another program or version")
+)
+
+// tokenKeys 是签名密钥，第一个签发新令牌
+var tokenKeys []tokenKey
+
+type tokenKey struct {
+	id     string
+	secret []byte
+}
+
+// tokenClaims 是令牌的内容，字段名尽量短，令牌会放在请求头里
+type tokenClaims struct {
+	Key     string `json:"k"`
+	Program string `json:"p"`
+	Version string `json:"v"`
+	Expires int64  `json:"e"`
+}
+
+// initTokenKeys 读取签名上传令牌的密钥
+func initTokenKeys() {
+	seen := make(map[string]bool)
+	for _, k := range conf.Xml.Auth.Upload.Token.Keys {
+		id, secret := strings.TrimSpace(k.ID), strings.TrimSpace(k.Secret)
+		if id == "" || strings.ContainsAny(id, ".") {
+			logrus.Fatalf("Invalid <auth><upload><token><key> id '%s'", id)
+		}
+		if seen[id] {
+			logrus.Fatalf("Duplicate <auth><upload><token><key> id '%s'", id)
+		}
+		if len(secret) < minTokenSecret {
+			logrus.Fatalf("<auth><upload><token><key> '%s' must have at least %d characters", id, minTokenSecret)
+		}
+		seen[id] = true
+		tokenKeys = append(tokenKeys, tokenKey{id: id, secret: []byte(secret)})
+	}
+}
+
+// UploadTokensEnabled 判断是否配置了上传令牌的签名密钥
+func UploadTokensEnabled() bool {
+	return len(tokenKeys) > 0
+}
+
+// HandshakeTTL 是握手领取的令牌的有效时间
+func HandshakeTTL() time.Duration {
+	minutes := conf.Xml.Auth.Upload.Token.TTLMinutes
+	if minutes <= 0 {
+		minutes = defaultTokenMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// MaxBuildTTL 是用API密钥领取的令牌最长的有效时间
+func MaxBuildTTL() time.Duration {
+	hours := conf.Xml.Auth.Upload.Token.BuildHours
+	if hours <= 0 {
+		hours = defaultBuildHours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// IssueUploadToken 用当前的密钥签发上传令牌，令牌只能上传program的version版本的dump
+func IssueUploadToken(program string, version string, ttl time.Duration) (string, time.Time, error) {
+	if !UploadTokensEnabled() {
+		return "", time.Time{}, fmt.Errorf("no upload token key configured")
+	}
+	if program == "" || version == "" {
+		return "", time.Time{}, fmt.Errorf("a token needs a program and a version")
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	key := tokenKeys[0]
+	payload, err := json.Marshal(tokenClaims{Key: key.id, Program: program, Version: version, Expires: expires.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return uploadTokenPrefix + encoded + "." + sign(key.secret, encoded), expires, nil
+}
+
+// VerifyUploadToken 校验令牌的签名和有效期，以及令牌是不是签发给program的version版本的
+func VerifyUploadToken(token string, program string, version string) error {
+	encoded, signature, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(token), uploadTokenPrefix), ".")
+	if !ok {
+		return ErrInvalidUploadToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return ErrInvalidUploadToken
+	}
+	claims := tokenClaims{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ErrInvalidUploadToken
+	}
+	var key *tokenKey
+	for i := range tokenKeys {
+		if tokenKeys[i].id == claims.Key {
+			key = &tokenKeys[i]
+			break
+		}
+	}
+	// 密钥被移除后，用它签发的令牌都失效
+	if key == nil || !hmac.Equal([]byte(sign(key.secret, encoded)), []byte(signature)) {
+		return ErrInvalidUploadToken
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return ErrUploadTokenExpired
+	}
+	if claims.Program != program || claims.Version != version {
+		return ErrTokenMismatch
+	}
+	return nil
+}
@@ -32,12 +32,16 @@ package breakpad
 
 import (
 	"bp-server/internal/conf"
+	"bp-server/internal/minidump"
+	"bp-server/internal/symbols"
 	"os/exec"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
-func init() {
+// Init 检查stackwalk需要的配置
+func Init() {
 	if conf.Xml.DumpPath == "" {
 		panic("config file 'dump' is empty")
 	}
@@ -50,9 +54,19 @@ func init() {
 }
 
 func WalkStack(dumpPath string) (string, error) {
-	out, err := exec.Command(conf.Xml.ExePath, dumpPath, conf.Xml.SymbolPath).Output()
+	var modules []minidump.Module
+	dump, err := minidump.ParseFile(dumpPath)
 	if err != nil {
-		logrus.Errorf("Execute command '%s %s %s' failed: %v", conf.Xml.ExePath, dumpPath, conf.Xml.SymbolPath, err)
+		logrus.Warnf("Parse minidump '%s' failed, compressed symbols will not be used: %v", dumpPath, err)
+	} else {
+		modules = dump.Modules
+	}
+	symbolPaths, release := symbols.Prepare(modules)
+	defer release()
+	args := append([]string{dumpPath}, symbolPaths...)
+	out, err := exec.Command(conf.Xml.ExePath, args...).Output()
+	if err != nil {
+		logrus.Errorf("Execute command '%s %s' failed: %v", conf.Xml.ExePath, strings.Join(args, " "), err)
 		return "", err
 	} else {
 		return string(out), nil
@@ -0,0 +1,189 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package chart
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"math"
+	"strings"
+)
+
+// palette 是图表的配色，序列多于颜色数量时循环使用
+var palette = []string{
+	"#4e79a7", "#f28e2b", "#e15759", "#76b7b2", "#59a14f",
+	"#edc948", "#b07aa1", "#ff9da7", "#9c755f", "#bab0ac",
+}
+
+const (
+	width       = 960
+	plotLeft    = 60
+	plotTop     = 20
+	plotHeight  = 260
+	xLabelSpace = 60
+	legendRow   = 20
+	barRow      = 24
+	labelWidth  = 300
+	fontSize    = 12
+)
+
+// Series 是堆叠柱状图的一个序列，Values和横轴标签一一对应
+type Series struct {
+	Name   string
+	Values []int64
+}
+
+// Bar 是横向柱状图的一行
+type Bar struct {
+	Label string
+	Value int64
+	Link  string
+}
+
+func color(i int) string {
+	return palette[i%len(palette)]
+}
+
+// niceStep 返回不小于max/ticks的1、2、5乘10的幂，使每个刻度都是整数
+func niceStep(max int64, ticks int64) int64 {
+	raw := float64(max) / float64(ticks)
+	if raw <= 1 {
+		return 1
+	}
+	magnitude := int64(math.Pow(10, math.Floor(math.Log10(raw))))
+	for _, step := range []int64{1, 2, 5, 10} {
+		if float64(step*magnitude) >= raw {
+			return step * magnitude
+		}
+	}
+	return 10 * magnitude
+}
+
+func text(b *strings.Builder, x, y float64, anchor string, extra string, content string) {
+	fmt.Fprintf(b, `<text x="%.1f" y="%.1f" font-size="%d" text-anchor="%s" %s>%s</text>`,
+		x, y, fontSize, anchor, extra, html.EscapeString(content))
+}
+
+// StackedBars 画按横轴标签堆叠的柱状图，每个标签一根柱子，每个序列一种颜色
+func StackedBars(labels []string, series []Series) template.HTML {
+	legendRows := (len(series) + 4) / 5
+	height := plotTop + plotHeight + xLabelSpace + legendRows*legendRow
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif">`, width, height)
+	var max int64
+	for i := range labels {
+		var total int64
+		for _, s := range series {
+			total += s.Values[i]
+		}
+		if total > max {
+			max = total
+		}
+	}
+	const ticks = 4
+	step := niceStep(max, ticks)
+	top := step * ticks
+	plotWidth := float64(width - plotLeft - 10)
+	for i := 0; i <= ticks; i++ {
+		y := float64(plotTop) + float64(plotHeight)*float64(i)/ticks
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#ddd"/>`, plotLeft, y, width-10, y)
+		text(&b, plotLeft-6, y+4, "end", "", fmt.Sprint(step*int64(ticks-i)))
+	}
+	if len(labels) > 0 {
+		slot := plotWidth / float64(len(labels))
+		barWidth := math.Max(slot*0.8, 1)
+		every := (len(labels) + 14) / 15
+		for i, label := range labels {
+			x := float64(plotLeft) + slot*float64(i) + (slot-barWidth)/2
+			y := float64(plotTop + plotHeight)
+			for j, s := range series {
+				if s.Values[i] == 0 {
+					continue
+				}
+				h := float64(plotHeight) * float64(s.Values[i]) / float64(top)
+				y -= h
+				fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s %s: %d</title></rect>`,
+					x, y, barWidth, h, color(j), html.EscapeString(label), html.EscapeString(s.Name), s.Values[i])
+			}
+			if i%every == 0 {
+				lx := x + barWidth/2
+				ly := float64(plotTop+plotHeight) + 14
+				text(&b, lx, ly, "end", fmt.Sprintf(`transform="rotate(-45 %.1f %.1f)"`, lx, ly), label)
+			}
+		}
+	}
+	for j, s := range series {
+		x := plotLeft + (j%5)*180
+		y := plotTop + plotHeight + xLabelSpace + (j/5)*legendRow
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="12" height="12" fill="%s"/>`, x, y, color(j))
+		text(&b, float64(x+16), float64(y+10), "start", "", s.Name)
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// HorizontalBars 画横向柱状图，Link不为空时标签是链接
+func HorizontalBars(bars []Bar) template.HTML {
+	height := len(bars)*barRow + 10
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif">`, width, height)
+	var max int64
+	for _, bar := range bars {
+		if bar.Value > max {
+			max = bar.Value
+		}
+	}
+	if max == 0 {
+		max = 1
+	}
+	plotWidth := float64(width - labelWidth - 80)
+	for i, bar := range bars {
+		y := float64(i*barRow + 5)
+		label := bar.Label
+		if runes := []rune(label); len(runes) > 48 {
+			label = string(runes[:45]) + "..."
+		}
+		if bar.Link != "" {
+			fmt.Fprintf(&b, `<a href="%s">`, html.EscapeString(bar.Link))
+		}
+		text(&b, labelWidth-6, y+14, "end", "", label)
+		if bar.Link != "" {
+			b.WriteString(`</a>`)
+		}
+		w := math.Max(plotWidth*float64(bar.Value)/float64(max), 1)
+		fmt.Fprintf(&b, `<rect x="%d" y="%.1f" width="%.1f" height="%d" fill="%s"><title>%s: %d</title></rect>`,
+			labelWidth, y, w, barRow-6, color(0), html.EscapeString(bar.Label), bar.Value)
+		text(&b, float64(labelWidth)+w+6, y+14, "start", "", fmt.Sprint(bar.Value))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
@@ -0,0 +1,112 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package clock
+
+import (
+	"bp-server/internal/conf"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultTolerance = 5 * time.Minute
+
+// minValidTime 之前的时间一定来自没有设置过的时钟
+var minValidTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Crash 是根据客户端上报的信息推算出的崩溃时间
+type Crash struct {
+	Time   time.Time
+	Skew   int64
+	Skewed bool
+}
+
+func tolerance() time.Duration {
+	if conf.Xml.Clock.SkewTolerance <= 0 {
+		return defaultTolerance
+	}
+	return time.Duration(conf.Xml.Clock.SkewTolerance) * time.Second
+}
+
+// Resolve 推算崩溃时间。crashTime依次取表单里的crash_time、minidump头里的时间，
+// 都没有时使用服务器收到的时间。客户端上报了client_time时用它计算时钟偏差并修正崩溃时间；
+// 没有上报时，比收到时间还晚或者早于2000年的崩溃时间被认为是客户端时钟错误
+func Resolve(received time.Time, crashTime time.Time, clientTime time.Time) Crash {
+	if crashTime.IsZero() {
+		return Crash{Time: received}
+	}
+	crash := Crash{Time: crashTime}
+	if !clientTime.IsZero() {
+		skew := received.Sub(clientTime)
+		crash.Skew = int64(skew / time.Second)
+		if skew > tolerance() || skew < -tolerance() {
+			crash.Skewed = true
+			crash.Time = crashTime.Add(time.Duration(crash.Skew) * time.Second)
+		}
+	}
+	if crash.Time.After(received.Add(tolerance())) || crash.Time.Before(minValidTime) {
+		crash.Skewed = true
+		crash.Time = received
+	}
+	return crash
+}
+
+// Parse 解析客户端上报的时间，支持unix时间戳(秒)和RFC3339
+func Parse(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s', expect unix seconds or RFC3339", value)
+	}
+	return t, nil
+}
+
+// Location 返回name对应的时区，name为空时使用配置的时区，都没有时使用服务器本地时区
+func Location(name string) *time.Location {
+	if name == "" {
+		name = conf.Xml.Clock.Timezone
+	}
+	if name == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
@@ -0,0 +1,199 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package compress
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	None = "none"
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// Methods 所有支持的压缩方式，按探测顺序排列
+var Methods = []string{None, Zstd, Gzip}
+
+// Normalize 把配置里的压缩方式转成规范名字，空字符串视为不压缩
+func Normalize(method string) (string, error) {
+	method = strings.ToLower(strings.TrimSpace(method))
+	switch method {
+	case "", None:
+		return None, nil
+	case Gzip, "gz":
+		return Gzip, nil
+	case Zstd, "zst":
+		return Zstd, nil
+	default:
+		return "", fmt.Errorf("unknown compress method '%s'", method)
+	}
+}
+
+// Ext 返回压缩方式对应的文件扩展名
+func Ext(method string) string {
+	switch method {
+	case Gzip:
+		return ".gz"
+	case Zstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// FromName 根据文件扩展名推断压缩方式，返回压缩方式和去掉扩展名后的文件名
+func FromName(filename string) (string, string) {
+	for _, method := range Methods {
+		ext := Ext(method)
+		if ext != "" && strings.HasSuffix(filename, ext) {
+			return method, strings.TrimSuffix(filename, ext)
+		}
+	}
+	return None, filename
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+// NewWriter 返回一个按method压缩的Writer，调用者必须Close以刷新数据，
+// Close不会关闭底层的w
+func NewWriter(method string, w io.Writer) (io.WriteCloser, error) {
+	switch method {
+	case None:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown compress method '%s'", method)
+	}
+}
+
+// NewReader 返回一个按method解压的Reader，Close不会关闭底层的r
+func NewReader(method string, r io.Reader) (io.ReadCloser, error) {
+	switch method {
+	case None:
+		return io.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{decoder}, nil
+	default:
+		return nil, fmt.Errorf("unknown compress method '%s'", method)
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// WriteFile 把r按method压缩后写入fullpath，返回写入磁盘的字节数。
+// 先写同目录下的临时文件再rename，读者不会看到写了一半的文件
+func WriteFile(fullpath string, r io.Reader, method string) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(fullpath), ".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	counter := &countingWriter{w: tmp}
+	writer, err := NewWriter(method, counter)
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if _, err = io.Copy(writer, r); err == nil {
+		err = writer.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return counter.n, os.Rename(tmp.Name(), fullpath)
+}
+
+// Normalized 和Normalize一样但忽略错误，无法识别的方式视为不压缩，用于读取数据库中记录的值
+func Normalized(method string) string {
+	m, err := Normalize(method)
+	if err != nil {
+		return None
+	}
+	return m
+}
+
+// Compressed 返回一个读出r按method压缩后数据的Reader，压缩在单独的goroutine里进行。
+// 调用者读完或放弃读取后必须Close
+func Compressed(method string, r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		writer, err := NewWriter(method, pw)
+		if err == nil {
+			if _, err = io.Copy(writer, r); err == nil {
+				err = writer.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
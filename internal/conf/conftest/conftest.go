@@ -0,0 +1,59 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package conftest
+
+import (
+	"bp-server/internal/conf"
+	"os"
+	"path/filepath"
+)
+
+// ConfigEnv 是测试使用的配置文件路径的环境变量，go test的命令行参数不能用-c指定配置
+const ConfigEnv = "BP_SERVER_CONFIG"
+
+// Load 给测试读取ConfigEnv指定的配置，没有指定时使用默认配置，并把数据库和文件目录放到临时目录，测试不会写到源码目录里。
+// 测试在TestMain里先调用Load，再初始化用到的包
+func Load() {
+	xmlPath := os.Getenv(ConfigEnv)
+	if err := conf.Load(xmlPath); err != nil {
+		panic(err)
+	}
+	if xmlPath != "" {
+		return
+	}
+	dir, err := os.MkdirTemp("", "bp-server-test-")
+	if err != nil {
+		panic(err)
+	}
+	conf.Xml.DB.DSN = filepath.Join(dir, "dumps.db")
+	conf.Xml.DumpPath = filepath.Join(dir, "dumps")
+	conf.Xml.SymbolPath = filepath.Join(dir, "symbols")
+}
@@ -50,14 +50,124 @@ const defaultXmlConfig = `
         <maxage>30</maxage>
     </log>
 
+    <storage>
+        <type>local</type>
+    </storage>
+
     <db>./dumps.db</db>
     <dump>./dumps/</dump>
     <symbol>./symbols</symbol>
     <exe>minidump_stackwalk</exe>
 
+    <symbol_store>
+        <compress>none</compress>
+        <cache_path>./symbols_cache</cache_path>
+        <cache_size>1024</cache_size>
+        <gc>
+            <enable>false</enable>
+            <interval>24</interval>
+            <crash_days>90</crash_days>
+            <keep_releases>5</keep_releases>
+            <min_age>7</min_age>
+        </gc>
+    </symbol_store>
+
+    <dump_store>
+        <compress>zstd</compress>
+    </dump_store>
+
+    <process>
+        <workers>2</workers>
+        <signature_depth>3</signature_depth>
+        <retries>5</retries>
+    </process>
+
+    <signature>
+    </signature>
+
+    <stats>
+        <interval>10</interval>
+    </stats>
+
+    <similar>
+        <frames>10</frames>
+        <min_score>0.6</min_score>
+        <limit>10</limit>
+    </similar>
+
+    <retention>
+        <enable>false</enable>
+        <interval>60</interval>
+        <max_age>0</max_age>
+        <max_per_group>0</max_per_group>
+        <quota>0</quota>
+    </retention>
+
+    <clock>
+        <skew_tolerance>300</skew_tolerance>
+        <timezone></timezone>
+    </clock>
+
+    <triage>
+        <bug_url></bug_url>
+    </triage>
+
+    <usage>
+        <salt></salt>
+        <keep_days>90</keep_days>
+    </usage>
+
+    <crash_loop>
+        <window>10</window>
+        <count>3</count>
+    </crash_loop>
+
+    <webhooks>
+        <retries>8</retries>
+        <backoff>30</backoff>
+        <timeout>10</timeout>
+    </webhooks>
+
+    <spike>
+        <enable>false</enable>
+        <interval>10</interval>
+        <baseline_days>7</baseline_days>
+        <multiple>3</multiple>
+        <zscore>3</zscore>
+        <min_count>10</min_count>
+    </spike>
+
+    <tracker>
+        <url></url>
+        <method>POST</method>
+        <frames>10</frames>
+        <sync>
+            <enable>false</enable>
+            <interval>60</interval>
+        </sync>
+    </tracker>
+
+    <email>
+        <host></host>
+        <port>25</port>
+        <from>bp-server@localhost</from>
+        <digest>
+            <enable>false</enable>
+            <hour>8</hour>
+            <limit>10</limit>
+        </digest>
+    </email>
+
+    <auth>
+        <enable>false</enable>
+        <session_hours>168</session_hours>
+        <secure_cookie>false</secure_cookie>
+    </auth>
+
     <net>
         <mode>release</mode>
         <prefix></prefix>
+        <public_url></public_url>
         <view_ip>0.0.0.0</view_ip>
         <view_port>17000</view_port>
         <upload_ip>0.0.0.0</upload_ip>
@@ -70,12 +180,170 @@ const defaultXmlConfig = `
 var Xml relayConf
 
 type relayConf struct {
-	Log        logConf `xml:"log"`
-	Net        netConf `xml:"net"`
-	DB         string  `xml:"db"`
-	DumpPath   string  `xml:"dump"`
-	SymbolPath string  `xml:"symbol"`
-	ExePath    string  `xml:"exe"`
+	Log         logConf         `xml:"log"`
+	Net         netConf         `xml:"net"`
+	DB          dbConf          `xml:"db"`
+	DumpPath    string          `xml:"dump"`
+	SymbolPath  string          `xml:"symbol"`
+	ExePath     string          `xml:"exe"`
+	SymbolStore symbolStoreConf `xml:"symbol_store"`
+	DumpStore   dumpStoreConf   `xml:"dump_store"`
+	Process     processConf     `xml:"process"`
+	Signature   signatureConf   `xml:"signature"`
+	Similar     similarConf     `xml:"similar"`
+	Stats       statsConf       `xml:"stats"`
+	Retention   retentionConf   `xml:"retention"`
+	Storage     storageConf     `xml:"storage"`
+	Clock       clockConf       `xml:"clock"`
+	Triage      triageConf      `xml:"triage"`
+	Usage       usageConf       `xml:"usage"`
+	CrashLoop   crashLoopConf   `xml:"crash_loop"`
+	Webhooks    webhooksConf    `xml:"webhooks"`
+	Email       emailConf       `xml:"email"`
+	Spike       spikeConf       `xml:"spike"`
+	Tracker     trackerConf     `xml:"tracker"`
+	Auth        authConf        `xml:"auth"`
+}
+
+// trackerConf 是创建外部问题的HTTP接口，URL为空时不能创建问题。Body是text/template模板，
+// 执行结果作为请求内容发送。IssueID、IssueURL和IssueAPI是响应JSON里问题编号、网页地址和API地址的路径，
+// 路径用.分隔，数组用下标
+type trackerConf struct {
+	Name     string          `xml:"name"`
+	URL      string          `xml:"url"`
+	Method   string          `xml:"method"`
+	Headers  []TrackerHeader `xml:"header"`
+	Body     string          `xml:"body"`
+	Frames   int             `xml:"frames"`
+	IssueID  string          `xml:"issue_id"`
+	IssueURL string          `xml:"issue_url"`
+	IssueAPI string          `xml:"issue_api"`
+	Sync     trackerSyncConf `xml:"sync"`
+}
+
+type TrackerHeader struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// trackerSyncConf 定期用GET请求问题的API地址，State是响应JSON里状态的路径，值在Closed里时认为问题已关闭
+type trackerSyncConf struct {
+	Enable   bool     `xml:"enable"`
+	Interval int      `xml:"interval"`
+	State    string   `xml:"state"`
+	Closed   []string `xml:"closed"`
+}
+
+// spikeConf 是突增检测的配置：当天到目前为止的崩溃数不少于MinCount，并且超过之前BaselineDays天平均数的Multiple倍，
+// 或者比平均数高出ZScore个标准差时认为发生了突增。Multiple或ZScore为0时不使用对应的条件。
+// 基线里有崩溃的天数少于MinBaselineDays时不检测
+type spikeConf struct {
+	Enable          bool    `xml:"enable"`
+	Interval        int     `xml:"interval"`
+	BaselineDays    int     `xml:"baseline_days"`
+	Multiple        float64 `xml:"multiple"`
+	ZScore          float64 `xml:"zscore"`
+	MinCount        int64   `xml:"min_count"`
+	MinBaselineDays int     `xml:"min_baseline_days"`
+}
+
+// emailConf 是SMTP通知的配置，Host为空时不发送邮件。TLS为true时直接用TLS连接，
+// 否则在服务器支持时使用STARTTLS
+type emailConf struct {
+	Host       string          `xml:"host"`
+	Port       int             `xml:"port"`
+	Username   string          `xml:"username"`
+	Password   string          `xml:"password"`
+	TLS        bool            `xml:"tls"`
+	From       string          `xml:"from"`
+	Digest     digestConf      `xml:"digest"`
+	Alerts     alertsConf      `xml:"alerts"`
+	Recipients []RecipientConf `xml:"recipient"`
+}
+
+// digestConf 的Hour是<clock><timezone>时区下每天发送摘要的时间，摘要包含前一天的情况
+type digestConf struct {
+	Enable bool `xml:"enable"`
+	Hour   int  `xml:"hour"`
+	Limit  int  `xml:"limit"`
+}
+
+// alertsConf 是立即发送提醒的程序和事件，Events为空时提醒所有事件
+type alertsConf struct {
+	Programs []string `xml:"program"`
+	Events   []string `xml:"event"`
+}
+
+// RecipientConf 是一个收件人订阅的程序和分组，Programs为空时订阅所有程序
+type RecipientConf struct {
+	Address  string   `xml:"address,attr"`
+	Digest   bool     `xml:"digest,attr"`
+	Alerts   bool     `xml:"alerts,attr"`
+	Programs []string `xml:"program"`
+	Groups   []uint   `xml:"group"`
+}
+
+// webhooksConf 的Backoff是第一次重试前等待的秒数，之后每次重试等待的时间加倍
+type webhooksConf struct {
+	Retries int           `xml:"retries"`
+	Backoff int           `xml:"backoff"`
+	Timeout int           `xml:"timeout"`
+	Hooks   []WebhookConf `xml:"webhook"`
+}
+
+// WebhookConf 是一个接收事件的地址，Events和Programs为空时接收所有事件和所有程序的事件
+type WebhookConf struct {
+	Name     string   `xml:"name,attr"`
+	URL      string   `xml:"url"`
+	Secret   string   `xml:"secret"`
+	Events   []string `xml:"event"`
+	Programs []string `xml:"program"`
+}
+
+// crashLoopConf 同一个安装在Window分钟内崩溃在同一个分组Count次时认为发生了崩溃循环
+type crashLoopConf struct {
+	Window int `xml:"window"`
+	Count  int `xml:"count"`
+}
+
+// usageConf 的Salt用于对安装ID做哈希，KeepDays是每日安装记录保留的天数，0表示一直保留
+type usageConf struct {
+	Salt     string `xml:"salt"`
+	KeepDays int    `xml:"keep_days"`
+}
+
+// triageConf 的BugURL是外部缺陷的链接模板，其中的%s会被替换为分组的BugID
+type triageConf struct {
+	BugURL string `xml:"bug_url"`
+}
+
+type clockConf struct {
+	SkewTolerance int    `xml:"skew_tolerance"`
+	Timezone      string `xml:"timezone"`
+}
+
+// dbConf 的内容是DSN，driver属性可以是sqlite(默认)、postgres或mysql。
+// migrate属性为manual时启动时不自动执行数据库迁移
+type dbConf struct {
+	Driver  string `xml:"driver,attr"`
+	Migrate string `xml:"migrate,attr"`
+	DSN     string `xml:",chardata"`
+}
+
+type storageConf struct {
+	Type string `xml:"type"`
+	S3   S3Conf `xml:"s3"`
+}
+
+// S3Conf 是S3兼容对象存储的配置，dump和符号分别保存在Prefix下的dumps/和symbols/
+type S3Conf struct {
+	Endpoint  string `xml:"endpoint"`
+	Region    string `xml:"region"`
+	Bucket    string `xml:"bucket"`
+	Prefix    string `xml:"prefix"`
+	AccessKey string `xml:"access_key"`
+	SecretKey string `xml:"secret_key"`
+	Secure    bool   `xml:"secure"`
 }
 
 type logConf struct {
@@ -86,26 +354,162 @@ type logConf struct {
 	MaxAge  int    `xml:"maxage"`
 }
 
+type symbolStoreConf struct {
+	Compress  string `xml:"compress"`
+	CachePath string `xml:"cache_path"`
+	CacheSize int64  `xml:"cache_size"`
+	GC        gcConf `xml:"gc"`
+}
+
+type gcConf struct {
+	Enable       bool `xml:"enable"`
+	Interval     int  `xml:"interval"`
+	CrashDays    int  `xml:"crash_days"`
+	KeepReleases int  `xml:"keep_releases"`
+	MinAge       int  `xml:"min_age"`
+}
+
+type dumpStoreConf struct {
+	Compress string `xml:"compress"`
+}
+
+type processConf struct {
+	Workers        int `xml:"workers"`
+	SignatureDepth int `xml:"signature_depth"`
+	Retries        int `xml:"retries"`
+}
+
+type signatureConf struct {
+	SignatureRules
+	Programs []programSignature `xml:"program"`
+}
+
+// SignatureRules 是生成崩溃签名的规则，除了Normalize以外都是匹配整个函数名或模块名的正则表达式
+type SignatureRules struct {
+	Normalize  []NormalizeRule `xml:"normalize"`
+	Irrelevant []string        `xml:"irrelevant"`
+	Prefix     []string        `xml:"prefix"`
+	Skip       []string        `xml:"skip"`
+}
+
+type NormalizeRule struct {
+	Pattern string `xml:"pattern,attr"`
+	Replace string `xml:"replace,attr"`
+}
+
+type programSignature struct {
+	Name string `xml:"name,attr"`
+	SignatureRules
+}
+
+type statsConf struct {
+	Interval int `xml:"interval"`
+}
+
+type similarConf struct {
+	Frames   int     `xml:"frames"`
+	MinScore float64 `xml:"min_score"`
+	Limit    int     `xml:"limit"`
+}
+
+type retentionConf struct {
+	Enable   bool `xml:"enable"`
+	Interval int  `xml:"interval"`
+	Policy
+	Programs []programRetention `xml:"program"`
+}
+
+// Policy 是dump保留策略，值为0表示不限制
+type Policy struct {
+	MaxAge      int   `xml:"max_age"`
+	MaxPerGroup int   `xml:"max_per_group"`
+	Quota       int64 `xml:"quota"`
+}
+
+type programRetention struct {
+	Name string `xml:"name,attr"`
+	Policy
+}
+
+// netConf 的PublicURL是用户访问查看服务器的地址，包括Prefix，用于通知里的链接
 type netConf struct {
-	Mode       string `xml:"mode"`
-	Prefix     string `xml:"prefix"`
-	ViewPort   uint16 `xml:"view_port"`
-	ViewIP     string `xml:"view_ip"`
-	UploadPort uint16 `xml:"upload_port"`
-	UploadIP   string `xml:"upload_ip"`
+	Mode       string  `xml:"mode"`
+	Prefix     string  `xml:"prefix"`
+	PublicURL  string  `xml:"public_url"`
+	ViewPort   uint16  `xml:"view_port"`
+	ViewIP     string  `xml:"view_ip"`
+	UploadPort uint16  `xml:"upload_port"`
+	UploadIP   string  `xml:"upload_ip"`
+	ViewTLS    TLSConf `xml:"view_tls"`
+	UploadTLS  TLSConf `xml:"upload_tls"`
+}
+
+// TLSConf 是一个端口的HTTPS配置，Cert和Key为空时使用HTTP。证书文件修改后自动重新加载。
+// MinVersion是最低的TLS版本，如1.2、1.3。ClientCA不为空时校验客户端证书，
+// ClientAuth为require时必须有证书，为optional或空时只校验提供了的证书
+type TLSConf struct {
+	Cert       string `xml:"cert"`
+	Key        string `xml:"key"`
+	MinVersion string `xml:"min_version"`
+	ClientCA   string `xml:"client_ca"`
+	ClientAuth string `xml:"client_auth"`
+}
+
+// authConf 开启后查看服务器的所有页面和API都需要登录。SessionHours是登录的有效时间，
+// SecureCookie为true时会话cookie只通过HTTPS发送
+type authConf struct {
+	Enable       bool           `xml:"enable"`
+	SessionHours int            `xml:"session_hours"`
+	SecureCookie bool           `xml:"secure_cookie"`
+	Proxy        authProxyConf  `xml:"proxy"`
+	Upload       authUploadConf `xml:"upload"`
+}
+
+// authUploadConf 开启后上传端口的请求需要带上API密钥，密钥限定了程序和上传的类型
+type authUploadConf struct {
+	Enable bool          `xml:"enable"`
+	Token  authTokenConf `xml:"token"`
 }
 
-func init() {
-	xmlPath := flag.String("c", defaultXmlPath, "config file path")
+// authTokenConf 是签名的上传令牌，令牌绑定了程序和版本，不查数据库就能校验。Keys里第一个密钥签发新令牌，
+// 所有密钥都能校验令牌。Handshake为true时客户端不用API密钥也能为已经上传过符号的程序版本领取TTLMinutes的令牌，
+// 带dump权限的API密钥可以领取最长BuildHours的令牌，打包进发布的程序里
+type authTokenConf struct {
+	TTLMinutes int            `xml:"ttl_minutes"`
+	BuildHours int            `xml:"build_hours"`
+	Handshake  bool           `xml:"handshake"`
+	Keys       []authTokenKey `xml:"key"`
+}
+
+type authTokenKey struct {
+	ID     string `xml:"id,attr"`
+	Secret string `xml:",chardata"`
+}
+
+// authProxyConf 是前面的反向代理已经认证了用户时的配置，来自Trusted里的地址(IP或CIDR)的请求用Header的值作为用户名。
+// 有同名本地账号时使用账号的授权，否则在所有程序上是Role，Role为空时没有权限
+type authProxyConf struct {
+	Header  string   `xml:"header"`
+	Trusted []string `xml:"trusted"`
+	Role    string   `xml:"role"`
+}
+
+var xmlPath = flag.String("c", defaultXmlPath, "config file path")
+
+// Init 解析命令行参数并读取-c指定的配置文件，main在初始化其他包之前调用
+func Init() {
 	flag.Parse()
-	if err := loadConfig(*xmlPath); err != nil {
+	if err := Load(*xmlPath); err != nil {
 		panic(err)
 	}
 }
 
-func loadConfig(xmlPath string) error {
+// Load 读取配置文件，xmlPath为空时使用默认配置
+func Load(xmlPath string) error {
 	content, err := os.ReadFile(xmlPath)
-	if err != nil {
+	if xmlPath == "" {
+		content, err = []byte(defaultXmlConfig), nil
+	} else if err != nil {
 		fmt.Printf("Read config from '%s' failed, using default config.\n\n", xmlPath)
 		content = []byte(defaultXmlConfig)
 	}
@@ -32,11 +32,18 @@ package db
 
 import (
 	"bp-server/internal/conf"
+	"errors"
+	"flag"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/glebarez/sqlite"
 	"github.com/sirupsen/logrus"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var dbConn *gorm.DB
@@ -48,25 +55,135 @@ type Dump struct {
 	Version  string
 	Filename string
 	Build    string
+	Size     int64
+	Compress string
+	Hash     string `gorm:"index"`
+	Status   string `gorm:"index"`
+	GroupID  uint   `gorm:"index"`
+	// Duplicates 是内容完全相同的重复上传次数，重复上传不会生成新记录
+	Duplicates    int64
+	LastDuplicate *time.Time
+	// CrashTime 是修正过客户端时钟偏差的崩溃时间，CreatedAt是服务器收到dump的时间
+	CrashTime time.Time `gorm:"index"`
+	// ClockSkew 是服务器时间减客户端时间的秒数，客户端没有上报时间时为0
+	ClockSkew   int64
+	ClockSkewed bool
+	// OSVersion 和CPU 取自minidump的SystemInfo，用于统计
+	OSVersion string
+	CPU       string
+	// InstallHash 是服务器端对客户端安装ID做过哈希的结果，没有上报时为空
+	InstallHash string `gorm:"size:64;index"`
+	// CrashLoop 表示同一个安装在这个dump之前不久已经在同一个分组崩溃了多次
+	CrashLoop bool `gorm:"default:false"`
+	// Attempts 是stackwalk失败的次数，RetryAt之前pending的dump不会被重新处理
+	Attempts int `gorm:"default:0"`
+	RetryAt  *time.Time
 }
 
-func init() {
-	db, err := gorm.Open(sqlite.Open(conf.Xml.DB), &gorm.Config{})
+// DumpHash 记录每个程序的每个内容哈希属于哪个未清理的dump，Program和Hash是主键，同时上传的相同内容只有一个能插入成功。
+// 不同程序上传的相同内容是各自的dump，只共享存储的文件。
+// dumps表里被清理的dump还留着哈希，所以不能直接在dumps上建唯一索引
+type DumpHash struct {
+	Program string `gorm:"primaryKey;size:255"`
+	Hash    string `gorm:"primaryKey;size:64"`
+	DumpID  uint   `gorm:"index"`
+}
+
+// ErrDuplicateDump 表示已经有内容相同的dump
+var ErrDuplicateDump = errors.New("duplicate dump")
+
+const (
+	StatusPending   = "pending"
+	StatusProcessed = "processed"
+	StatusFailed    = "failed"
+)
+
+// Init 按配置打开数据库，需要时执行迁移
+func Init() {
+	dialector, err := openDialector(conf.Xml.DB.Driver, strings.TrimSpace(conf.Xml.DB.DSN))
+	if err != nil {
+		panic(err)
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
-		panic(fmt.Sprintf("Failed to open sqlite database(%s): %v", conf.Xml.DB, err))
+		panic(fmt.Sprintf("Failed to open %s database(%s): %v", dialector.Name(), conf.Xml.DB.DSN, err))
 	}
-	db.AutoMigrate(&Dump{})
 	dbConn = db
+	// 执行维护命令时不自动迁移，migrate -status只能查看，其他命令要求数据库已经是最新结构
+	if strings.ToLower(conf.Xml.DB.Migrate) == "manual" || flag.NArg() > 0 {
+		err = checkSchemaVersion()
+	} else {
+		err = Migrate()
+	}
+	if err != nil {
+		panic(fmt.Sprintf("Database schema: %v", err))
+	}
 }
 
-func QueryDumpList(page int) ([]Dump, error) {
+func openDialector(driver string, dsn string) (gorm.Dialector, error) {
+	switch strings.ToLower(driver) {
+	case "", "sqlite", "sqlite3":
+		return sqlite.Open(sqliteDSN(dsn)), nil
+	case "postgres", "postgresql":
+		return postgres.Open(dsn), nil
+	case "mysql":
+		return mysql.Open(dsn), nil
+	default:
+		return nil, fmt.Errorf("unknown database driver '%s'", driver)
+	}
+}
+
+// sqliteDSN 给SQLite的DSN加上等待锁的时间，事务开始时就取得写锁。
+// 否则多个worker同时写入时，读过数据的事务升级成写锁会直接失败
+func sqliteDSN(dsn string) string {
+	var params []string
+	if !strings.Contains(dsn, "busy_timeout") {
+		params = append(params, "_pragma=busy_timeout(10000)")
+	}
+	if !strings.Contains(dsn, "_txlock") {
+		params = append(params, "_txlock=immediate")
+	}
+	if len(params) == 0 {
+		return dsn
+	}
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	return dsn + separator + strings.Join(params, "&")
+}
+
+// DumpListFilter 是列表页的过滤条件，ByReceived为true时按服务器收到的时间而不是崩溃时间过滤和排序。
+// Programs不为nil时只返回这些程序的dump
+type DumpListFilter struct {
+	ByReceived bool
+	From       time.Time
+	To         time.Time
+	Programs   []string
+}
+
+func QueryDumpList(page int, filter DumpListFilter) ([]Dump, error) {
 	const kLimit int = 20
 	index := kLimit * page
 	if index < 0 {
 		index = 0
 	}
+	column := "crash_time"
+	if filter.ByReceived {
+		column = "created_at"
+	}
+	tx := dbConn.Order(column + " desc").Order("id desc")
+	if !filter.From.IsZero() {
+		tx = tx.Where(column+" >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		tx = tx.Where(column+" < ?", filter.To)
+	}
+	if filter.Programs != nil {
+		tx = tx.Where("program IN ?", filter.Programs)
+	}
 	var dumps []Dump
-	result := dbConn.Order("id desc").Limit(kLimit).Offset(index).Find(&dumps)
+	result := tx.Limit(kLimit).Offset(index).Find(&dumps)
 	if result.Error != nil {
 		logrus.Errorf("Query table 'dumps' with limit(%d) offset(%d) failed with: %v", kLimit, index, result.Error)
 		return nil, result.Error
@@ -74,17 +191,67 @@ func QueryDumpList(page int) ([]Dump, error) {
 	return dumps, nil
 }
 
-func AddDump(OS string, program string, version string, filename string, buildTime string) error {
-	dump := Dump{
-		OS:       OS,
-		Program:  program,
-		Version:  version,
-		Filename: filename,
-		Build:    buildTime,
+// AddDump 插入一个新上传的dump，状态设为pending。同一个程序已经有内容相同的dump时返回ErrDuplicateDump，不插入记录
+func AddDump(dump *Dump) error {
+	dump.Status = StatusPending
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(dump).Error; err != nil {
+			return err
+		}
+		if dump.Hash == "" {
+			return nil
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&DumpHash{Program: dump.Program, Hash: dump.Hash, DumpID: dump.ID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrDuplicateDump
+		}
+		return nil
+	})
+	if err == ErrDuplicateDump {
+		dump.ID = 0
+		return err
+	}
+	if err != nil {
+		logrus.Errorf("Insert record to table 'dumps' failed with: %v", err)
 	}
-	result := dbConn.Create(&dump)
+	return err
+}
+
+// QueryDumpByHash 返回程序里内容相同的未清理的dump
+func QueryDumpByHash(program string, hash string) (*Dump, error) {
+	dump := Dump{}
+	result := dbConn.Where("id = (SELECT dump_id FROM dump_hashes WHERE program = ? AND hash = ?)", program, hash).Limit(1).Find(&dump)
+	if result.Error != nil {
+		logrus.Errorf("Select table 'dumps' with {program:'%s', hash:'%s'} failed with: %v", program, hash, result.Error)
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &dump, nil
+}
+
+func HasOtherDumpWithHash(hash string, id uint) (bool, error) {
+	var count int64
+	result := dbConn.Model(&Dump{}).Where("hash = ? AND id <> ?", hash, id).Count(&count)
+	if result.Error != nil {
+		logrus.Errorf("Count dumps with {hash:'%s'} failed with: %v", hash, result.Error)
+		return false, result.Error
+	}
+	return count > 0, nil
+}
+
+// AddDuplicate 记录一次重复上传
+func AddDuplicate(id uint) error {
+	result := dbConn.Model(&Dump{}).Where("id = ?", id).Updates(map[string]any{
+		"duplicates":     gorm.Expr("duplicates + 1"),
+		"last_duplicate": time.Now(),
+	})
 	if result.Error != nil {
-		logrus.Error("Insert record to table 'dumps' failed")
+		logrus.Errorf("Update duplicates of dump %d failed with: %v", id, result.Error)
 		return result.Error
 	}
 	return nil
@@ -100,3 +267,33 @@ func QueryDump(id uint) (*Dump, error) {
 	}
 	return &dump, nil
 }
+
+// QueryDumpsToConvert 分页返回压缩方式不是method或者还没按内容寻址保存的dump
+func QueryDumpsToConvert(method string, afterID uint, limit int) ([]Dump, error) {
+	var dumps []Dump
+	tx := dbConn.Where("id > ?", afterID)
+	if method == "none" {
+		tx = tx.Where("(compress <> '' AND compress <> ?) OR hash = '' OR hash IS NULL", method)
+	} else {
+		tx = tx.Where("compress <> ? OR compress IS NULL OR hash = '' OR hash IS NULL", method)
+	}
+	result := tx.Order("id").Limit(limit).Find(&dumps)
+	if result.Error != nil {
+		logrus.Errorf("Query dumps to convert to %s failed with: %v", method, result.Error)
+		return nil, result.Error
+	}
+	return dumps, nil
+}
+
+func UpdateDumpStorage(dump *Dump, method string, size int64, hash string) error {
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Dump{}).Where("id = ?", dump.ID).Updates(map[string]any{"compress": method, "size": size, "hash": hash}).Error; err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&DumpHash{Program: dump.Program, Hash: hash, DumpID: dump.ID}).Error
+	})
+	if err != nil {
+		logrus.Errorf("Update compress method of dump %d failed with: %v", dump.ID, err)
+	}
+	return err
+}
@@ -0,0 +1,384 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/conf/conftest"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// postgresEnv 是测试用的PostgreSQL的DSN，设置后测试在其中的bp_server_test schema里运行，否则使用临时的SQLite数据库
+const (
+	postgresEnv    = "BP_SERVER_TEST_POSTGRES"
+	postgresSchema = "bp_server_test"
+)
+
+func TestMain(m *testing.M) {
+	conftest.Load()
+	if dsn := os.Getenv(postgresEnv); dsn != "" {
+		schemaDSN, err := postgresTestSchema(dsn)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Use PostgreSQL from %s failed: %v\n", postgresEnv, err)
+			os.Exit(1)
+		}
+		conf.Xml.DB.Driver = "postgres"
+		conf.Xml.DB.DSN = schemaDSN
+	}
+	Init()
+	os.Exit(m.Run())
+}
+
+// postgresTestSchema 重建测试用的schema，返回连接到这个schema的DSN
+func postgresTestSchema(dsn string) (string, error) {
+	admin, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return "", err
+	}
+	if err := admin.Exec("DROP SCHEMA IF EXISTS " + postgresSchema + " CASCADE").Error; err != nil {
+		return "", err
+	}
+	if err := admin.Exec("CREATE SCHEMA " + postgresSchema).Error; err != nil {
+		return "", err
+	}
+	if sqlDB, err := admin.DB(); err == nil {
+		sqlDB.Close()
+	}
+	switch {
+	case !strings.Contains(dsn, "://"):
+		dsn += " search_path=" + postgresSchema
+	case strings.Contains(dsn, "?"):
+		dsn += "&search_path=" + postgresSchema
+	default:
+		dsn += "?search_path=" + postgresSchema
+	}
+	return dsn, nil
+}
+
+// testProgram 返回这个测试专用的程序名，测试之间以及-count重复执行时的数据互不影响
+func testProgram(t *testing.T) string {
+	return fmt.Sprintf("%s-%d", strings.ReplaceAll(t.Name(), "/", "-"), time.Now().UnixNano())
+}
+
+func testHash(n int) string {
+	return fmt.Sprintf("%064x", time.Now().UnixNano()+int64(n))
+}
+
+func addTestDump(t *testing.T, program string, hash string) *Dump {
+	t.Helper()
+	dump := &Dump{OS: "windows", Program: program, Version: "1.0", Filename: "test.dmp", Build: "b", Hash: hash}
+	if err := AddDump(dump); err != nil {
+		t.Fatalf("AddDump failed: %v", err)
+	}
+	return dump
+}
+
+func TestMigrations(t *testing.T) {
+	version, err := SchemaVersion()
+	if err != nil || version != LatestSchemaVersion() {
+		t.Fatalf("schema version %d, %v, want %d", version, err, LatestSchemaVersion())
+	}
+	if err := RequireLatestSchema(); err != nil {
+		t.Fatal(err)
+	}
+	// 已经是最新版本时再执行不会做任何事
+	if err := Migrate(); err != nil {
+		t.Fatalf("second Migrate failed: %v", err)
+	}
+}
+
+func TestAddDumpDuplicate(t *testing.T) {
+	program := testProgram(t)
+	hash := testHash(0)
+	original := addTestDump(t, program, hash)
+	duplicate := &Dump{OS: "windows", Program: program, Version: "1.0", Filename: "again.dmp", Build: "b", Hash: hash}
+	if err := AddDump(duplicate); !errors.Is(err, ErrDuplicateDump) {
+		t.Fatalf("AddDump of a duplicate returned %v", err)
+	}
+	found, err := QueryDumpByHash(program, hash)
+	if err != nil || found == nil || found.ID != original.ID {
+		t.Fatalf("QueryDumpByHash returned %+v, %v, want dump %d", found, err, original.ID)
+	}
+	if err := AddDuplicate(original.ID); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ = QueryDump(original.ID); found.Duplicates != 1 || found.LastDuplicate == nil {
+		t.Errorf("duplicate not counted: %d, %v", found.Duplicates, found.LastDuplicate)
+	}
+	// 清理后相同的内容可以重新上传
+	if err := PruneDump(original.ID); err != nil {
+		t.Fatal(err)
+	}
+	again := addTestDump(t, program, hash)
+	if found, _ = QueryDumpByHash(program, hash); found == nil || found.ID != again.ID {
+		t.Errorf("hash claimed by %+v after prune, want dump %d", found, again.ID)
+	}
+}
+
+func TestAddDumpSameHashOtherProgram(t *testing.T) {
+	program, other := testProgram(t), testProgram(t)+"-other"
+	hash := testHash(0)
+	original := addTestDump(t, program, hash)
+	// 另一个程序上传的相同内容是它自己的dump，不算作第一个程序的重复上传
+	second := addTestDump(t, other, hash)
+	if second.ID == original.ID {
+		t.Fatalf("dump of program %s reused dump %d", other, original.ID)
+	}
+	for _, want := range []*Dump{original, second} {
+		found, err := QueryDumpByHash(want.Program, hash)
+		if err != nil || found == nil || found.ID != want.ID {
+			t.Errorf("QueryDumpByHash(%s) returned %+v, %v, want dump %d", want.Program, found, err, want.ID)
+		}
+	}
+	if shared, err := HasOtherDumpWithHash(hash, original.ID); err != nil || !shared {
+		t.Errorf("HasOtherDumpWithHash returned %v, %v, want the file to be shared", shared, err)
+	}
+}
+
+func TestConcurrentDuplicates(t *testing.T) {
+	program := testProgram(t)
+	hash := testHash(0)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	added, duplicates := 0, 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dump := &Dump{OS: "windows", Program: program, Version: "1.0", Filename: "test.dmp", Build: "b", Hash: hash}
+			err := AddDump(dump)
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch {
+			case err == nil:
+				added++
+			case errors.Is(err, ErrDuplicateDump):
+				duplicates++
+			default:
+				t.Errorf("AddDump failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 1 || duplicates != 7 {
+		t.Fatalf("%d dumps added and %d duplicates, want 1 and 7", added, duplicates)
+	}
+}
+
+func TestSaveReport(t *testing.T) {
+	program := testProgram(t)
+	first := addTestDump(t, program, testHash(0))
+	group, err := SaveReport(first, "text", "f1\nf2", "f1", "f1\nf2")
+	if err != nil {
+		t.Fatalf("SaveReport failed: %v", err)
+	}
+	if group.Count != 0 || group.Stack != "f1\nf2" || group.TopFrame != "f1" {
+		t.Errorf("new group has count %d, stack %q, top frame %q", group.Count, group.Stack, group.TopFrame)
+	}
+	second := addTestDump(t, program, testHash(1))
+	again, err := SaveReport(second, "text", "f1\nf3", "f1", "f1\nf3")
+	if err != nil {
+		t.Fatalf("SaveReport failed: %v", err)
+	}
+	if again.ID != group.ID || again.Count != 1 {
+		t.Errorf("second dump went to group %d with count %d, want group %d with count 1", again.ID, again.Count, group.ID)
+	}
+	// 已有的栈不会被后来的dump覆盖
+	saved, err := QueryGroup(group.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Count != 2 || saved.Stack != "f1\nf2" {
+		t.Errorf("group has count %d and stack %q", saved.Count, saved.Stack)
+	}
+	report, err := QueryReport(second.ID)
+	if err != nil || report.Frames != "f1\nf3" {
+		t.Errorf("QueryReport returned %+v, %v", report, err)
+	}
+	if dump, _ := QueryDump(second.ID); dump.Status != StatusProcessed || dump.GroupID != group.ID {
+		t.Errorf("dump has status '%s' and group %d", dump.Status, dump.GroupID)
+	}
+}
+
+func TestConcurrentSaveReport(t *testing.T) {
+	program := testProgram(t)
+	var dumps []*Dump
+	for i := 0; i < 8; i++ {
+		dumps = append(dumps, addTestDump(t, program, testHash(i)))
+	}
+	var wg sync.WaitGroup
+	groups := make([]uint, len(dumps))
+	for i, dump := range dumps {
+		wg.Add(1)
+		go func(i int, dump *Dump) {
+			defer wg.Done()
+			group, err := SaveReport(dump, "text", "race", "race", "race")
+			if err != nil {
+				t.Errorf("SaveReport of dump %d failed: %v", dump.ID, err)
+				return
+			}
+			groups[i] = group.ID
+		}(i, dump)
+	}
+	wg.Wait()
+	for _, id := range groups[1:] {
+		if id != groups[0] {
+			t.Fatalf("dumps with one signature landed in groups %v", groups)
+		}
+	}
+	group, err := QueryGroup(groups[0])
+	if err != nil || group.Count != int64(len(dumps)) {
+		t.Fatalf("group has count %d, %v, want %d", group.Count, err, len(dumps))
+	}
+}
+
+func TestQueryPendingDumps(t *testing.T) {
+	program := testProgram(t)
+	pending := addTestDump(t, program, testHash(0))
+	legacy := addTestDump(t, program, testHash(1))
+	failed := addTestDump(t, program, testHash(2))
+	retrying := addTestDump(t, program, testHash(3))
+	// 旧版本留下的记录没有状态
+	if err := dbConn.Model(&Dump{}).Where("id = ?", legacy.ID).Update("status", nil).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := MarkDumpFailed(failed.ID, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := RetryDump(retrying.ID, 1, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	found := queryPending(t)
+	if !found[pending.ID] || !found[legacy.ID] || found[failed.ID] || found[retrying.ID] {
+		t.Errorf("pending dumps %v, want %d and %d but not %d and %d", found, pending.ID, legacy.ID, failed.ID, retrying.ID)
+	}
+
+	n, err := ResetFailedDumps(program)
+	if err != nil || n != 1 {
+		t.Fatalf("reset %d failed dumps, err %v, want 1", n, err)
+	}
+	if !queryPending(t)[failed.ID] {
+		t.Errorf("dump %d is not pending after reset", failed.ID)
+	}
+	dump, err := QueryDump(failed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dump.Attempts != 0 || dump.RetryAt != nil {
+		t.Errorf("reset dump has attempts %d, retry at %v, want 0 and nil", dump.Attempts, dump.RetryAt)
+	}
+}
+
+func queryPending(t *testing.T) map[uint]bool {
+	ids, err := QueryPendingDumps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[uint]bool{}
+	for _, id := range ids {
+		found[id] = true
+	}
+	return found
+}
+
+func TestQuerySimilarCandidates(t *testing.T) {
+	program := testProgram(t)
+	a := addTestDump(t, program, testHash(0))
+	b := addTestDump(t, program, testHash(1))
+	c := addTestDump(t, program, testHash(2))
+	ga, _ := SaveReport(a, "text", "", "a", "top\nx")
+	gb, _ := SaveReport(b, "text", "", "b", "top\ny")
+	gc, _ := SaveReport(c, "text", "", "c", "other\nz")
+	if ga == nil || gb == nil || gc == nil {
+		t.Fatal("SaveReport failed")
+	}
+	groups, err := QuerySimilarCandidates(program, []string{"top"}, ga.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].ID != gb.ID {
+		t.Errorf("candidates %+v, want only group %d", groups, gb.ID)
+	}
+	if long := strings.Repeat("界", 300); len([]rune(TopFrame(long+"\nnext"))) != 255 {
+		t.Errorf("TopFrame kept %d runes", len([]rune(TopFrame(long))))
+	}
+}
+
+func TestUploadKeys(t *testing.T) {
+	key := &UploadKey{Name: t.Name(), Prefix: "bpk_test", KeyHash: testHash(0), Programs: "app,tool", Dump: true}
+	if err := AddUploadKey(key); err != nil {
+		t.Fatal(err)
+	}
+	found, err := QueryUploadKey(key.KeyHash)
+	if err != nil || found.ID != key.ID {
+		t.Fatalf("QueryUploadKey returned %+v, %v", found, err)
+	}
+	if !found.Allows("tool", UploadDump) || found.Allows("other", UploadDump) || found.Allows("app", UploadSymbol) {
+		t.Errorf("key with programs %v allows the wrong uploads", found.ProgramList())
+	}
+	if err := RevokeUploadKey(key.ID, "admin", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ = QueryUploadKey(key.KeyHash); found.Allows("app", UploadDump) {
+		t.Error("revoked key still allows uploads")
+	}
+}
+
+func TestQuerySymbolsWithRelease(t *testing.T) {
+	entry := testProgram(t) + ".pdb"
+	AddSymbol(entry, "TAGGED", "a.sym", "app", "1.0")
+	AddSymbol(entry, "TAGGED", "a.sym", "app", "1.1")
+	AddSymbol(entry, "MIXED", "a.sym", "app", "1.0")
+	AddSymbol(entry, "MIXED", "a.sym", "", "")
+	AddSymbol(entry, "UNTAGGED", "a.sym", "", "")
+	keys, err := QuerySymbolsWithRelease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, key := range keys {
+		if key.Entry == entry {
+			found[key.DebugID] = true
+		}
+	}
+	if !found["TAGGED"] || found["MIXED"] || found["UNTAGGED"] {
+		t.Errorf("symbols with release %v, want only TAGGED", found)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GroupGrowth 是分组在一天里的崩溃数和之前几天的平均每天崩溃数
+type GroupGrowth struct {
+	Group    CrashGroup
+	Count    int64
+	Baseline float64
+}
+
+// MissingSymbol 是一个版本的dump引用了、但没有上传过这个版本的符号的模块。
+// 只统计上传过其他版本符号的模块，系统模块不计算在内
+type MissingSymbol struct {
+	Program   string
+	Version   string
+	DebugFile string
+	Dumps     int64 `gorm:"column:total"`
+}
+
+// QueryNewGroups 返回首次出现在[start, end)之间的分组，按数量倒序，programs为空时不过滤程序
+func QueryNewGroups(start time.Time, end time.Time, programs []string, limit int) ([]CrashGroup, error) {
+	tx := dbConn.Where("count > 0 AND first_seen >= ? AND first_seen < ?", start, end)
+	if len(programs) > 0 {
+		tx = tx.Where("program IN ?", programs)
+	}
+	var groups []CrashGroup
+	if err := tx.Order("count desc").Limit(limit).Find(&groups).Error; err != nil {
+		logrus.Errorf("Query new crash groups failed with: %v", err)
+		return nil, err
+	}
+	return groups, nil
+}
+
+// QueryGroupDayCounts 返回分组在日期范围[from, to]内的崩溃数，groupIDs为空时返回所有分组
+func QueryGroupDayCounts(from string, to string, programs []string, groupIDs []uint) (map[uint]int64, error) {
+	type groupCount struct {
+		GroupID uint
+		Count   int64 `gorm:"column:total"`
+	}
+	tx := dbConn.Model(&CrashStat{}).Where("day >= ? AND day <= ? AND group_id <> 0", from, to)
+	if len(programs) > 0 {
+		tx = tx.Where("program IN ?", programs)
+	}
+	if len(groupIDs) > 0 {
+		tx = tx.Where("group_id IN ?", groupIDs)
+	}
+	var rows []groupCount
+	if err := tx.Select("group_id, SUM(count) AS total").Group("group_id").Find(&rows).Error; err != nil {
+		logrus.Errorf("Query crash counts of groups from %s to %s failed with: %v", from, to, err)
+		return nil, err
+	}
+	counts := make(map[uint]int64, len(rows))
+	for _, r := range rows {
+		counts[r.GroupID] = r.Count
+	}
+	return counts, nil
+}
+
+// QueryMissingSymbols 返回[start, end)之间收到的dump缺少的符号
+func QueryMissingSymbols(start time.Time, end time.Time, programs []string) ([]MissingSymbol, error) {
+	known := dbConn.Model(&Symbol{}).Distinct("entry")
+	uploaded := dbConn.Model(&Symbol{}).Select("1").
+		Where("symbols.entry = dump_modules.debug_file AND symbols.debug_id = dump_modules.debug_id")
+	tx := dbConn.Model(&DumpModule{}).
+		Joins("JOIN dumps ON dumps.id = dump_modules.dump_id").
+		Where("dumps.created_at >= ? AND dumps.created_at < ?", start, end).
+		Where("dump_modules.debug_file IN (?)", known).
+		Where("NOT EXISTS (?)", uploaded)
+	if len(programs) > 0 {
+		tx = tx.Where("dumps.program IN ?", programs)
+	}
+	var missing []MissingSymbol
+	result := tx.Select("dumps.program, dumps.version, dump_modules.debug_file, COUNT(DISTINCT dumps.id) AS total").
+		Group("dumps.program, dumps.version, dump_modules.debug_file").
+		Order("dumps.program, dumps.version, dump_modules.debug_file").Find(&missing)
+	if result.Error != nil {
+		logrus.Errorf("Query missing symbols failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	return missing, nil
+}
+
+// QueryGroups 返回ids对应的分组，不存在的分组被忽略
+func QueryGroups(ids []uint) ([]CrashGroup, error) {
+	var groups []CrashGroup
+	if len(ids) == 0 {
+		return groups, nil
+	}
+	if err := dbConn.Where("id IN ?", ids).Order("id").Find(&groups).Error; err != nil {
+		logrus.Errorf("Query crash groups %v failed with: %v", ids, err)
+		return nil, err
+	}
+	return groups, nil
+}
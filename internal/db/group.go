@@ -0,0 +1,451 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"bp-server/internal/version"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	GroupNew           = "new"
+	GroupInvestigating = "investigating"
+	GroupFixed         = "fixed"
+	GroupWontFix       = "wontfix"
+	GroupIgnored       = "ignored"
+)
+
+// GroupStatuses 是分组所有可用的处理状态
+var GroupStatuses = []string{GroupNew, GroupInvestigating, GroupFixed, GroupWontFix, GroupIgnored}
+
+// CrashGroup 把同一个程序里签名相同的dump归为一组，Count包含已被清理的dump
+type CrashGroup struct {
+	gorm.Model
+	Program       string `gorm:"size:255;uniqueIndex:idx_group_program_signature"`
+	SignatureHash string `gorm:"size:64;uniqueIndex:idx_group_program_signature"`
+	Signature     string
+	Count         int64
+	FirstSeen     time.Time
+	LastSeen      time.Time
+
+	// 以下是分组的处理信息，FixedVersion和FixedAt只在Status为fixed时有意义。
+	// 已修复的分组在FixedVersion或更新的版本里再次出现时会重新打开并标记为Regression
+	Status       string `gorm:"size:32;index;default:new"`
+	Assignee     string `gorm:"size:255"`
+	Notes        string
+	BugID        string `gorm:"size:255"`
+	FixedVersion string `gorm:"size:255"`
+	FixedAt      *time.Time
+	Regression   bool
+	// SplitDepth 不为0时分组被手动拆分过，签名落在这个分组的dump用这个深度重新计算签名
+	SplitDepth int
+	// Stack 是分组里一个dump规范化后的栈顶帧，以换行分隔，用于查找相似的分组
+	Stack string
+	// TopFrame 是Stack的第一帧，查找相似分组时只比较栈顶相近的分组
+	TopFrame string `gorm:"size:255;index"`
+	// Installs 是上报了安装ID的dump来自的不同安装数，LoopInstalls是其中发生过崩溃循环的安装数
+	Installs     int64 `gorm:"default:0;index"`
+	LoopInstalls int64 `gorm:"default:0"`
+	// IssueURL 和IssueAPI 是在问题跟踪系统里创建的问题的网页地址和API地址，IssueState是最近一次同步到的问题状态
+	IssueURL    string
+	IssueAPI    string
+	IssueState  string `gorm:"size:64"`
+	IssueClosed bool
+	// Reopened 表示这次归组把已修复的分组重新打开了，不保存到数据库
+	Reopened bool `gorm:"-"`
+}
+
+// Triage 是可以在界面上修改的分组处理信息
+type Triage struct {
+	Status       string
+	Assignee     string
+	Notes        string
+	BugID        string
+	FixedVersion string
+}
+
+// ValidGroupStatus 判断status是不是可用的分组状态
+func ValidGroupStatus(status string) bool {
+	for _, s := range GroupStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Report 是dump经过minidump_stackwalk处理后的结果，Frames是崩溃线程规范化后的栈帧，以换行分隔
+type Report struct {
+	ID     uint `gorm:"primarykey"`
+	DumpID uint `gorm:"uniqueIndex"`
+	Text   string
+	Frames string
+}
+
+// hashSignature 签名可能很长，唯一索引建在它的sha256上以兼容MySQL的索引长度限制
+func hashSignature(signature string) string {
+	sum := sha256.Sum256([]byte(signature))
+	return hex.EncodeToString(sum[:])
+}
+
+// QueryPendingDumps 返回还没有处理过的dump，包括旧版本留下的没有状态的记录，不包括还没到重试时间的dump
+func QueryPendingDumps() ([]uint, error) {
+	var ids []uint
+	result := dbConn.Model(&Dump{}).Where("status = ? OR status = '' OR status IS NULL", StatusPending).
+		Where("retry_at IS NULL OR retry_at <= ?", time.Now()).Order("id").Pluck("id", &ids)
+	if result.Error != nil {
+		logrus.Errorf("Query pending dumps failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	return ids, nil
+}
+
+// assignGroup 把dump归入签名对应的崩溃分组，dump原来属于别的分组时从原分组移出
+func assignGroup(tx *gorm.DB, dump *Dump, signature string) (*CrashGroup, error) {
+	group, err := resolveGroup(tx, dump.Program, signature, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := reopenRegression(tx, group, dump); err != nil {
+		return nil, err
+	}
+	if dump.GroupID != group.ID {
+		if dump.GroupID != 0 {
+			old := map[string]any{"count": gorm.Expr("count - 1")}
+			if err := leaveInstall(tx, dump, old); err != nil {
+				return nil, err
+			}
+			if err := tx.Model(&CrashGroup{}).Where("id = ?", dump.GroupID).Updates(old).Error; err != nil {
+				return nil, err
+			}
+		}
+		updates := map[string]any{"count": gorm.Expr("count + 1")}
+		if err := joinInstall(tx, dump, group, updates); err != nil {
+			return nil, err
+		}
+		if dump.CreatedAt.After(group.LastSeen) {
+			updates["last_seen"] = dump.CreatedAt
+		}
+		if group.FirstSeen.IsZero() || dump.CreatedAt.Before(group.FirstSeen) {
+			updates["first_seen"] = dump.CreatedAt
+		}
+		if err := tx.Model(group).Updates(updates).Error; err != nil {
+			return nil, err
+		}
+	}
+	return group, nil
+}
+
+// SaveReport 保存处理结果，并把dump归入签名对应的崩溃分组，分组还没有栈时保存stack。
+// 返回的分组的Count是归入这个dump之前的数量
+func SaveReport(dump *Dump, text string, frames string, signature string, stack string) (*CrashGroup, error) {
+	var group *CrashGroup
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if group, err = assignGroup(tx, dump, signature); err != nil {
+			return err
+		}
+		if group.Stack == "" && stack != "" {
+			group.Stack, group.TopFrame = stack, TopFrame(stack)
+			if err := tx.Model(group).Updates(map[string]any{"stack": group.Stack, "top_frame": group.TopFrame}).Error; err != nil {
+				return err
+			}
+		}
+		report := Report{DumpID: dump.ID, Text: text, Frames: frames}
+		if err := tx.Where(Report{DumpID: dump.ID}).Assign(report).FirstOrCreate(&report).Error; err != nil {
+			return err
+		}
+		return tx.Model(dump).Updates(map[string]any{"status": StatusProcessed, "group_id": group.ID}).Error
+	})
+	if err != nil {
+		logrus.Errorf("Save report of dump %d failed with: %v", dump.ID, err)
+		return nil, err
+	}
+	return group, nil
+}
+
+// Regroup 把已处理的dump移到新签名对应的分组，处理结果不变
+func Regroup(dump *Dump, signature string) (*CrashGroup, error) {
+	var group *CrashGroup
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if group, err = assignGroup(tx, dump, signature); err != nil {
+			return err
+		}
+		return tx.Model(dump).Update("group_id", group.ID).Error
+	})
+	if err != nil {
+		logrus.Errorf("Regroup dump %d failed with: %v", dump.ID, err)
+		return nil, err
+	}
+	return group, nil
+}
+
+// QueryProcessedDumps 按id顺序返回id大于afterID的已处理dump，program为空时不过滤程序
+func QueryProcessedDumps(program string, afterID uint, limit int) ([]Dump, error) {
+	tx := dbConn.Where("status = ? AND id > ?", StatusProcessed, afterID)
+	if program != "" {
+		tx = tx.Where("program = ?", program)
+	}
+	var dumps []Dump
+	result := tx.Order("id").Limit(limit).Find(&dumps)
+	if result.Error != nil {
+		logrus.Errorf("Query processed dumps failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	return dumps, nil
+}
+
+// reopenRegression 已修复的分组收到了修复版本之后上传的、版本不低于修复版本的dump时重新打开分组
+func reopenRegression(tx *gorm.DB, group *CrashGroup, dump *Dump) error {
+	if group.Status != GroupFixed || group.FixedVersion == "" {
+		return nil
+	}
+	if group.FixedAt != nil && dump.CreatedAt.Before(*group.FixedAt) {
+		return nil
+	}
+	if version.Compare(dump.Version, group.FixedVersion) < 0 {
+		return nil
+	}
+	logrus.Warnf("Crash group %d fixed in version %s crashed again in version %s (dump %d), reopen it as regression",
+		group.ID, group.FixedVersion, dump.Version, dump.ID)
+	group.Status = GroupNew
+	group.Regression = true
+	group.Reopened = true
+	return tx.Model(group).Updates(map[string]any{"status": GroupNew, "regression": true}).Error
+}
+
+// 分组列表的排序方式
+const (
+	SortLastSeen = "last_seen"
+	SortCount    = "count"
+	SortInstalls = "installs"
+)
+
+// GroupSorts 是分组列表所有可用的排序方式，第一个是默认的
+var GroupSorts = []string{SortLastSeen, SortCount, SortInstalls}
+
+// GroupListFilter 是分组列表的过滤条件和排序方式，为空的字段不过滤，Sort为空时按最后一次出现的时间排序。
+// Programs不为nil时只返回这些程序的分组
+type GroupListFilter struct {
+	Program  string
+	Status   string
+	Sort     string
+	Programs []string
+}
+
+// QueryGroupList 按filter.Sort倒序返回分组，重新分组后变空的分组不返回
+func QueryGroupList(page int, filter GroupListFilter) ([]CrashGroup, error) {
+	const kLimit int = 20
+	index := kLimit * page
+	if index < 0 {
+		index = 0
+	}
+	tx := dbConn.Where("count > 0")
+	switch filter.Sort {
+	case SortCount:
+		tx = tx.Order("count desc")
+	case SortInstalls:
+		tx = tx.Order("installs desc").Order("count desc")
+	case "", SortLastSeen:
+		tx = tx.Order("last_seen desc")
+	default:
+		return nil, fmt.Errorf("invalid sort '%s'", filter.Sort)
+	}
+	tx = tx.Order("id desc")
+	if filter.Program != "" {
+		tx = tx.Where("program = ?", filter.Program)
+	}
+	if filter.Status != "" {
+		tx = tx.Where("status = ?", filter.Status)
+	}
+	if filter.Programs != nil {
+		tx = tx.Where("program IN ?", filter.Programs)
+	}
+	var groups []CrashGroup
+	result := tx.Limit(kLimit).Offset(index).Find(&groups)
+	if result.Error != nil {
+		logrus.Errorf("Query crash group list failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	return groups, nil
+}
+
+func QueryGroup(id uint) (*CrashGroup, error) {
+	group := CrashGroup{}
+	result := dbConn.First(&group, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &group, nil
+}
+
+// QueryGroupDumps 返回分组里最新的limit个dump
+func QueryGroupDumps(groupID uint, limit int) ([]Dump, error) {
+	var dumps []Dump
+	result := dbConn.Where("group_id = ?", groupID).Order("id desc").Limit(limit).Find(&dumps)
+	if result.Error != nil {
+		logrus.Errorf("Query dumps of crash group %d failed with: %v", groupID, result.Error)
+		return nil, result.Error
+	}
+	return dumps, nil
+}
+
+// UpdateTriage 修改分组的处理信息。标记为fixed时必须给出修复的版本，并清除Regression标记
+func UpdateTriage(id uint, triage Triage) (*CrashGroup, error) {
+	if !ValidGroupStatus(triage.Status) {
+		return nil, fmt.Errorf("invalid status '%s'", triage.Status)
+	}
+	if triage.Status == GroupFixed && triage.FixedVersion == "" {
+		return nil, fmt.Errorf("status '%s' requires the fixed version", GroupFixed)
+	}
+	group := CrashGroup{}
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&group, id).Error; err != nil {
+			return err
+		}
+		updates := map[string]any{
+			"status":        triage.Status,
+			"assignee":      triage.Assignee,
+			"notes":         triage.Notes,
+			"bug_id":        triage.BugID,
+			"fixed_version": triage.FixedVersion,
+		}
+		if triage.Status == GroupFixed {
+			if group.Status != GroupFixed || group.FixedVersion != triage.FixedVersion {
+				updates["fixed_at"] = time.Now()
+			}
+			updates["regression"] = false
+		} else {
+			updates["fixed_at"] = nil
+		}
+		return tx.Model(&group).Updates(updates).Error
+	})
+	if err != nil {
+		logrus.Errorf("Update triage of crash group %d failed with: %v", id, err)
+		return nil, err
+	}
+	return &group, nil
+}
+
+// MarkDumpFailed 把dump标记为处理失败，attempts是stackwalk失败的次数
+func MarkDumpFailed(id uint, attempts int) error {
+	result := dbConn.Model(&Dump{}).Where("id = ?", id).
+		Updates(map[string]any{"status": StatusFailed, "attempts": attempts, "retry_at": nil})
+	if result.Error != nil {
+		logrus.Errorf("Update status of dump %d failed with: %v", id, result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+// RetryDump 让dump保持pending，到retryAt之后再处理
+func RetryDump(id uint, attempts int, retryAt time.Time) error {
+	result := dbConn.Model(&Dump{}).Where("id = ?", id).
+		Updates(map[string]any{"attempts": attempts, "retry_at": retryAt})
+	if result.Error != nil {
+		logrus.Errorf("Update retry time of dump %d failed with: %v", id, result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+// ResetFailedDumps 把处理失败的dump改回pending，program不为空时只修改这个程序的dump，返回修改的数量
+func ResetFailedDumps(program string) (int64, error) {
+	tx := dbConn.Model(&Dump{}).Where("status = ?", StatusFailed)
+	if program != "" {
+		tx = tx.Where("program = ?", program)
+	}
+	result := tx.Updates(map[string]any{"status": StatusPending, "attempts": 0, "retry_at": nil})
+	if result.Error != nil {
+		logrus.Errorf("Reset failed dumps failed with: %v", result.Error)
+		return 0, result.Error
+	}
+	return result.RowsAffected, nil
+}
+
+func QueryReport(dumpID uint) (*Report, error) {
+	report := Report{}
+	result := dbConn.Where("dump_id = ?", dumpID).First(&report)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &report, nil
+}
+
+// SetGroupStack 保存分组用于比较相似度的栈
+func SetGroupStack(id uint, stack string) error {
+	result := dbConn.Model(&CrashGroup{}).Where("id = ?", id).Updates(map[string]any{"stack": stack, "top_frame": TopFrame(stack)})
+	if result.Error != nil {
+		logrus.Errorf("Update stack of crash group %d failed with: %v", id, result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+// TopFrame 返回栈的第一帧，超过索引长度的部分截掉
+func TopFrame(stack string) string {
+	frame, _, _ := strings.Cut(stack, "\n")
+	if runes := []rune(frame); len(runes) > 255 {
+		frame = string(runes[:255])
+	}
+	return frame
+}
+
+// QuerySimilarCandidates 返回程序里栈顶是topFrames之一的不为空的分组，不包括exclude，最多limit个，数量多的在前
+func QuerySimilarCandidates(program string, topFrames []string, exclude uint, limit int) ([]CrashGroup, error) {
+	var groups []CrashGroup
+	result := dbConn.Where("program = ? AND count > 0 AND top_frame IN ? AND id <> ?", program, topFrames, exclude).
+		Order("count DESC").Limit(limit).Find(&groups)
+	if result.Error != nil {
+		logrus.Errorf("Query crash groups similar to %v of '%s' failed with: %v", topFrames, program, result.Error)
+		return nil, result.Error
+	}
+	return groups, nil
+}
+
+// QueryGroupsWithoutStack 返回还没有保存栈的不为空的分组，最多limit个
+func QueryGroupsWithoutStack(limit int) ([]CrashGroup, error) {
+	var groups []CrashGroup
+	result := dbConn.Where("count > 0 AND (stack IS NULL OR stack = '')").Order("id").Limit(limit).Find(&groups)
+	if result.Error != nil {
+		logrus.Errorf("Query crash groups without stack failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	return groups, nil
+}
@@ -0,0 +1,168 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"bp-server/internal/conf"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultLoopWindow = 10
+	defaultLoopCount  = 3
+)
+
+// GroupVersion 是分组在一个版本里的崩溃数和受影响的安装数
+type GroupVersion struct {
+	Version  string
+	Count    int64 `gorm:"column:total"`
+	Installs int64
+}
+
+// loopRule 返回崩溃循环的判断条件：同一个安装在window时间内崩溃在同一个分组count次
+func loopRule() (time.Duration, int64) {
+	window, count := conf.Xml.CrashLoop.Window, conf.Xml.CrashLoop.Count
+	if window <= 0 {
+		window = defaultLoopWindow
+	}
+	if count <= 1 {
+		count = defaultLoopCount
+	}
+	return time.Duration(window) * time.Minute, int64(count)
+}
+
+// countInstallDumps 返回分组里除dump以外同一个安装的dump数量，loop为true时只计算崩溃循环中的dump
+func countInstallDumps(tx *gorm.DB, groupID uint, dump *Dump, loop bool) (int64, error) {
+	var count int64
+	q := tx.Model(&Dump{}).Unscoped().Where("group_id = ? AND install_hash = ? AND id <> ?", groupID, dump.InstallHash, dump.ID)
+	if loop {
+		q = q.Where("crash_loop = ?", true)
+	}
+	err := q.Count(&count).Error
+	return count, err
+}
+
+// leaveInstall 在dump移出原分组时，把需要减少的安装数加到原分组的updates里
+func leaveInstall(tx *gorm.DB, dump *Dump, updates map[string]any) error {
+	if dump.InstallHash == "" {
+		return nil
+	}
+	others, err := countInstallDumps(tx, dump.GroupID, dump, false)
+	if err != nil {
+		return err
+	}
+	if others == 0 {
+		updates["installs"] = gorm.Expr("installs - 1")
+	}
+	if !dump.CrashLoop {
+		return nil
+	}
+	if others, err = countInstallDumps(tx, dump.GroupID, dump, true); err != nil {
+		return err
+	}
+	if others == 0 {
+		updates["loop_installs"] = gorm.Expr("loop_installs - 1")
+	}
+	return nil
+}
+
+// joinInstall 在dump归入分组时，把需要增加的安装数加到分组的updates里，并判断dump是不是崩溃循环的一部分：
+// 同一个安装在这个dump之前的一段时间内已经在这个分组崩溃了多次
+func joinInstall(tx *gorm.DB, dump *Dump, group *CrashGroup, updates map[string]any) error {
+	loop := false
+	if dump.InstallHash != "" {
+		others, err := countInstallDumps(tx, group.ID, dump, false)
+		if err != nil {
+			return err
+		}
+		if others == 0 {
+			updates["installs"] = gorm.Expr("installs + 1")
+		}
+		window, count := loopRule()
+		var recent int64
+		if others > 0 {
+			err = tx.Model(&Dump{}).Unscoped().
+				Where("group_id = ? AND install_hash = ? AND id <> ?", group.ID, dump.InstallHash, dump.ID).
+				Where("crash_time >= ? AND crash_time <= ?", dump.CrashTime.Add(-window), dump.CrashTime).
+				Count(&recent).Error
+			if err != nil {
+				return err
+			}
+		}
+		if recent+1 >= count {
+			loop = true
+			looped, err := countInstallDumps(tx, group.ID, dump, true)
+			if err != nil {
+				return err
+			}
+			if looped == 0 {
+				updates["loop_installs"] = gorm.Expr("loop_installs + 1")
+				logrus.Warnf("Crash loop detected in crash group %d: dump %d is crash %d of one installation within %v",
+					group.ID, dump.ID, recent+1, window)
+			}
+		}
+	}
+	if loop == dump.CrashLoop {
+		return nil
+	}
+	dump.CrashLoop = loop
+	return tx.Model(dump).Update("crash_loop", loop).Error
+}
+
+// countInstalls 根据dump重新计算分组受影响的安装数和发生过崩溃循环的安装数
+func countInstalls(tx *gorm.DB, groupID uint) (int64, int64, error) {
+	var installs, loops int64
+	q := tx.Model(&Dump{}).Unscoped().Where("group_id = ? AND install_hash <> ''", groupID)
+	if err := q.Distinct("install_hash").Count(&installs).Error; err != nil {
+		return 0, 0, err
+	}
+	q = tx.Model(&Dump{}).Unscoped().Where("group_id = ? AND install_hash <> '' AND crash_loop = ?", groupID, true)
+	if err := q.Distinct("install_hash").Count(&loops).Error; err != nil {
+		return 0, 0, err
+	}
+	return installs, loops, nil
+}
+
+// QueryGroupVersions 返回分组在每个版本里的崩溃数和受影响的安装数，包括被清理的dump
+func QueryGroupVersions(groupID uint) ([]GroupVersion, error) {
+	var versions []GroupVersion
+	result := dbConn.Model(&Dump{}).Unscoped().Where("group_id = ?", groupID).
+		Select("version, COUNT(*) AS total, COUNT(DISTINCT NULLIF(install_hash, '')) AS installs").
+		Group("version").Find(&versions)
+	if result.Error != nil {
+		logrus.Errorf("Query versions of crash group %d failed with: %v", groupID, result.Error)
+		return nil, result.Error
+	}
+	return versions, nil
+}
@@ -0,0 +1,83 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// SetGroupIssue 记录为分组创建的问题，分组还没有BugID时用问题编号作为BugID
+func SetGroupIssue(id uint, issueID string, issueURL string, issueAPI string) (*CrashGroup, error) {
+	group := CrashGroup{}
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&group, id).Error; err != nil {
+			return err
+		}
+		updates := map[string]any{
+			"issue_url":    issueURL,
+			"issue_api":    issueAPI,
+			"issue_state":  "",
+			"issue_closed": false,
+		}
+		if group.BugID == "" {
+			updates["bug_id"] = issueID
+		}
+		return tx.Model(&group).Updates(updates).Error
+	})
+	if err != nil {
+		logrus.Errorf("Save issue of crash group %d failed with: %v", id, err)
+		return nil, err
+	}
+	return &group, nil
+}
+
+// QueryIssueGroups 返回所有可以同步问题状态的分组
+func QueryIssueGroups() ([]CrashGroup, error) {
+	var groups []CrashGroup
+	result := dbConn.Where("issue_api <> ''").Order("id").Find(&groups)
+	if result.Error != nil {
+		logrus.Errorf("Query crash groups with issues failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	return groups, nil
+}
+
+// SetIssueState 保存同步到的问题状态
+func SetIssueState(id uint, state string, closed bool) error {
+	result := dbConn.Model(&CrashGroup{}).Where("id = ?", id).
+		Updates(map[string]any{"issue_state": state, "issue_closed": closed})
+	if result.Error != nil {
+		logrus.Errorf("Update issue state of crash group %d failed with: %v", id, result.Error)
+		return result.Error
+	}
+	return nil
+}
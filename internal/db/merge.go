@@ -0,0 +1,444 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ChangeMerge = "merge"
+	ChangeSplit = "split"
+)
+
+// GroupAlias 是合并分组留下的规则：程序里签名为Signature的dump归入GroupID分组
+type GroupAlias struct {
+	ID            uint   `gorm:"primarykey"`
+	Program       string `gorm:"size:255;uniqueIndex:idx_alias_program_signature"`
+	SignatureHash string `gorm:"size:64;uniqueIndex:idx_alias_program_signature"`
+	Signature     string
+	GroupID       uint `gorm:"index"`
+	CreatedAt     time.Time
+}
+
+// GroupChange 记录一次手动合并或拆分。合并是把GroupID合并到TargetID；
+// 拆分是把GroupID的拆分深度从PrevDepth改为Depth。Aliases是被修改的别名，用于撤销
+type GroupChange struct {
+	ID        uint   `gorm:"primarykey"`
+	Action    string `gorm:"size:16"`
+	GroupID   uint   `gorm:"index"`
+	TargetID  uint   `gorm:"index"`
+	Depth     int
+	PrevDepth int
+	Aliases   string
+	Moved     int64
+	Actor     string `gorm:"size:255"`
+	CreatedAt time.Time
+	UndoneAt  *time.Time
+	UndoneBy  string `gorm:"size:255"`
+}
+
+// GroupChangeDump 记录一次修改移动过的dump，撤销时移回FromGroupID
+type GroupChangeDump struct {
+	ID          uint `gorm:"primarykey"`
+	ChangeID    uint `gorm:"index"`
+	DumpID      uint
+	FromGroupID uint
+	ToGroupID   uint
+}
+
+// aliasChange 是修改前的别名，PrevGroupID为0表示别名是这次修改新建的
+type aliasChange struct {
+	ID          uint `json:"id"`
+	PrevGroupID uint `json:"prev_group_id"`
+}
+
+// Assignment 是拆分时dump按新深度计算出的签名
+type Assignment struct {
+	DumpID    uint
+	Signature string
+}
+
+// resolveGroup 返回签名对应的分组，合并过的签名返回合并到的分组，create为false且分组不存在时返回nil
+func resolveGroup(tx *gorm.DB, program string, signature string, create bool) (*CrashGroup, error) {
+	hash := hashSignature(signature)
+	alias := GroupAlias{}
+	if err := tx.Where("program = ? AND signature_hash = ?", program, hash).Limit(1).Find(&alias).Error; err != nil {
+		return nil, err
+	}
+	group := CrashGroup{}
+	if alias.ID != 0 {
+		if err := tx.Limit(1).Find(&group, alias.GroupID).Error; err != nil {
+			return nil, err
+		}
+		if group.ID != 0 {
+			return &group, nil
+		}
+	}
+	if err := tx.Where("program = ? AND signature_hash = ?", program, hash).Limit(1).Find(&group).Error; err != nil {
+		return nil, err
+	}
+	if group.ID != 0 {
+		return &group, nil
+	}
+	if !create {
+		return nil, nil
+	}
+	// 多个worker可能同时遇到同一个新签名，插入冲突时不报错，再查一次拿到别人创建的分组
+	candidate := CrashGroup{Program: program, SignatureHash: hash, Signature: signature}
+	result := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "program"}, {Name: "signature_hash"}},
+		DoNothing: true,
+	}).Create(&candidate)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if err := tx.Where("program = ? AND signature_hash = ?", program, hash).Limit(1).Find(&group).Error; err != nil {
+		return nil, err
+	}
+	if group.ID == 0 {
+		return nil, fmt.Errorf("crash group of '%s' neither created nor found", signature)
+	}
+	return &group, nil
+}
+
+// FindGroup 返回签名对应的分组，不存在时返回nil
+func FindGroup(program string, signature string) (*CrashGroup, error) {
+	group, err := resolveGroup(dbConn, program, signature, false)
+	if err != nil {
+		logrus.Errorf("Find crash group of '%s' failed with: %v", signature, err)
+		return nil, err
+	}
+	return group, nil
+}
+
+// QueryGroupAlias 返回分组被合并到的分组id，没有合并过时返回0
+func QueryGroupAlias(group *CrashGroup) (uint, error) {
+	alias := GroupAlias{}
+	result := dbConn.Where("program = ? AND signature_hash = ?", group.Program, group.SignatureHash).Limit(1).Find(&alias)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if alias.GroupID == group.ID {
+		return 0, nil
+	}
+	return alias.GroupID, nil
+}
+
+// recountGroups 根据dump重新计算分组的数量、安装数和首次、最后出现时间，被清理的dump也计算在内
+func recountGroups(tx *gorm.DB, ids ...uint) error {
+	for _, id := range ids {
+		var count int64
+		if err := tx.Model(&Dump{}).Unscoped().Where("group_id = ?", id).Count(&count).Error; err != nil {
+			return err
+		}
+		installs, loops, err := countInstalls(tx, id)
+		if err != nil {
+			return err
+		}
+		updates := map[string]any{"count": count, "installs": installs, "loop_installs": loops}
+		if count > 0 {
+			var first, last Dump
+			if err := tx.Unscoped().Where("group_id = ?", id).Order("created_at").First(&first).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Where("group_id = ?", id).Order("created_at desc").First(&last).Error; err != nil {
+				return err
+			}
+			updates["first_seen"] = first.CreatedAt
+			updates["last_seen"] = last.CreatedAt
+		}
+		if err := tx.Model(&CrashGroup{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MergeGroups 把srcID分组合并到dstID：移动所有dump，并留下别名让以后的dump也归入dstID
+func MergeGroups(srcID uint, dstID uint, actor string) (*GroupChange, error) {
+	if srcID == dstID {
+		return nil, fmt.Errorf("can not merge a crash group into itself")
+	}
+	change := GroupChange{Action: ChangeMerge, GroupID: srcID, TargetID: dstID, Actor: actor}
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		var src, dst CrashGroup
+		if err := tx.First(&src, srcID).Error; err != nil {
+			return fmt.Errorf("crash group %d: %w", srcID, err)
+		}
+		if err := tx.First(&dst, dstID).Error; err != nil {
+			return fmt.Errorf("crash group %d: %w", dstID, err)
+		}
+		if src.Program != dst.Program {
+			return fmt.Errorf("can not merge crash groups of different programs '%s' and '%s'", src.Program, dst.Program)
+		}
+		if err := tx.Create(&change).Error; err != nil {
+			return err
+		}
+		var aliases []aliasChange
+		var existing []GroupAlias
+		if err := tx.Where("group_id = ? OR (program = ? AND signature_hash = ?)", srcID, src.Program, src.SignatureHash).
+			Find(&existing).Error; err != nil {
+			return err
+		}
+		hasSrcAlias := false
+		for _, alias := range existing {
+			aliases = append(aliases, aliasChange{ID: alias.ID, PrevGroupID: alias.GroupID})
+			hasSrcAlias = hasSrcAlias || alias.SignatureHash == src.SignatureHash
+		}
+		if err := tx.Model(&GroupAlias{}).Where("group_id = ? OR (program = ? AND signature_hash = ?)", srcID, src.Program, src.SignatureHash).
+			Update("group_id", dstID).Error; err != nil {
+			return err
+		}
+		if !hasSrcAlias {
+			alias := GroupAlias{Program: src.Program, SignatureHash: src.SignatureHash, Signature: src.Signature, GroupID: dstID}
+			if err := tx.Create(&alias).Error; err != nil {
+				return err
+			}
+			aliases = append(aliases, aliasChange{ID: alias.ID})
+		}
+		moved, err := moveDumps(tx, change.ID, srcID, dstID, nil)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(aliases)
+		change.Moved = moved
+		if err := tx.Model(&change).Updates(map[string]any{"aliases": string(data), "moved": moved}).Error; err != nil {
+			return err
+		}
+		return recountGroups(tx, srcID, dstID)
+	})
+	if err != nil {
+		logrus.Errorf("Merge crash group %d into %d failed with: %v", srcID, dstID, err)
+		return nil, err
+	}
+	return &change, nil
+}
+
+// moveDumps 把fromID分组里的dump移到toID，dumpIDs为nil时移动全部dump，被清理的dump也一起移动
+func moveDumps(tx *gorm.DB, changeID uint, fromID uint, toID uint, dumpIDs []uint) (int64, error) {
+	insert := "INSERT INTO group_change_dumps (change_id, dump_id, from_group_id, to_group_id) SELECT ?, id, group_id, ? FROM dumps WHERE group_id = ?"
+	args := []any{changeID, toID, fromID}
+	update := tx.Model(&Dump{}).Unscoped().Where("group_id = ?", fromID)
+	if dumpIDs != nil {
+		insert += " AND id IN ?"
+		args = append(args, dumpIDs)
+		update = update.Where("id IN ?", dumpIDs)
+	}
+	if err := tx.Exec(insert, args...).Error; err != nil {
+		return 0, err
+	}
+	result := update.Update("group_id", toID)
+	return result.RowsAffected, result.Error
+}
+
+// SplitGroup 用新的深度拆分分组，assignments是分组里每个dump按新深度计算出的签名。
+// 分组记住拆分深度，以后签名落在这个分组的dump也按新深度计算签名
+func SplitGroup(groupID uint, depth int, assignments []Assignment, actor string) (*GroupChange, error) {
+	if depth <= 0 {
+		return nil, fmt.Errorf("invalid depth %d", depth)
+	}
+	change := GroupChange{Action: ChangeSplit, GroupID: groupID, Depth: depth, Actor: actor}
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		group := CrashGroup{}
+		if err := tx.First(&group, groupID).Error; err != nil {
+			return fmt.Errorf("crash group %d: %w", groupID, err)
+		}
+		change.PrevDepth = group.SplitDepth
+		if err := tx.Create(&change).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&group).Update("split_depth", depth).Error; err != nil {
+			return err
+		}
+		targets := map[uint][]uint{}
+		for _, a := range assignments {
+			target, err := resolveGroup(tx, group.Program, a.Signature, true)
+			if err != nil {
+				return err
+			}
+			if target.ID != groupID {
+				targets[target.ID] = append(targets[target.ID], a.DumpID)
+			}
+		}
+		affected := []uint{groupID}
+		for target, ids := range targets {
+			moved, err := moveDumps(tx, change.ID, groupID, target, ids)
+			if err != nil {
+				return err
+			}
+			change.Moved += moved
+			affected = append(affected, target)
+		}
+		if err := tx.Model(&change).Update("moved", change.Moved).Error; err != nil {
+			return err
+		}
+		return recountGroups(tx, affected...)
+	})
+	if err != nil {
+		logrus.Errorf("Split crash group %d by depth %d failed with: %v", groupID, depth, err)
+		return nil, err
+	}
+	return &change, nil
+}
+
+// UndoChange 撤销一次合并或拆分：移回这次修改移动的、之后没有再被移动过的dump，恢复别名和拆分深度。
+// 返回受影响的分组，其中修改之后新处理的和又被移走的dump需要调用者按恢复后的规则重新分组
+func UndoChange(id uint, actor string) (*GroupChange, []uint, error) {
+	change := GroupChange{}
+	affected := map[uint]bool{}
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&change, id).Error; err != nil {
+			return err
+		}
+		if change.UndoneAt != nil {
+			return fmt.Errorf("change %d has already been undone", id)
+		}
+		affected[change.GroupID] = true
+		if change.TargetID != 0 {
+			affected[change.TargetID] = true
+		}
+		var pairs []GroupChangeDump
+		if err := tx.Model(&GroupChangeDump{}).Select("from_group_id", "to_group_id").Distinct().
+			Where("change_id = ?", id).Find(&pairs).Error; err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			moved := tx.Model(&GroupChangeDump{}).Select("dump_id").
+				Where("change_id = ? AND from_group_id = ? AND to_group_id = ?", id, pair.FromGroupID, pair.ToGroupID)
+			if err := tx.Model(&Dump{}).Unscoped().Where("group_id = ? AND id IN (?)", pair.ToGroupID, moved).
+				Update("group_id", pair.FromGroupID).Error; err != nil {
+				return err
+			}
+			affected[pair.FromGroupID] = true
+			affected[pair.ToGroupID] = true
+		}
+		// 之后又被别的修改移走的dump留在原处，它们所在的分组也需要重新分组
+		var current []uint
+		recorded := tx.Model(&GroupChangeDump{}).Select("dump_id").Where("change_id = ?", id)
+		if err := tx.Model(&Dump{}).Unscoped().Distinct().Where("id IN (?)", recorded).
+			Pluck("group_id", &current).Error; err != nil {
+			return err
+		}
+		for _, group := range current {
+			affected[group] = true
+		}
+		var aliases []aliasChange
+		if change.Aliases != "" {
+			if err := json.Unmarshal([]byte(change.Aliases), &aliases); err != nil {
+				return fmt.Errorf("parse aliases of change %d: %w", id, err)
+			}
+		}
+		for _, alias := range aliases {
+			var err error
+			if alias.PrevGroupID == 0 {
+				err = tx.Delete(&GroupAlias{}, alias.ID).Error
+			} else {
+				err = tx.Model(&GroupAlias{}).Where("id = ?", alias.ID).Update("group_id", alias.PrevGroupID).Error
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if change.Action == ChangeSplit {
+			if err := tx.Model(&CrashGroup{}).Where("id = ?", change.GroupID).Update("split_depth", change.PrevDepth).Error; err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		change.UndoneAt = &now
+		change.UndoneBy = actor
+		if err := tx.Model(&change).Updates(map[string]any{"undone_at": now, "undone_by": actor}).Error; err != nil {
+			return err
+		}
+		ids := make([]uint, 0, len(affected))
+		for group := range affected {
+			ids = append(ids, group)
+		}
+		return recountGroups(tx, ids...)
+	})
+	if err != nil {
+		logrus.Errorf("Undo crash group change %d failed with: %v", id, err)
+		return nil, nil, err
+	}
+	ids := make([]uint, 0, len(affected))
+	for group := range affected {
+		ids = append(ids, group)
+	}
+	return &change, ids, nil
+}
+
+// QueryGroupChanges 返回涉及分组的修改记录，groupID为0时返回所有记录，新的在前
+func QueryGroupChanges(groupID uint, limit int) ([]GroupChange, error) {
+	tx := dbConn.Order("id desc").Limit(limit)
+	if groupID != 0 {
+		sub := dbConn.Model(&GroupChangeDump{}).Select("change_id").Where("to_group_id = ?", groupID)
+		tx = tx.Where("group_id = ? OR target_id = ? OR id IN (?)", groupID, groupID, sub)
+	}
+	var changes []GroupChange
+	if err := tx.Find(&changes).Error; err != nil {
+		logrus.Errorf("Query changes of crash group %d failed with: %v", groupID, err)
+		return nil, err
+	}
+	return changes, nil
+}
+
+// QueryGroupDumpIDs 返回分组里的所有dump id，不包括被清理的dump
+func QueryGroupDumpIDs(groupID uint) ([]uint, error) {
+	var ids []uint
+	result := dbConn.Model(&Dump{}).Where("group_id = ?", groupID).Order("id").Pluck("id", &ids)
+	if result.Error != nil {
+		logrus.Errorf("Query dumps of crash group %d failed with: %v", groupID, result.Error)
+		return nil, result.Error
+	}
+	return ids, nil
+}
+
+// QueryChange 返回一条合并或拆分记录
+func QueryChange(id uint) (*GroupChange, error) {
+	change := GroupChange{}
+	if err := dbConn.First(&change, id).Error; err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// IsNotFound 判断错误是不是记录不存在
+func IsNotFound(err error) bool {
+	return errors.Is(err, gorm.ErrRecordNotFound)
+}
@@ -0,0 +1,303 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// SchemaMigration 记录已经执行过的迁移
+type SchemaMigration struct {
+	Version   int `gorm:"primarykey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+}
+
+// migrations 按版本号递增排列，已发布的迁移不能修改，只能追加。
+// 迁移只使用schema.go里冻结的表结构，模型以后的修改不会改变已发布的迁移。
+// 引入迁移之前的版本用AutoMigrate建表，升级时表和列可能已经存在，所以迁移必须是幂等的
+var migrations = []migration{
+	{1, "initial schema", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&v1Dump{}, &v1DumpModule{}, &v1Symbol{}, &v1SymbolDeletion{}, &v1CrashGroup{}, &v1Report{})
+	}},
+	{2, "dump crash time", func(tx *gorm.DB) error {
+		if err := addColumns(tx, &v2Dump{}, "CrashTime", "ClockSkew", "ClockSkewed"); err != nil {
+			return err
+		}
+		if err := addIndex(tx, &v2Dump{}, "CrashTime"); err != nil {
+			return err
+		}
+		return tx.Table("dumps").Where("crash_time IS NULL").Update("crash_time", gorm.Expr("created_at")).Error
+	}},
+	{3, "crash group triage", func(tx *gorm.DB) error {
+		if err := addColumns(tx, &v3CrashGroup{}, "Status", "Assignee", "Notes", "BugID", "FixedVersion", "FixedAt", "Regression"); err != nil {
+			return err
+		}
+		if err := addIndex(tx, &v3CrashGroup{}, "Status"); err != nil {
+			return err
+		}
+		return tx.Table("crash_groups").Where("status IS NULL OR status = ''").Update("status", "new").Error
+	}},
+	{4, "crash group merge and split", func(tx *gorm.DB) error {
+		if err := addColumns(tx, &v4CrashGroup{}, "SplitDepth"); err != nil {
+			return err
+		}
+		return tx.AutoMigrate(&v4GroupAlias{}, &v4GroupChange{}, &v4GroupChangeDump{})
+	}},
+	{5, "crash group stack", func(tx *gorm.DB) error {
+		return addColumns(tx, &v5CrashGroup{}, "Stack")
+	}},
+	{6, "crash statistics", func(tx *gorm.DB) error {
+		if err := addColumns(tx, &v6Dump{}, "OSVersion", "CPU"); err != nil {
+			return err
+		}
+		return tx.AutoMigrate(&v6CrashStat{}, &v6StatState{})
+	}},
+	{7, "release health", func(tx *gorm.DB) error {
+		if err := addColumns(tx, &v7Dump{}, "InstallHash"); err != nil {
+			return err
+		}
+		if err := addIndex(tx, &v7Dump{}, "InstallHash"); err != nil {
+			return err
+		}
+		if err := tx.Table("dumps").Where("install_hash IS NULL").Update("install_hash", "").Error; err != nil {
+			return err
+		}
+		return tx.AutoMigrate(&v7UsageStat{}, &v7UsageInstall{}, &v7CrashInstall{})
+	}},
+	{8, "crash group installations", func(tx *gorm.DB) error {
+		if err := addColumns(tx, &v8Dump{}, "CrashLoop"); err != nil {
+			return err
+		}
+		if err := addColumns(tx, &v8CrashGroup{}, "Installs", "LoopInstalls"); err != nil {
+			return err
+		}
+		if err := addIndex(tx, &v8CrashGroup{}, "Installs"); err != nil {
+			return err
+		}
+		if err := tx.Table("dumps").Where("crash_loop IS NULL").Update("crash_loop", false).Error; err != nil {
+			return err
+		}
+		return tx.Exec("UPDATE crash_groups SET loop_installs = 0, installs = " +
+			"(SELECT COUNT(DISTINCT install_hash) FROM dumps WHERE dumps.group_id = crash_groups.id AND install_hash <> '')").Error
+	}},
+	{9, "webhook deliveries", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&v9WebhookDelivery{}, &v9WebhookAttempt{})
+	}},
+	{10, "spike alerts", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&v10SpikeAlert{})
+	}},
+	{11, "crash group issues", func(tx *gorm.DB) error {
+		if err := addColumns(tx, &v11CrashGroup{}, "IssueURL", "IssueAPI", "IssueState", "IssueClosed"); err != nil {
+			return err
+		}
+		return tx.Table("crash_groups").Where("issue_closed IS NULL").Update("issue_closed", false).Error
+	}},
+	{12, "users and sessions", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&v12User{}, &v12Session{})
+	}},
+	{13, "user grants", func(tx *gorm.DB) error {
+		if err := tx.AutoMigrate(&v13Grant{}); err != nil {
+			return err
+		}
+		// 以前登录的用户可以做所有操作，保持不变
+		return tx.Exec("INSERT INTO grants (user_id, program, role) SELECT id, '*', 'admin' FROM users " +
+			"WHERE id NOT IN (SELECT user_id FROM grants)").Error
+	}},
+	{14, "upload keys", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&v14UploadKey{})
+	}},
+	{15, "unique dump hashes", func(tx *gorm.DB) error {
+		if err := tx.AutoMigrate(&v15DumpHash{}); err != nil {
+			return err
+		}
+		return tx.Exec("INSERT INTO dump_hashes (hash, dump_id) SELECT hash, MIN(id) FROM dumps " +
+			"WHERE hash IS NOT NULL AND hash <> '' AND deleted_at IS NULL GROUP BY hash").Error
+	}},
+	{16, "crash group top frame", func(tx *gorm.DB) error {
+		if err := addColumns(tx, &v16CrashGroup{}, "TopFrame"); err != nil {
+			return err
+		}
+		if err := addIndex(tx, &v16CrashGroup{}, "TopFrame"); err != nil {
+			return err
+		}
+		var groups []struct {
+			ID    uint
+			Stack string
+		}
+		if err := tx.Table("crash_groups").Select("id", "stack").Where("stack <> ''").Scan(&groups).Error; err != nil {
+			return err
+		}
+		for _, group := range groups {
+			if err := tx.Table("crash_groups").Where("id = ?", group.ID).
+				Update("top_frame", TopFrame(group.Stack)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{17, "dump processing attempts", func(tx *gorm.DB) error {
+		if err := addColumns(tx, &v17Dump{}, "Attempts", "RetryAt"); err != nil {
+			return err
+		}
+		return tx.Table("dumps").Where("attempts IS NULL").Update("attempts", 0).Error
+	}},
+	{18, "dump hashes per program", func(tx *gorm.DB) error {
+		// 主键从hash改成(program, hash)，表里的记录都能从dumps重新生成
+		if err := tx.Migrator().DropTable(&v15DumpHash{}); err != nil {
+			return err
+		}
+		if err := tx.AutoMigrate(&v18DumpHash{}); err != nil {
+			return err
+		}
+		return tx.Exec("INSERT INTO dump_hashes (program, hash, dump_id) SELECT COALESCE(program, ''), hash, MIN(id) FROM dumps " +
+			"WHERE hash IS NOT NULL AND hash <> '' AND deleted_at IS NULL GROUP BY COALESCE(program, ''), hash").Error
+	}},
+}
+
+// addColumns 添加表里还没有的列，fields是model的字段名
+func addColumns(tx *gorm.DB, model any, fields ...string) error {
+	for _, field := range fields {
+		if tx.Migrator().HasColumn(model, field) {
+			continue
+		}
+		if err := tx.Migrator().AddColumn(model, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addIndex 给model的字段创建还没有的索引
+func addIndex(tx *gorm.DB, model any, field string) error {
+	if tx.Migrator().HasIndex(model, field) {
+		return nil
+	}
+	return tx.Migrator().CreateIndex(model, field)
+}
+
+// LatestSchemaVersion 是这个版本的程序所知道的最新的数据库结构版本
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion 返回数据库当前的结构版本，还没有执行过任何迁移时返回0
+func SchemaVersion() (int, error) {
+	if !dbConn.Migrator().HasTable(&SchemaMigration{}) {
+		return 0, nil
+	}
+	var version int
+	result := dbConn.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version)
+	if result.Error != nil {
+		logrus.Errorf("Query schema version failed with: %v", result.Error)
+		return 0, result.Error
+	}
+	return version, nil
+}
+
+// PendingMigrations 返回还没有执行的迁移的版本号和名字
+func PendingMigrations() ([]string, error) {
+	current, err := SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	var pending []string
+	for _, m := range migrations {
+		if m.version > current {
+			pending = append(pending, fmt.Sprintf("%d %s", m.version, m.name))
+		}
+	}
+	return pending, nil
+}
+
+// Migrate 依次执行所有还没有执行的迁移，每个迁移在单独的事务里执行
+func Migrate() error {
+	if err := dbConn.AutoMigrate(&SchemaMigration{}); err != nil {
+		return fmt.Errorf("create table 'schema_migrations': %w", err)
+	}
+	if err := checkSchemaVersion(); err != nil {
+		return err
+	}
+	current, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err := dbConn.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.version, Name: m.name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d '%s' failed: %w", m.version, m.name, err)
+		}
+		logrus.Infof("Applied database migration %d '%s'", m.version, m.name)
+	}
+	return nil
+}
+
+// checkSchemaVersion 数据库结构比程序知道的新时返回错误，避免旧程序写坏新结构的数据
+func checkSchemaVersion() error {
+	current, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > LatestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than the latest version %d known by this binary", current, LatestSchemaVersion())
+	}
+	return nil
+}
+
+// RequireLatestSchema 数据库结构不是最新版本时返回错误
+func RequireLatestSchema() error {
+	pending, err := PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("database has %d pending migrations, run 'bp-server migrate' first", len(pending))
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// DumpFilter 选择参与清理的dump：Program不为空时只选这个程序，否则选除Exclude以外的所有程序
+type DumpFilter struct {
+	Program string
+	Exclude []string
+}
+
+func (f DumpFilter) scope(tx *gorm.DB) *gorm.DB {
+	if f.Program != "" {
+		return tx.Where("program = ?", f.Program)
+	}
+	if len(f.Exclude) > 0 {
+		return tx.Where("program NOT IN ?", f.Exclude)
+	}
+	return tx
+}
+
+func QueryDumpsBefore(f DumpFilter, before time.Time) ([]Dump, error) {
+	var dumps []Dump
+	result := dbConn.Scopes(f.scope).Where("created_at < ?", before).Order("id").Find(&dumps)
+	if result.Error != nil {
+		logrus.Errorf("Query dumps before %v failed with: %v", before, result.Error)
+		return nil, result.Error
+	}
+	return dumps, nil
+}
+
+// QueryGroupsExceeding 返回未清理的dump数量超过max的分组
+func QueryGroupsExceeding(f DumpFilter, max int) ([]uint, error) {
+	var ids []uint
+	result := dbConn.Model(&Dump{}).Scopes(f.scope).
+		Where("group_id <> 0").
+		Group("group_id").
+		Having("COUNT(*) > ?", max).
+		Pluck("group_id", &ids)
+	if result.Error != nil {
+		logrus.Errorf("Query groups with more than %d dumps failed with: %v", max, result.Error)
+		return nil, result.Error
+	}
+	return ids, nil
+}
+
+// QueryGroupOverflow 返回分组里除最新的keep个以外的dump
+func QueryGroupOverflow(groupID uint, keep int) ([]Dump, error) {
+	var dumps []Dump
+	result := dbConn.Where("group_id = ?", groupID).Order("id desc").Find(&dumps)
+	if result.Error != nil {
+		logrus.Errorf("Query dumps of group %d beyond %d failed with: %v", groupID, keep, result.Error)
+		return nil, result.Error
+	}
+	if len(dumps) <= keep {
+		return nil, nil
+	}
+	return dumps[keep:], nil
+}
+
+func QueryDumpBytes(f DumpFilter) (int64, error) {
+	var total int64
+	result := dbConn.Model(&Dump{}).Scopes(f.scope).Select("COALESCE(SUM(size), 0)").Scan(&total)
+	if result.Error != nil {
+		logrus.Errorf("Query total dump size failed with: %v", result.Error)
+		return 0, result.Error
+	}
+	return total, nil
+}
+
+// QueryOldestDumps 按上传时间从旧到新分页返回dump
+func QueryOldestDumps(f DumpFilter, afterID uint, limit int) ([]Dump, error) {
+	var dumps []Dump
+	result := dbConn.Scopes(f.scope).Where("id > ?", afterID).Order("id").Limit(limit).Find(&dumps)
+	if result.Error != nil {
+		logrus.Errorf("Query oldest dumps after %d failed with: %v", afterID, result.Error)
+		return nil, result.Error
+	}
+	return dumps, nil
+}
+
+// QueryDumpsWithoutSize 返回旧版本留下的没有记录文件大小的dump
+func QueryDumpsWithoutSize() ([]Dump, error) {
+	var dumps []Dump
+	result := dbConn.Where("size = 0 OR size IS NULL").Find(&dumps)
+	if result.Error != nil {
+		logrus.Errorf("Query dumps without size failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	return dumps, nil
+}
+
+func UpdateDumpSize(id uint, size int64) error {
+	result := dbConn.Model(&Dump{}).Where("id = ?", id).Update("size", size)
+	if result.Error != nil {
+		logrus.Errorf("Update size of dump %d failed with: %v", id, result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+// PruneDump 删除dump的处理结果并软删除dump记录。软删除的记录仍可用Unscoped统计，
+// 所属分组的Count不变
+func PruneDump(id uint) error {
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("dump_id = ?", id).Delete(&Report{}).Error; err != nil {
+			return err
+		}
+		// 清理后相同内容可以重新上传
+		if err := tx.Where("dump_id = ?", id).Delete(&DumpHash{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Dump{}, id).Error
+	})
+	if err != nil {
+		logrus.Errorf("Prune dump %d failed with: %v", id, err)
+	}
+	return err
+}
@@ -0,0 +1,421 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 以下是每个迁移执行时的表结构，只包含那个迁移创建或添加的字段。
+// 模型以后的修改由新的迁移完成，这里的结构不能跟着模型修改
+
+// 版本1 initial schema
+
+type v1Dump struct {
+	gorm.Model
+	OS            string
+	Program       string
+	Version       string
+	Filename      string
+	Build         string
+	Size          int64
+	Compress      string
+	Hash          string `gorm:"index"`
+	Status        string `gorm:"index"`
+	GroupID       uint   `gorm:"index"`
+	Duplicates    int64
+	LastDuplicate *time.Time
+}
+
+func (v1Dump) TableName() string { return "dumps" }
+
+type v1DumpModule struct {
+	ID        uint   `gorm:"primarykey"`
+	DumpID    uint   `gorm:"index"`
+	DebugFile string `gorm:"index:idx_dump_module_symbol"`
+	DebugID   string `gorm:"index:idx_dump_module_symbol"`
+}
+
+func (v1DumpModule) TableName() string { return "dump_modules" }
+
+type v1Symbol struct {
+	gorm.Model
+	Entry    string `gorm:"index:idx_symbol_entry_id"`
+	DebugID  string `gorm:"index:idx_symbol_entry_id"`
+	Filename string
+	Program  string
+	Version  string
+}
+
+func (v1Symbol) TableName() string { return "symbols" }
+
+type v1SymbolDeletion struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Entry     string
+	DebugID   string
+	Size      int64
+	Reason    string
+}
+
+func (v1SymbolDeletion) TableName() string { return "symbol_deletions" }
+
+type v1CrashGroup struct {
+	gorm.Model
+	Program       string `gorm:"size:255;uniqueIndex:idx_group_program_signature"`
+	SignatureHash string `gorm:"size:64;uniqueIndex:idx_group_program_signature"`
+	Signature     string
+	Count         int64
+	FirstSeen     time.Time
+	LastSeen      time.Time
+}
+
+func (v1CrashGroup) TableName() string { return "crash_groups" }
+
+type v1Report struct {
+	ID     uint `gorm:"primarykey"`
+	DumpID uint `gorm:"uniqueIndex"`
+	Text   string
+	Frames string
+}
+
+func (v1Report) TableName() string { return "reports" }
+
+// 版本2 dump crash time
+
+type v2Dump struct {
+	CrashTime   time.Time `gorm:"index"`
+	ClockSkew   int64
+	ClockSkewed bool
+}
+
+func (v2Dump) TableName() string { return "dumps" }
+
+// 版本3 crash group triage
+
+type v3CrashGroup struct {
+	Status       string `gorm:"size:32;index;default:new"`
+	Assignee     string `gorm:"size:255"`
+	Notes        string
+	BugID        string `gorm:"size:255"`
+	FixedVersion string `gorm:"size:255"`
+	FixedAt      *time.Time
+	Regression   bool
+}
+
+func (v3CrashGroup) TableName() string { return "crash_groups" }
+
+// 版本4 crash group merge and split
+
+type v4CrashGroup struct {
+	SplitDepth int
+}
+
+func (v4CrashGroup) TableName() string { return "crash_groups" }
+
+type v4GroupAlias struct {
+	ID            uint   `gorm:"primarykey"`
+	Program       string `gorm:"size:255;uniqueIndex:idx_alias_program_signature"`
+	SignatureHash string `gorm:"size:64;uniqueIndex:idx_alias_program_signature"`
+	Signature     string
+	GroupID       uint `gorm:"index"`
+	CreatedAt     time.Time
+}
+
+func (v4GroupAlias) TableName() string { return "group_aliases" }
+
+type v4GroupChange struct {
+	ID        uint   `gorm:"primarykey"`
+	Action    string `gorm:"size:16"`
+	GroupID   uint   `gorm:"index"`
+	TargetID  uint   `gorm:"index"`
+	Depth     int
+	PrevDepth int
+	Aliases   string
+	Moved     int64
+	Actor     string `gorm:"size:255"`
+	CreatedAt time.Time
+	UndoneAt  *time.Time
+	UndoneBy  string `gorm:"size:255"`
+}
+
+func (v4GroupChange) TableName() string { return "group_changes" }
+
+type v4GroupChangeDump struct {
+	ID          uint `gorm:"primarykey"`
+	ChangeID    uint `gorm:"index"`
+	DumpID      uint
+	FromGroupID uint
+	ToGroupID   uint
+}
+
+func (v4GroupChangeDump) TableName() string { return "group_change_dumps" }
+
+// 版本5 crash group stack
+
+type v5CrashGroup struct {
+	Stack string
+}
+
+func (v5CrashGroup) TableName() string { return "crash_groups" }
+
+// 版本6 crash statistics
+
+type v6Dump struct {
+	OSVersion string
+	CPU       string
+}
+
+func (v6Dump) TableName() string { return "dumps" }
+
+type v6CrashStat struct {
+	ID        uint   `gorm:"primarykey"`
+	Day       string `gorm:"size:10;index:idx_stat_day_program,priority:1"`
+	Program   string `gorm:"size:255;index:idx_stat_day_program,priority:2"`
+	Version   string `gorm:"size:255"`
+	OSVersion string `gorm:"size:255"`
+	CPU       string `gorm:"size:64"`
+	GroupID   uint   `gorm:"index"`
+	Count     int64
+}
+
+func (v6CrashStat) TableName() string { return "crash_stats" }
+
+type v6StatState struct {
+	Name   string `gorm:"primarykey;size:64"`
+	Cursor time.Time
+}
+
+func (v6StatState) TableName() string { return "stat_states" }
+
+// 版本7 release health
+
+type v7Dump struct {
+	InstallHash string `gorm:"size:64;index"`
+}
+
+func (v7Dump) TableName() string { return "dumps" }
+
+type v7UsageStat struct {
+	ID       uint   `gorm:"primarykey"`
+	Day      string `gorm:"size:10;uniqueIndex:idx_usage_stat,priority:1"`
+	Program  string `gorm:"size:255;uniqueIndex:idx_usage_stat,priority:2"`
+	Version  string `gorm:"size:255;uniqueIndex:idx_usage_stat,priority:3"`
+	Sessions int64
+}
+
+func (v7UsageStat) TableName() string { return "usage_stats" }
+
+type v7UsageInstall struct {
+	ID          uint   `gorm:"primarykey"`
+	Day         string `gorm:"size:10;uniqueIndex:idx_usage_install,priority:1"`
+	Program     string `gorm:"size:255;uniqueIndex:idx_usage_install,priority:2"`
+	Version     string `gorm:"size:255;uniqueIndex:idx_usage_install,priority:3"`
+	InstallHash string `gorm:"size:64;uniqueIndex:idx_usage_install,priority:4"`
+}
+
+func (v7UsageInstall) TableName() string { return "usage_installs" }
+
+type v7CrashInstall struct {
+	ID          uint   `gorm:"primarykey"`
+	Day         string `gorm:"size:10;index:idx_crash_install,priority:1"`
+	Program     string `gorm:"size:255;index:idx_crash_install,priority:2"`
+	Version     string `gorm:"size:255;index:idx_crash_install,priority:3"`
+	InstallHash string `gorm:"size:64"`
+}
+
+func (v7CrashInstall) TableName() string { return "crash_installs" }
+
+// 版本8 crash group installations
+
+type v8Dump struct {
+	CrashLoop bool `gorm:"default:false"`
+}
+
+func (v8Dump) TableName() string { return "dumps" }
+
+type v8CrashGroup struct {
+	Installs     int64 `gorm:"default:0;index"`
+	LoopInstalls int64 `gorm:"default:0"`
+}
+
+func (v8CrashGroup) TableName() string { return "crash_groups" }
+
+// 版本9 webhook deliveries
+
+type v9WebhookDelivery struct {
+	ID          uint   `gorm:"primarykey"`
+	Webhook     string `gorm:"size:255;index"`
+	Event       string `gorm:"size:64"`
+	Payload     string
+	Status      string `gorm:"size:16;index:idx_delivery_status_next,priority:1"`
+	Attempts    int
+	NextAttempt time.Time `gorm:"index:idx_delivery_status_next,priority:2"`
+	ReplayOf    uint
+	CreatedAt   time.Time
+	DeliveredAt *time.Time
+}
+
+func (v9WebhookDelivery) TableName() string { return "webhook_deliveries" }
+
+type v9WebhookAttempt struct {
+	ID         uint `gorm:"primarykey"`
+	DeliveryID uint `gorm:"index"`
+	StatusCode int
+	Response   string
+	Error      string
+	Duration   int64
+	CreatedAt  time.Time
+}
+
+func (v9WebhookAttempt) TableName() string { return "webhook_attempts" }
+
+// 版本10 spike alerts
+
+type v10SpikeAlert struct {
+	ID        uint   `gorm:"primarykey"`
+	Day       string `gorm:"size:10;uniqueIndex:idx_spike,priority:1"`
+	Kind      string `gorm:"size:16;uniqueIndex:idx_spike,priority:2"`
+	Program   string `gorm:"size:255;uniqueIndex:idx_spike,priority:3"`
+	Version   string `gorm:"size:255;uniqueIndex:idx_spike,priority:4"`
+	GroupID   uint   `gorm:"uniqueIndex:idx_spike,priority:5;index"`
+	Count     int64
+	Baseline  float64
+	StdDev    float64
+	Score     float64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (v10SpikeAlert) TableName() string { return "spike_alerts" }
+
+// 版本11 crash group issues
+
+type v11CrashGroup struct {
+	IssueURL    string
+	IssueAPI    string
+	IssueState  string `gorm:"size:64"`
+	IssueClosed bool
+}
+
+func (v11CrashGroup) TableName() string { return "crash_groups" }
+
+// 版本12 users and sessions
+
+type v12User struct {
+	ID           uint   `gorm:"primarykey"`
+	Username     string `gorm:"size:255;uniqueIndex"`
+	PasswordHash string `gorm:"size:255"`
+	Disabled     bool
+	LastLogin    *time.Time
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (v12User) TableName() string { return "users" }
+
+type v12Session struct {
+	ID        uint      `gorm:"primarykey"`
+	TokenHash string    `gorm:"size:64;uniqueIndex"`
+	UserID    uint      `gorm:"index"`
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+func (v12Session) TableName() string { return "sessions" }
+
+// 版本13 user grants
+
+type v13Grant struct {
+	ID      uint   `gorm:"primarykey"`
+	UserID  uint   `gorm:"uniqueIndex:idx_grant_user_program"`
+	Program string `gorm:"size:255;uniqueIndex:idx_grant_user_program"`
+	Role    string `gorm:"size:16"`
+}
+
+func (v13Grant) TableName() string { return "grants" }
+
+// 版本14 upload keys
+
+type v14UploadKey struct {
+	ID        uint   `gorm:"primarykey"`
+	Name      string `gorm:"size:255"`
+	Prefix    string `gorm:"size:16"`
+	KeyHash   string `gorm:"size:64;uniqueIndex"`
+	Programs  string `gorm:"size:1024"`
+	Dump      bool
+	Symbol    bool
+	CreatedBy string `gorm:"size:255"`
+	CreatedAt time.Time
+	LastUsed  *time.Time
+	RevokedAt *time.Time
+	RevokedBy string `gorm:"size:255"`
+}
+
+func (v14UploadKey) TableName() string { return "upload_keys" }
+
+// 版本15 unique dump hashes
+
+type v15DumpHash struct {
+	Hash   string `gorm:"primaryKey;size:64"`
+	DumpID uint   `gorm:"index"`
+}
+
+func (v15DumpHash) TableName() string { return "dump_hashes" }
+
+// 版本16 crash group top frame
+
+type v16CrashGroup struct {
+	TopFrame string `gorm:"size:255;index"`
+}
+
+func (v16CrashGroup) TableName() string { return "crash_groups" }
+
+// 版本17 dump processing attempts
+
+type v17Dump struct {
+	Attempts int `gorm:"default:0"`
+	RetryAt  *time.Time
+}
+
+func (v17Dump) TableName() string { return "dumps" }
+
+// 版本18 dump hashes per program
+
+type v18DumpHash struct {
+	Program string `gorm:"primaryKey;size:255"`
+	Hash    string `gorm:"primaryKey;size:64"`
+	DumpID  uint   `gorm:"index"`
+}
+
+func (v18DumpHash) TableName() string { return "dump_hashes" }
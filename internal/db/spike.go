@@ -0,0 +1,143 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	SpikeGroup   = "group"
+	SpikeRelease = "release"
+)
+
+// SpikeAlert 是一次崩溃数突增，Kind为group时按分组统计，为release时按程序和版本统计。
+// 同一天同一个对象只记录一次，Count和Score是当天观察到的最大值
+type SpikeAlert struct {
+	ID        uint   `gorm:"primarykey"`
+	Day       string `gorm:"size:10;uniqueIndex:idx_spike,priority:1"`
+	Kind      string `gorm:"size:16;uniqueIndex:idx_spike,priority:2"`
+	Program   string `gorm:"size:255;uniqueIndex:idx_spike,priority:3"`
+	Version   string `gorm:"size:255;uniqueIndex:idx_spike,priority:4"`
+	GroupID   uint   `gorm:"uniqueIndex:idx_spike,priority:5;index"`
+	Count     int64
+	Baseline  float64
+	StdDev    float64
+	Score     float64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// SpikeCount 是按天汇总的崩溃数，按分组汇总时Version为空
+type SpikeCount struct {
+	Day     string
+	Program string
+	Version string
+	GroupID uint
+	Count   int64 `gorm:"column:total"`
+}
+
+// QuerySpikeCounts 返回[from, to]之间每天每个分组(kind为group)或每个版本(kind为release)的崩溃数
+func QuerySpikeCounts(kind string, from string, to string) ([]SpikeCount, error) {
+	tx := dbConn.Model(&CrashStat{}).Where("day >= ? AND day <= ?", from, to)
+	if kind == SpikeGroup {
+		tx = tx.Where("group_id <> 0").Select("day, program, group_id, SUM(count) AS total").Group("day, program, group_id")
+	} else {
+		tx = tx.Select("day, program, version, SUM(count) AS total").Group("day, program, version")
+	}
+	var counts []SpikeCount
+	if err := tx.Find(&counts).Error; err != nil {
+		logrus.Errorf("Query %s crash counts from %s to %s failed with: %v", kind, from, to, err)
+		return nil, err
+	}
+	return counts, nil
+}
+
+// SaveSpikeAlert 保存突增记录，当天已经记录过时只更新更大的数量，返回是否是新的记录
+func SaveSpikeAlert(alert *SpikeAlert) (bool, error) {
+	created := false
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		existing := SpikeAlert{}
+		result := tx.Where("day = ? AND kind = ? AND program = ? AND version = ? AND group_id = ?",
+			alert.Day, alert.Kind, alert.Program, alert.Version, alert.GroupID).Limit(1).Find(&existing)
+		if result.Error != nil {
+			return result.Error
+		}
+		if existing.ID == 0 {
+			created = true
+			return tx.Create(alert).Error
+		}
+		alert.ID = existing.ID
+		if alert.Count <= existing.Count {
+			return nil
+		}
+		return tx.Model(&existing).Updates(map[string]any{"count": alert.Count, "score": alert.Score}).Error
+	})
+	if err != nil {
+		logrus.Errorf("Save spike alert of %s %s %s %d failed with: %v", alert.Kind, alert.Program, alert.Version, alert.GroupID, err)
+	}
+	return created, err
+}
+
+// SpikeFilter 是突增记录的过滤条件，为空的字段不过滤，Programs不为nil时只返回这些程序的记录
+type SpikeFilter struct {
+	Program  string
+	GroupID  uint
+	Programs []string
+}
+
+// QuerySpikeAlerts 按时间倒序返回突增记录
+func QuerySpikeAlerts(page int, filter SpikeFilter) ([]SpikeAlert, error) {
+	const kLimit int = 50
+	index := kLimit * page
+	if index < 0 {
+		index = 0
+	}
+	tx := dbConn.Order("day desc").Order("id desc").Limit(kLimit).Offset(index)
+	if filter.Program != "" {
+		tx = tx.Where("program = ?", filter.Program)
+	}
+	if filter.GroupID != 0 {
+		tx = tx.Where("group_id = ?", filter.GroupID)
+	}
+	if filter.Programs != nil {
+		tx = tx.Where("program IN ?", filter.Programs)
+	}
+	var alerts []SpikeAlert
+	if err := tx.Find(&alerts).Error; err != nil {
+		logrus.Errorf("Query spike alerts failed with: %v", err)
+		return nil, err
+	}
+	return alerts, nil
+}
@@ -0,0 +1,219 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// CrashStat 是按天汇总的dump数量，Day是<clock><timezone>时区下崩溃时间的日期。
+// 被清理的dump也计算在内，没有处理的dump的GroupID为0
+type CrashStat struct {
+	ID        uint   `gorm:"primarykey"`
+	Day       string `gorm:"size:10;index:idx_stat_day_program,priority:1"`
+	Program   string `gorm:"size:255;index:idx_stat_day_program,priority:2"`
+	Version   string `gorm:"size:255"`
+	OSVersion string `gorm:"size:255"`
+	CPU       string `gorm:"size:64"`
+	GroupID   uint   `gorm:"index"`
+	Count     int64
+}
+
+// StatState 记录汇总进行到的位置，Cursor是已经汇总过的dump的最大更新时间
+type StatState struct {
+	Name   string `gorm:"primarykey;size:64"`
+	Cursor time.Time
+}
+
+// DumpTime 是dump的崩溃时间和更新时间
+type DumpTime struct {
+	ID        uint
+	CrashTime time.Time
+	UpdatedAt time.Time
+}
+
+// StatCount 是汇总查询的一行，Key的含义取决于查询
+type StatCount struct {
+	Day   string
+	Key   string `gorm:"column:stat_key"`
+	Count int64  `gorm:"column:total"`
+}
+
+func QueryStatCursor(name string) (time.Time, error) {
+	state := StatState{}
+	result := dbConn.Where("name = ?", name).Limit(1).Find(&state)
+	if result.Error != nil {
+		logrus.Errorf("Query stat state '%s' failed with: %v", name, result.Error)
+		return time.Time{}, result.Error
+	}
+	return state.Cursor, nil
+}
+
+func SaveStatCursor(name string, cursor time.Time) error {
+	result := dbConn.Save(&StatState{Name: name, Cursor: cursor})
+	if result.Error != nil {
+		logrus.Errorf("Save stat state '%s' failed with: %v", name, result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+// QueryUpdatedDumps 按id顺序返回更新时间不早于since、id大于afterID的dump的时间，包括被清理的dump
+func QueryUpdatedDumps(since time.Time, afterID uint, limit int) ([]DumpTime, error) {
+	var times []DumpTime
+	result := dbConn.Model(&Dump{}).Unscoped().Select("id", "crash_time", "updated_at").
+		Where("updated_at >= ? AND id > ?", since, afterID).Order("id").Limit(limit).Find(&times)
+	if result.Error != nil {
+		logrus.Errorf("Query updated dumps failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	return times, nil
+}
+
+// RebuildDayStats 用崩溃时间在[start, end)之间的dump重新汇总day这一天的崩溃数和崩溃过的安装
+func RebuildDayStats(day string, start time.Time, end time.Time) error {
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("day = ?", day).Delete(&CrashStat{}).Error; err != nil {
+			return err
+		}
+		err := tx.Exec("INSERT INTO crash_stats (day, program, version, os_version, cpu, group_id, count) "+
+			"SELECT ?, program, version, os_version, cpu, group_id, COUNT(*) FROM dumps "+
+			"WHERE crash_time >= ? AND crash_time < ? GROUP BY program, version, os_version, cpu, group_id",
+			day, start, end).Error
+		if err != nil {
+			return err
+		}
+		return rebuildDayInstalls(tx, day, start, end)
+	})
+	if err != nil {
+		logrus.Errorf("Rebuild crash stats of %s failed with: %v", day, err)
+		return err
+	}
+	return nil
+}
+
+// ClearStats 删除所有从dump汇总的数据和汇总位置，使用上报不是从dump汇总的，不会被删除
+func ClearStats() error {
+	if err := dbConn.Where("1 = 1").Delete(&CrashStat{}).Error; err != nil {
+		return err
+	}
+	if err := dbConn.Where("1 = 1").Delete(&CrashInstall{}).Error; err != nil {
+		return err
+	}
+	return dbConn.Where("1 = 1").Delete(&StatState{}).Error
+}
+
+// StatFilter 是统计查询的条件，From和To是包含在内的日期，为空的字段不过滤
+type StatFilter struct {
+	Program string
+	Version string
+	From    string
+	To      string
+}
+
+func (f *StatFilter) apply(tx *gorm.DB) *gorm.DB {
+	return f.applyTo(tx, &CrashStat{})
+}
+
+// QueryStatPrograms 返回有崩溃统计或使用上报的程序
+func QueryStatPrograms() ([]string, error) {
+	var programs, used []string
+	if err := dbConn.Model(&CrashStat{}).Distinct().Pluck("program", &programs).Error; err != nil {
+		return nil, err
+	}
+	if err := dbConn.Model(&UsageStat{}).Distinct().Pluck("program", &used).Error; err != nil {
+		return nil, err
+	}
+	programs = union(programs, used)
+	sort.Strings(programs)
+	return programs, nil
+}
+
+// QueryStatVersions 返回程序有崩溃统计或使用上报的版本
+func QueryStatVersions(program string) ([]string, error) {
+	var versions, used []string
+	if err := dbConn.Model(&CrashStat{}).Where("program = ?", program).Distinct().Pluck("version", &versions).Error; err != nil {
+		return nil, err
+	}
+	if err := dbConn.Model(&UsageStat{}).Where("program = ?", program).Distinct().Pluck("version", &used).Error; err != nil {
+		return nil, err
+	}
+	return union(versions, used), nil
+}
+
+func union(a []string, b []string) []string {
+	seen := make(map[string]bool, len(a))
+	for _, s := range a {
+		seen[s] = true
+	}
+	for _, s := range b {
+		if !seen[s] {
+			seen[s] = true
+			a = append(a, s)
+		}
+	}
+	return a
+}
+
+// QueryDailyStats 返回每天每个版本的崩溃数量，Key是版本
+func QueryDailyStats(filter StatFilter) ([]StatCount, error) {
+	var counts []StatCount
+	result := filter.apply(dbConn).Select("day, version AS stat_key, SUM(count) AS total").
+		Group("day, version").Order("day").Find(&counts)
+	if result.Error != nil {
+		logrus.Errorf("Query daily crash stats failed with: %v", result.Error)
+	}
+	return counts, result.Error
+}
+
+// QueryStatDistribution 返回按column分布的崩溃数量，column只能是os_version、cpu或group_id
+func QueryStatDistribution(filter StatFilter, column string, limit int) ([]StatCount, error) {
+	switch column {
+	case "os_version", "cpu", "group_id":
+	default:
+		panic("invalid stat column " + column)
+	}
+	tx := filter.apply(dbConn)
+	if column == "group_id" {
+		tx = tx.Where("group_id <> 0")
+	}
+	var counts []StatCount
+	result := tx.Select(column + " AS stat_key, SUM(count) AS total").Group(column).
+		Order("total desc").Limit(limit).Find(&counts)
+	if result.Error != nil {
+		logrus.Errorf("Query crash stats by %s failed with: %v", column, result.Error)
+	}
+	return counts, result.Error
+}
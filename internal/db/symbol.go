@@ -0,0 +1,258 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Symbol 记录一次符号上传，Program和Version是可选的，用于按版本保留符号
+type Symbol struct {
+	gorm.Model
+	Entry    string `gorm:"index:idx_symbol_entry_id"`
+	DebugID  string `gorm:"index:idx_symbol_entry_id"`
+	Filename string
+	Program  string
+	Version  string
+}
+
+// DumpModule 记录一个dump引用到的模块，也就是它需要的符号
+type DumpModule struct {
+	ID        uint   `gorm:"primarykey"`
+	DumpID    uint   `gorm:"index"`
+	DebugFile string `gorm:"index:idx_dump_module_symbol"`
+	DebugID   string `gorm:"index:idx_dump_module_symbol"`
+}
+
+// SymbolDeletion 是符号回收的审计记录
+type SymbolDeletion struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Entry     string
+	DebugID   string
+	Size      int64
+	Reason    string
+}
+
+// SymbolKey 唯一确定符号目录下的一个 <entry>/<id>
+type SymbolKey struct {
+	Entry   string
+	DebugID string
+}
+
+func AddSymbol(entry string, id string, filename string, program string, version string) error {
+	symbol := Symbol{
+		Entry:    entry,
+		DebugID:  id,
+		Filename: filename,
+		Program:  program,
+		Version:  version,
+	}
+	result := dbConn.Create(&symbol)
+	if result.Error != nil {
+		logrus.Errorf("Insert record to table 'symbols' failed with: %v", result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+// HasReleaseSymbols 判断程序的这个版本是否上传过符号，也就是不是一个正式构建的版本
+func HasReleaseSymbols(program string, version string) (bool, error) {
+	var count int64
+	result := dbConn.Model(&Symbol{}).Where("program = ? AND version = ?", program, version).Limit(1).Count(&count)
+	if result.Error != nil {
+		logrus.Errorf("Query symbols of '%s' %s failed with: %v", program, version, result.Error)
+		return false, result.Error
+	}
+	return count > 0, nil
+}
+
+func AddDumpModules(dumpID uint, modules []DumpModule) error {
+	if len(modules) == 0 {
+		return nil
+	}
+	for i := range modules {
+		modules[i].DumpID = dumpID
+	}
+	result := dbConn.CreateInBatches(modules, 100)
+	if result.Error != nil {
+		logrus.Errorf("Insert records to table 'dump_modules' for dump %d failed with: %v", dumpID, result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+// QuerySymbolsReferencedSince 返回since之后上传的dump引用过的符号
+func QuerySymbolsReferencedSince(since time.Time) ([]SymbolKey, error) {
+	var keys []SymbolKey
+	result := dbConn.Model(&DumpModule{}).
+		Distinct("dump_modules.debug_file AS entry", "dump_modules.debug_id AS debug_id").
+		Joins("JOIN dumps ON dumps.id = dump_modules.dump_id").
+		Where("dumps.created_at >= ?", since).
+		Scan(&keys)
+	if result.Error != nil {
+		logrus.Errorf("Query referenced symbols since %v failed with: %v", since, result.Error)
+		return nil, result.Error
+	}
+	return keys, nil
+}
+
+// QuerySymbolsWithRelease 返回每一次上传都记录了程序和版本的符号。
+// 升级前上传的符号和上传时没有给出程序和版本的符号不在其中，不知道它们属于哪个版本
+func QuerySymbolsWithRelease() ([]SymbolKey, error) {
+	var keys []SymbolKey
+	result := dbConn.Model(&Symbol{}).
+		Select("entry, debug_id").
+		Group("entry, debug_id").
+		Having("SUM(CASE WHEN program IS NULL OR program = '' OR version IS NULL OR version = '' THEN 1 ELSE 0 END) = 0").
+		Scan(&keys)
+	if result.Error != nil {
+		logrus.Errorf("Query symbols with release from table 'symbols' failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	return keys, nil
+}
+
+// QuerySymbolsOfCrashedVersions 返回since之后有崩溃的版本所上传的符号
+func QuerySymbolsOfCrashedVersions(since time.Time) ([]SymbolKey, error) {
+	var keys []SymbolKey
+	crashed := dbConn.Model(&Dump{}).Select("program, version").Where("created_at >= ?", since)
+	result := dbConn.Model(&Symbol{}).
+		Distinct("entry", "debug_id").
+		Where("(program, version) IN (?)", crashed).
+		Scan(&keys)
+	if result.Error != nil {
+		logrus.Errorf("Query symbols of versions crashed since %v failed with: %v", since, result.Error)
+		return nil, result.Error
+	}
+	return keys, nil
+}
+
+// QuerySymbolsOfLatestReleases 返回每个程序最近上传过符号的count个版本的符号
+func QuerySymbolsOfLatestReleases(count int) ([]SymbolKey, error) {
+	type release struct {
+		Program string
+		Version string
+		Latest  uint
+	}
+	var releases []release
+	result := dbConn.Model(&Symbol{}).
+		Select("program, version, MAX(id) AS latest").
+		Where("program <> '' AND version <> ''").
+		Group("program, version").
+		Order("program, latest DESC").
+		Scan(&releases)
+	if result.Error != nil {
+		logrus.Errorf("Query latest releases from table 'symbols' failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	var keys []SymbolKey
+	kept := make(map[string]int)
+	for _, r := range releases {
+		if kept[r.Program] >= count {
+			continue
+		}
+		kept[r.Program]++
+		var versionKeys []SymbolKey
+		result = dbConn.Model(&Symbol{}).
+			Distinct("entry", "debug_id").
+			Where("program = ? AND version = ?", r.Program, r.Version).
+			Scan(&versionKeys)
+		if result.Error != nil {
+			logrus.Errorf("Query symbols of %s %s failed with: %v", r.Program, r.Version, result.Error)
+			return nil, result.Error
+		}
+		keys = append(keys, versionKeys...)
+	}
+	return keys, nil
+}
+
+// SymbolFilter 是符号上传记录的过滤条件，为空的字段不过滤，Programs不为nil时只返回这些程序上传的符号
+type SymbolFilter struct {
+	Program  string
+	Entry    string
+	Programs []string
+}
+
+// QuerySymbolList 按上传时间倒序返回符号上传记录
+func QuerySymbolList(page int, filter SymbolFilter) ([]Symbol, error) {
+	const kLimit int = 50
+	index := kLimit * page
+	if index < 0 {
+		index = 0
+	}
+	tx := dbConn.Order("id desc").Limit(kLimit).Offset(index)
+	if filter.Program != "" {
+		tx = tx.Where("program = ?", filter.Program)
+	}
+	if filter.Entry != "" {
+		tx = tx.Where("entry = ?", filter.Entry)
+	}
+	if filter.Programs != nil {
+		tx = tx.Where("program IN ?", filter.Programs)
+	}
+	var symbols []Symbol
+	if err := tx.Find(&symbols).Error; err != nil {
+		logrus.Errorf("Query table 'symbols' failed with: %v", err)
+		return nil, err
+	}
+	return symbols, nil
+}
+
+// QuerySymbolOwners 返回上传过 <entry>/<id> 的程序，没有填写程序的上传记录为空字符串
+func QuerySymbolOwners(entry string, id string) ([]string, error) {
+	var programs []string
+	result := dbConn.Model(&Symbol{}).Distinct("program").Where("entry = ? AND debug_id = ?", entry, id).Pluck("program", &programs)
+	if result.Error != nil {
+		logrus.Errorf("Query programs of symbol %s/%s failed with: %v", entry, id, result.Error)
+		return nil, result.Error
+	}
+	return programs, nil
+}
+
+// RecordSymbolDeletion 删除符号的上传记录并写入审计记录
+func RecordSymbolDeletion(entry string, id string, size int64, reason string) error {
+	return dbConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("entry = ? AND debug_id = ?", entry, id).Delete(&Symbol{}).Error; err != nil {
+			logrus.Errorf("Delete records of symbol %s/%s failed with: %v", entry, id, err)
+			return err
+		}
+		deletion := SymbolDeletion{Entry: entry, DebugID: id, Size: size, Reason: reason}
+		if err := tx.Create(&deletion).Error; err != nil {
+			logrus.Errorf("Insert record to table 'symbol_deletions' failed with: %v", err)
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,151 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// 上传密钥的权限
+const (
+	UploadDump   = "dump"
+	UploadSymbol = "symbol"
+)
+
+// UploadKey 是上传端口的API密钥，数据库里只保存密钥的SHA-256。Programs是逗号分隔的程序名，
+// 包含AllPrograms时对所有程序生效。Prefix是密钥的开头几个字符，用于在列表里认出密钥
+type UploadKey struct {
+	ID        uint   `gorm:"primarykey"`
+	Name      string `gorm:"size:255"`
+	Prefix    string `gorm:"size:16"`
+	KeyHash   string `gorm:"size:64;uniqueIndex"`
+	Programs  string `gorm:"size:1024"`
+	Dump      bool
+	Symbol    bool
+	CreatedBy string `gorm:"size:255"`
+	CreatedAt time.Time
+	LastUsed  *time.Time
+	RevokedAt *time.Time
+	RevokedBy string `gorm:"size:255"`
+}
+
+// ProgramList 返回密钥可以上传的程序
+func (k *UploadKey) ProgramList() []string {
+	if k.Programs == "" {
+		return nil
+	}
+	return strings.Split(k.Programs, ",")
+}
+
+// Allows 判断密钥能否给程序上传permission类型的文件
+func (k *UploadKey) Allows(program string, permission string) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	switch permission {
+	case UploadDump:
+		if !k.Dump {
+			return false
+		}
+	case UploadSymbol:
+		if !k.Symbol {
+			return false
+		}
+	default:
+		return false
+	}
+	for _, p := range k.ProgramList() {
+		if p == AllPrograms || p == program {
+			return true
+		}
+	}
+	return false
+}
+
+func AddUploadKey(key *UploadKey) error {
+	if err := dbConn.Create(key).Error; err != nil {
+		logrus.Errorf("Add upload key '%s' failed with: %v", key.Name, err)
+		return err
+	}
+	return nil
+}
+
+// QueryUploadKey 按密钥哈希查找密钥，不存在时返回gorm.ErrRecordNotFound
+func QueryUploadKey(keyHash string) (*UploadKey, error) {
+	key := UploadKey{}
+	result := dbConn.Where("key_hash = ?", keyHash).Limit(1).Find(&key)
+	if result.Error != nil {
+		logrus.Errorf("Query upload key failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &key, nil
+}
+
+func QueryUploadKeys() ([]UploadKey, error) {
+	var keys []UploadKey
+	result := dbConn.Order("id").Find(&keys)
+	if result.Error != nil {
+		logrus.Errorf("Query upload keys failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	return keys, nil
+}
+
+// RevokeUploadKey 吊销密钥，密钥不存在或已经吊销时返回gorm.ErrRecordNotFound
+func RevokeUploadKey(id uint, by string, now time.Time) error {
+	result := dbConn.Model(&UploadKey{}).Where("id = ? AND revoked_at IS NULL", id).
+		Updates(map[string]any{"revoked_at": now, "revoked_by": by})
+	if result.Error != nil {
+		logrus.Errorf("Revoke upload key %d failed with: %v", id, result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// TouchUploadKey 记录密钥的使用时间，before之后已经记录过时不再写数据库
+func TouchUploadKey(id uint, now time.Time, before time.Time) error {
+	result := dbConn.Model(&UploadKey{}).Where("id = ? AND (last_used IS NULL OR last_used < ?)", id, before).
+		Update("last_used", now)
+	if result.Error != nil {
+		logrus.Errorf("Update last use of upload key %d failed with: %v", id, result.Error)
+	}
+	return result.Error
+}
@@ -0,0 +1,177 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UsageStat 是按天汇总的会话数，Day是<clock><timezone>时区下收到使用上报的日期
+type UsageStat struct {
+	ID       uint   `gorm:"primarykey"`
+	Day      string `gorm:"size:10;uniqueIndex:idx_usage_stat,priority:1"`
+	Program  string `gorm:"size:255;uniqueIndex:idx_usage_stat,priority:2"`
+	Version  string `gorm:"size:255;uniqueIndex:idx_usage_stat,priority:3"`
+	Sessions int64
+}
+
+// UsageInstall 记录每天使用过每个版本的安装，用于计算不同天数范围内的用户数。
+// InstallHash是服务器端对安装ID做过哈希的结果
+type UsageInstall struct {
+	ID          uint   `gorm:"primarykey"`
+	Day         string `gorm:"size:10;uniqueIndex:idx_usage_install,priority:1"`
+	Program     string `gorm:"size:255;uniqueIndex:idx_usage_install,priority:2"`
+	Version     string `gorm:"size:255;uniqueIndex:idx_usage_install,priority:3"`
+	InstallHash string `gorm:"size:64;uniqueIndex:idx_usage_install,priority:4"`
+}
+
+// CrashInstall 是每天每个版本崩溃过的安装，和CrashStat一起从dump重新汇总
+type CrashInstall struct {
+	ID          uint   `gorm:"primarykey"`
+	Day         string `gorm:"size:10;index:idx_crash_install,priority:1"`
+	Program     string `gorm:"size:255;index:idx_crash_install,priority:2"`
+	Version     string `gorm:"size:255;index:idx_crash_install,priority:3"`
+	InstallHash string `gorm:"size:64"`
+}
+
+// ReleaseHealth 是一个版本在一段时间内的使用和崩溃情况
+type ReleaseHealth struct {
+	Program      string
+	Version      string
+	Sessions     int64
+	Users        int64
+	Crashes      int64
+	CrashedUsers int64
+}
+
+// AddUsage 累加一次使用上报，installHash为空时只累加会话数
+func AddUsage(day string, program string, version string, installHash string, sessions int64) error {
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		stat := UsageStat{Day: day, Program: program, Version: version, Sessions: sessions}
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "day"}, {Name: "program"}, {Name: "version"}},
+			DoUpdates: clause.Assignments(map[string]any{"sessions": gorm.Expr("usage_stats.sessions + ?", sessions)}),
+		}).Create(&stat).Error
+		if err != nil || installHash == "" {
+			return err
+		}
+		install := UsageInstall{Day: day, Program: program, Version: version, InstallHash: installHash}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&install).Error
+	})
+	if err != nil {
+		logrus.Errorf("Add usage of %s %s failed with: %v", program, version, err)
+	}
+	return err
+}
+
+// DeleteUsageInstalls 删除before之前的每日安装记录，返回删除的数量
+func DeleteUsageInstalls(before string) (int64, error) {
+	result := dbConn.Where("day < ?", before).Delete(&UsageInstall{})
+	if result.Error != nil {
+		logrus.Errorf("Delete usage installs before %s failed with: %v", before, result.Error)
+	}
+	return result.RowsAffected, result.Error
+}
+
+// rebuildDayInstalls 用崩溃时间在[start, end)之间的dump重新汇总day这一天崩溃过的安装
+func rebuildDayInstalls(tx *gorm.DB, day string, start time.Time, end time.Time) error {
+	if err := tx.Where("day = ?", day).Delete(&CrashInstall{}).Error; err != nil {
+		return err
+	}
+	return tx.Exec("INSERT INTO crash_installs (day, program, version, install_hash) "+
+		"SELECT DISTINCT ?, program, version, install_hash FROM dumps "+
+		"WHERE crash_time >= ? AND crash_time < ? AND install_hash <> ''",
+		day, start, end).Error
+}
+
+// releaseCount 是按版本汇总查询的一行
+type releaseCount struct {
+	Program string
+	Version string
+	Count   int64 `gorm:"column:total"`
+}
+
+func (f *StatFilter) applyTo(tx *gorm.DB, model any) *gorm.DB {
+	tx = tx.Model(model)
+	if f.Program != "" {
+		tx = tx.Where("program = ?", f.Program)
+	}
+	if f.Version != "" {
+		tx = tx.Where("version = ?", f.Version)
+	}
+	if f.From != "" {
+		tx = tx.Where("day >= ?", f.From)
+	}
+	if f.To != "" {
+		tx = tx.Where("day <= ?", f.To)
+	}
+	return tx
+}
+
+// QueryReleaseHealth 返回每个有使用上报或崩溃的版本在filter范围内的会话数、用户数、崩溃数和崩溃过的用户数
+func QueryReleaseHealth(filter StatFilter) ([]ReleaseHealth, error) {
+	queries := []struct {
+		model  any
+		expr   string
+		target func(h *ReleaseHealth) *int64
+	}{
+		{&UsageStat{}, "SUM(sessions)", func(h *ReleaseHealth) *int64 { return &h.Sessions }},
+		{&UsageInstall{}, "COUNT(DISTINCT install_hash)", func(h *ReleaseHealth) *int64 { return &h.Users }},
+		{&CrashStat{}, "SUM(count)", func(h *ReleaseHealth) *int64 { return &h.Crashes }},
+		{&CrashInstall{}, "COUNT(DISTINCT install_hash)", func(h *ReleaseHealth) *int64 { return &h.CrashedUsers }},
+	}
+	index := map[[2]string]int{}
+	var releases []ReleaseHealth
+	for _, q := range queries {
+		var counts []releaseCount
+		result := filter.applyTo(dbConn, q.model).Select("program, version, " + q.expr + " AS total").
+			Group("program, version").Find(&counts)
+		if result.Error != nil {
+			logrus.Errorf("Query release health failed with: %v", result.Error)
+			return nil, result.Error
+		}
+		for _, c := range counts {
+			key := [2]string{c.Program, c.Version}
+			i, ok := index[key]
+			if !ok {
+				i = len(releases)
+				index[key] = i
+				releases = append(releases, ReleaseHealth{Program: c.Program, Version: c.Version})
+			}
+			*q.target(&releases[i]) = c.Count
+		}
+	}
+	return releases, nil
+}
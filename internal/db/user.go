@@ -0,0 +1,232 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// User 是查看服务器的本地账号，PasswordHash是bcrypt哈希
+type User struct {
+	ID           uint   `gorm:"primarykey"`
+	Username     string `gorm:"size:255;uniqueIndex"`
+	PasswordHash string `gorm:"size:255"`
+	Disabled     bool
+	LastLogin    *time.Time
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// Session 是一次登录，数据库里只保存cookie里令牌的SHA-256
+type Session struct {
+	ID        uint      `gorm:"primarykey"`
+	TokenHash string    `gorm:"size:64;uniqueIndex"`
+	UserID    uint      `gorm:"index"`
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+// 角色从低到高，高的角色包含低的角色的所有权限：viewer可以查看，triager还可以处理分组，
+// admin还可以删除dump和符号、管理账号
+const (
+	RoleViewer  = "viewer"
+	RoleTriager = "triager"
+	RoleAdmin   = "admin"
+)
+
+// Roles 是所有角色，从低到高
+var Roles = []string{RoleViewer, RoleTriager, RoleAdmin}
+
+// AllPrograms 是对所有程序生效的授权的Program
+const AllPrograms = "*"
+
+// RoleLevel 返回角色的级别，不是可用的角色时返回0
+func RoleLevel(role string) int {
+	for i, r := range Roles {
+		if r == role {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Grant 给账号在一个程序上的角色，Program为AllPrograms时对所有程序生效
+type Grant struct {
+	ID      uint   `gorm:"primarykey"`
+	UserID  uint   `gorm:"uniqueIndex:idx_grant_user_program"`
+	Program string `gorm:"size:255;uniqueIndex:idx_grant_user_program"`
+	Role    string `gorm:"size:16"`
+}
+
+// QueryUser 按用户名查找账号，不存在时返回gorm.ErrRecordNotFound。
+// 登录失败很常见，不用First，避免gorm为每次失败打印日志
+func QueryUser(username string) (*User, error) {
+	user := User{}
+	result := dbConn.Where("username = ?", username).Limit(1).Find(&user)
+	if result.Error != nil {
+		logrus.Errorf("Query user '%s' failed with: %v", username, result.Error)
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &user, nil
+}
+
+func QueryUsers() ([]User, error) {
+	var users []User
+	result := dbConn.Order("username").Find(&users)
+	if result.Error != nil {
+		logrus.Errorf("Query users failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	return users, nil
+}
+
+// SaveUser 创建或修改账号。修改了密码或禁用了账号时删除账号的所有会话
+func SaveUser(user *User, logout bool) error {
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(user).Error; err != nil {
+			return err
+		}
+		if logout {
+			return tx.Where("user_id = ?", user.ID).Delete(&Session{}).Error
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("Save user '%s' failed with: %v", user.Username, err)
+	}
+	return err
+}
+
+// AddSession 保存新的会话，并记录账号的登录时间
+func AddSession(session *Session) error {
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(session).Error; err != nil {
+			return err
+		}
+		return tx.Model(&User{}).Where("id = ?", session.UserID).Update("last_login", session.CreatedAt).Error
+	})
+	if err != nil {
+		logrus.Errorf("Add session of user %d failed with: %v", session.UserID, err)
+	}
+	return err
+}
+
+// QuerySession 返回令牌哈希对应的未过期会话和它的账号，账号被禁用时当作会话不存在
+func QuerySession(tokenHash string, now time.Time) (*Session, *User, error) {
+	session := Session{}
+	result := dbConn.Where("token_hash = ? AND expires_at > ?", tokenHash, now).Limit(1).Find(&session)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return nil, nil, gorm.ErrRecordNotFound
+	}
+	if result.Error != nil {
+		logrus.Errorf("Query session failed with: %v", result.Error)
+		return nil, nil, result.Error
+	}
+	user := User{}
+	result = dbConn.Where("id = ? AND disabled = ?", session.UserID, false).Limit(1).Find(&user)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return nil, nil, gorm.ErrRecordNotFound
+	}
+	if result.Error != nil {
+		logrus.Errorf("Query user of session failed with: %v", result.Error)
+		return nil, nil, result.Error
+	}
+	return &session, &user, nil
+}
+
+func DeleteSession(tokenHash string) error {
+	result := dbConn.Where("token_hash = ?", tokenHash).Delete(&Session{})
+	if result.Error != nil {
+		logrus.Errorf("Delete session failed with: %v", result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+// QueryGrants 返回账号的所有授权
+func QueryGrants(userID uint) ([]Grant, error) {
+	var grants []Grant
+	result := dbConn.Where("user_id = ?", userID).Order("program").Find(&grants)
+	if result.Error != nil {
+		logrus.Errorf("Query grants of user %d failed with: %v", userID, result.Error)
+		return nil, result.Error
+	}
+	return grants, nil
+}
+
+// QueryAllGrants 返回所有账号的授权，按账号分组
+func QueryAllGrants() (map[uint][]Grant, error) {
+	var grants []Grant
+	result := dbConn.Order("program").Find(&grants)
+	if result.Error != nil {
+		logrus.Errorf("Query grants failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	byUser := make(map[uint][]Grant)
+	for _, g := range grants {
+		byUser[g.UserID] = append(byUser[g.UserID], g)
+	}
+	return byUser, nil
+}
+
+// SetGrant 设置账号在程序上的角色，role为空时删除授权
+func SetGrant(userID uint, program string, role string) error {
+	var err error
+	if role == "" {
+		err = dbConn.Where("user_id = ? AND program = ?", userID, program).Delete(&Grant{}).Error
+	} else {
+		err = dbConn.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "program"}},
+			DoUpdates: clause.AssignmentColumns([]string{"role"}),
+		}).Create(&Grant{UserID: userID, Program: program, Role: role}).Error
+	}
+	if err != nil {
+		logrus.Errorf("Set grant of user %d on '%s' failed with: %v", userID, program, err)
+	}
+	return err
+}
+
+// DeleteExpiredSessions 删除过期的会话，返回删除的数量
+func DeleteExpiredSessions(now time.Time) (int64, error) {
+	result := dbConn.Where("expires_at <= ?", now).Delete(&Session{})
+	if result.Error != nil {
+		logrus.Errorf("Delete expired sessions failed with: %v", result.Error)
+		return 0, result.Error
+	}
+	return result.RowsAffected, nil
+}
@@ -0,0 +1,163 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery 是一个事件发给一个webhook的记录，Payload是发送的JSON。
+// 重放时生成新的记录，ReplayOf是被重放的记录
+type WebhookDelivery struct {
+	ID          uint   `gorm:"primarykey"`
+	Webhook     string `gorm:"size:255;index"`
+	Event       string `gorm:"size:64"`
+	Payload     string
+	Status      string `gorm:"size:16;index:idx_delivery_status_next,priority:1"`
+	Attempts    int
+	NextAttempt time.Time `gorm:"index:idx_delivery_status_next,priority:2"`
+	ReplayOf    uint
+	CreatedAt   time.Time
+	DeliveredAt *time.Time
+}
+
+// WebhookAttempt 是一次发送尝试，StatusCode为0表示没有收到响应
+type WebhookAttempt struct {
+	ID         uint `gorm:"primarykey"`
+	DeliveryID uint `gorm:"index"`
+	StatusCode int
+	Response   string
+	Error      string
+	Duration   int64
+	CreatedAt  time.Time
+}
+
+func AddDelivery(delivery *WebhookDelivery) error {
+	delivery.Status = DeliveryPending
+	if delivery.NextAttempt.IsZero() {
+		delivery.NextAttempt = time.Now()
+	}
+	if err := dbConn.Create(delivery).Error; err != nil {
+		logrus.Errorf("Insert webhook delivery of '%s' failed with: %v", delivery.Webhook, err)
+		return err
+	}
+	return nil
+}
+
+// QueryDueWebhooks 返回有到了发送时间还没有完成的记录的webhook
+func QueryDueWebhooks(now time.Time) ([]string, error) {
+	var names []string
+	result := dbConn.Model(&WebhookDelivery{}).Where("status = ? AND next_attempt <= ?", DeliveryPending, now).
+		Distinct("webhook").Order("webhook").Pluck("webhook", &names)
+	if result.Error != nil {
+		logrus.Errorf("Query due webhooks failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	return names, nil
+}
+
+// QueryDueDeliveries 返回webhook到了发送时间还没有完成的记录
+func QueryDueDeliveries(webhook string, now time.Time, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	result := dbConn.Where("webhook = ? AND status = ? AND next_attempt <= ?", webhook, DeliveryPending, now).
+		Order("next_attempt").Limit(limit).Find(&deliveries)
+	if result.Error != nil {
+		logrus.Errorf("Query due webhook deliveries failed with: %v", result.Error)
+		return nil, result.Error
+	}
+	return deliveries, nil
+}
+
+// SaveAttempt 记录一次发送尝试并更新发送记录的状态
+func SaveAttempt(delivery *WebhookDelivery, attempt *WebhookAttempt) error {
+	attempt.DeliveryID = delivery.ID
+	err := dbConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(attempt).Error; err != nil {
+			return err
+		}
+		return tx.Model(delivery).Updates(map[string]any{
+			"status":       delivery.Status,
+			"attempts":     delivery.Attempts,
+			"next_attempt": delivery.NextAttempt,
+			"delivered_at": delivery.DeliveredAt,
+		}).Error
+	})
+	if err != nil {
+		logrus.Errorf("Save attempt of webhook delivery %d failed with: %v", delivery.ID, err)
+	}
+	return err
+}
+
+// QueryDeliveryList 按时间倒序返回发送记录，webhook为空时返回所有webhook的记录
+func QueryDeliveryList(page int, webhook string) ([]WebhookDelivery, error) {
+	const kLimit int = 50
+	index := kLimit * page
+	if index < 0 {
+		index = 0
+	}
+	tx := dbConn.Order("id desc").Limit(kLimit).Offset(index)
+	if webhook != "" {
+		tx = tx.Where("webhook = ?", webhook)
+	}
+	var deliveries []WebhookDelivery
+	if err := tx.Find(&deliveries).Error; err != nil {
+		logrus.Errorf("Query webhook delivery list failed with: %v", err)
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func QueryDelivery(id uint) (*WebhookDelivery, error) {
+	delivery := WebhookDelivery{}
+	if err := dbConn.First(&delivery, id).Error; err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// QueryAttempts 按时间顺序返回发送记录的所有尝试
+func QueryAttempts(deliveryID uint) ([]WebhookAttempt, error) {
+	var attempts []WebhookAttempt
+	if err := dbConn.Where("delivery_id = ?", deliveryID).Order("id").Find(&attempts).Error; err != nil {
+		logrus.Errorf("Query attempts of webhook delivery %d failed with: %v", deliveryID, err)
+		return nil, err
+	}
+	return attempts, nil
+}
@@ -0,0 +1,253 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package dumps
+
+import (
+	"bp-server/internal/compress"
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/storage"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+var method string
+
+// Init 读取dump文件的压缩配置
+func Init() {
+	if conf.Xml.DumpStore.Compress == "" {
+		method = compress.Zstd
+		return
+	}
+	m, err := compress.Normalize(conf.Xml.DumpStore.Compress)
+	if err != nil {
+		panic(fmt.Sprintf("config file 'dump_store/compress': %v", err))
+	}
+	method = m
+}
+
+// Key 返回dump在存储中的key。dump按内容的sha256保存在 sha256/xx/yy/<hash>.dmp，
+// 旧版本保存的dump仍在 <program>/<version>/<filename>。压缩存储的dump带有压缩方式的扩展名
+func Key(dump *db.Dump) string {
+	if dump.Hash != "" {
+		return hashKey(dump.Hash) + compress.Ext(dump.Compress)
+	}
+	return storage.Key(dump.Program, dump.Version, dump.Filename+compress.Ext(dump.Compress))
+}
+
+func hashKey(hash string) string {
+	return storage.Key("sha256", hash[:2], hash[2:4], hash+".dmp")
+}
+
+// Save 按配置的压缩方式保存dump，保存的同时计算内容的sha256，只读一遍数据。
+// 先写到临时的key，算出哈希后再移到按内容寻址的key。返回哈希、压缩方式和存储的字节数
+func Save(r io.Reader) (string, string, int64, error) {
+	ctx := context.Background()
+	name := make([]byte, 16)
+	if _, err := rand.Read(name); err != nil {
+		return "", "", 0, err
+	}
+	// 以.开头，本地存储遍历时会跳过
+	tmpKey := storage.Key(".incoming", hex.EncodeToString(name)+".dmp"+compress.Ext(method))
+	h := sha256.New()
+	reader := compress.Compressed(method, io.TeeReader(r, h))
+	defer reader.Close()
+	size, err := storage.Dumps.Put(ctx, tmpKey, reader)
+	if err != nil {
+		storage.Dumps.Delete(ctx, tmpKey)
+		return "", "", 0, err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	if err := storage.Dumps.Move(ctx, tmpKey, hashKey(hash)+compress.Ext(method)); err != nil {
+		storage.Dumps.Delete(ctx, tmpKey)
+		return "", "", 0, err
+	}
+	return hash, method, size, nil
+}
+
+// Discard 删除Save保存的内容，用于上传的dump和已有的dump重复、但已有的dump用了别的压缩方式的情况
+func Discard(hash, method string) error {
+	return storage.Dumps.Delete(context.Background(), hashKey(hash)+compress.Ext(method))
+}
+
+// OpenRaw 返回存储中原样的dump数据和它的大小
+func OpenRaw(dump *db.Dump) (io.ReadCloser, int64, error) {
+	ctx := context.Background()
+	info, err := storage.Dumps.Stat(ctx, Key(dump))
+	if err != nil {
+		return nil, 0, err
+	}
+	reader, err := storage.Dumps.Get(ctx, Key(dump))
+	if err != nil {
+		return nil, 0, err
+	}
+	return reader, info.Size, nil
+}
+
+// Open 返回解压后的dump内容
+func Open(dump *db.Dump) (io.ReadCloser, error) {
+	object, err := storage.Dumps.Get(context.Background(), Key(dump))
+	if err != nil {
+		return nil, err
+	}
+	reader, err := compress.NewReader(compress.Normalized(dump.Compress), object)
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: reader, closers: []io.Closer{reader, object}}, nil
+}
+
+// Materialize 返回一个可以交给minidump_stackwalk的未压缩dump文件路径。
+// 本地存储的未压缩dump直接返回原文件，其它情况下载并解压到临时文件，用完后必须调用返回的cleanup
+func Materialize(dump *db.Dump) (string, func(), error) {
+	if local, ok := storage.Dumps.(storage.LocalPather); ok && compress.Normalized(dump.Compress) == compress.None {
+		return local.LocalPath(Key(dump)), func() {}, nil
+	}
+	reader, err := Open(dump)
+	if err != nil {
+		return "", nil, err
+	}
+	defer reader.Close()
+	tmp, err := os.CreateTemp("", "bp-server-*.dmp")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		os.Remove(tmp.Name())
+	}
+	_, err = io.Copy(tmp, reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return tmp.Name(), cleanup, nil
+}
+
+// Size 返回dump在存储中的大小
+func Size(dump *db.Dump) (int64, error) {
+	info, err := storage.Dumps.Stat(context.Background(), Key(dump))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// Remove 删除dump文件，文件不存在不算错误。还有其它dump记录引用同一内容时不删除
+func Remove(dump *db.Dump) error {
+	if dump.Hash != "" {
+		shared, err := db.HasOtherDumpWithHash(dump.Hash, dump.ID)
+		if err != nil {
+			return err
+		}
+		if shared {
+			return nil
+		}
+	}
+	return storage.Dumps.Delete(context.Background(), Key(dump))
+}
+
+// ConvertStore 把已有的dump转换成当前配置的压缩方式并按内容寻址保存，返回转换的dump数
+func ConvertStore() (int, error) {
+	converted := 0
+	var lastID uint
+	for {
+		list, err := db.QueryDumpsToConvert(method, lastID, 100)
+		if err != nil {
+			return converted, err
+		}
+		if len(list) == 0 {
+			return converted, nil
+		}
+		for i := range list {
+			dump := &list[i]
+			lastID = dump.ID
+			if err := convert(dump); err != nil {
+				logrus.Errorf("Convert dump %d '%s' failed: %v", dump.ID, Key(dump), err)
+				continue
+			}
+			converted++
+		}
+	}
+}
+
+func convert(dump *db.Dump) error {
+	path, cleanup, err := Materialize(dump)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	oldKey := Key(dump)
+	hash, m, size, err := Save(file)
+	if err != nil {
+		return err
+	}
+	if err := db.UpdateDumpStorage(dump, m, size, hash); err != nil {
+		return err
+	}
+	if newKey := hashKey(hash) + compress.Ext(m); newKey != oldKey {
+		if err := storage.Dumps.Delete(context.Background(), oldKey); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Converted dump %d '%s' to %s, %d -> %d bytes", dump.ID, oldKey, m, dump.Size, size)
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *readCloser) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if e := c.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
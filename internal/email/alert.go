@@ -0,0 +1,125 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package email
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/event"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Start 订阅需要立即提醒的事件，并在配置了摘要时每天发送摘要
+func Start() {
+	if !Enabled() {
+		return
+	}
+	event.Subscribe(alert)
+	startDigest()
+}
+
+func contains[T comparable](list []T, item T) bool {
+	for _, v := range list {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsAlert 判断收件人是否需要收到事件的提醒：事件属于配置了提醒并且收件人订阅了的程序，
+// 或者属于收件人订阅的分组
+func wantsAlert(r *conf.RecipientConf, ev event.Event) bool {
+	if !r.Alerts {
+		return false
+	}
+	if ev.GroupID != 0 && contains(r.Groups, ev.GroupID) {
+		return true
+	}
+	if !contains(conf.Xml.Email.Alerts.Programs, ev.Program) {
+		return false
+	}
+	return len(r.Programs) == 0 || contains(r.Programs, ev.Program)
+}
+
+// alertBody 返回事件提醒邮件的正文
+func alertBody(ev event.Event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\n", ev.Message)
+	fmt.Fprintf(&b, "Event:     %s\n", ev.Type)
+	fmt.Fprintf(&b, "Program:   %s\n", ev.Program)
+	if ev.Version != "" {
+		fmt.Fprintf(&b, "Version:   %s\n", ev.Version)
+	}
+	if ev.GroupID != 0 {
+		fmt.Fprintf(&b, "Group:     %d\n", ev.GroupID)
+	}
+	if ev.Signature != "" {
+		fmt.Fprintf(&b, "Signature: %s\n", ev.Signature)
+	}
+	if ev.DumpID != 0 {
+		fmt.Fprintf(&b, "Dump:      %d\n", ev.DumpID)
+	}
+	fmt.Fprintf(&b, "Time:      %s\n", ev.Time.Format("2006-01-02 15:04:05 MST"))
+	if ev.URL != "" {
+		fmt.Fprintf(&b, "\n%s\n", ev.URL)
+	}
+	return b.String()
+}
+
+// alert 把事件立即发给订阅了的收件人，发送在后台进行
+func alert(ev event.Event) {
+	alerts := conf.Xml.Email.Alerts
+	if len(alerts.Events) > 0 && !contains(alerts.Events, ev.Type) {
+		return
+	}
+	var to []string
+	for i := range conf.Xml.Email.Recipients {
+		r := &conf.Xml.Email.Recipients[i]
+		if wantsAlert(r, ev) {
+			to = append(to, r.Address)
+		}
+	}
+	if len(to) == 0 {
+		return
+	}
+	subject := "[bp-server] " + ev.Message
+	body := alertBody(ev)
+	go func() {
+		if err := Send(to, subject, body); err != nil {
+			logrus.Errorf("Send %s alert to %v failed: %v", ev.Type, to, err)
+			return
+		}
+		logrus.Infof("Sent %s alert to %v", ev.Type, to)
+	}()
+}
@@ -0,0 +1,277 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package email
+
+import (
+	"bp-server/internal/clock"
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/event"
+	"bp-server/internal/job"
+	"bp-server/internal/stats"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDigestLimit = 10
+	digestCursor       = "email digest"
+	// baselineDays 是计算分组平均每天崩溃数的天数
+	baselineDays = 7
+	// growthFactor 是分组被认为在增长时，当天崩溃数至少是平均数的倍数
+	growthFactor = 2
+)
+
+const digestTemplate = `Crash digest for {{ .Day }}
+{{ if .NewGroups }}
+New crash groups
+{{- range .NewGroups }}
+  #{{ .ID }} {{ .Program }}: {{ .Count }} crashes on {{ .Installs }} installations
+    {{ .Signature }}
+    {{- with groupURL .ID }}
+    {{ . }}
+    {{- end }}
+{{- end }}
+{{ else }}
+No new crash groups.
+{{ end }}
+{{- if .Growing }}
+Growing crash groups
+{{- range .Growing }}
+  #{{ .Group.ID }} {{ .Group.Program }}: {{ .Count }} crashes, {{ printf "%.1f" .Baseline }} per day before ({{ .Group.Status }})
+    {{ .Group.Signature }}
+    {{- with groupURL .Group.ID }}
+    {{ . }}
+    {{- end }}
+{{- end }}
+{{ end }}
+{{- if .Missing }}
+Releases with missing symbols
+{{- range .Missing }}
+  {{ .Program }} {{ .Version }}: {{ .DebugFile }} ({{ .Dumps }} dumps)
+{{- end }}
+{{ end }}
+{{- if .Subscribed }}
+Your crash groups
+{{- range .Subscribed }}
+  #{{ .Group.ID }} {{ .Group.Program }}: {{ .Count }} crashes, {{ .Group.Status }}
+    {{ .Group.Signature }}
+    {{- with groupURL .Group.ID }}
+    {{ . }}
+    {{- end }}
+{{- end }}
+{{ end -}}
+`
+
+var digestTpl = template.Must(template.New("digest").Funcs(template.FuncMap{"groupURL": event.GroupURL}).Parse(digestTemplate))
+
+// Digest 是一天的摘要
+type Digest struct {
+	Day        string
+	NewGroups  []db.CrashGroup
+	Growing    []db.GroupGrowth
+	Missing    []db.MissingSymbol
+	Subscribed []db.GroupGrowth
+}
+
+func startDigest() {
+	if !conf.Xml.Email.Digest.Enable {
+		return
+	}
+	job.Every("email digest", time.Minute, func() {
+		now := time.Now().In(clock.Location(""))
+		if now.Hour() < conf.Xml.Email.Digest.Hour {
+			return
+		}
+		last, err := db.QueryStatCursor(digestCursor)
+		if err != nil || (!last.IsZero() && stats.Day(last) == stats.Day(now)) {
+			return
+		}
+		// 发送失败时不重试，避免每分钟重复发送
+		if err := db.SaveStatCursor(digestCursor, now); err != nil {
+			return
+		}
+		if _, err := SendDigest(stats.Day(now.AddDate(0, 0, -1)), nil, nil); err != nil {
+			logrus.Errorf("Send email digest failed: %v", err)
+		}
+	})
+}
+
+func digestLimit() int {
+	if conf.Xml.Email.Digest.Limit <= 0 {
+		return defaultDigestLimit
+	}
+	return conf.Xml.Email.Digest.Limit
+}
+
+// growingGroups 返回day这一天崩溃数超过之前平均数growthFactor倍的分组，按增加的数量倒序
+func growingGroups(day string, start time.Time, programs []string, limit int) ([]db.GroupGrowth, error) {
+	current, err := db.QueryGroupDayCounts(day, day, programs, nil)
+	if err != nil {
+		return nil, err
+	}
+	before, err := db.QueryGroupDayCounts(stats.Day(start.AddDate(0, 0, -baselineDays)), stats.Day(start.AddDate(0, 0, -1)), programs, nil)
+	if err != nil {
+		return nil, err
+	}
+	var growing []db.GroupGrowth
+	for id, count := range current {
+		baseline := float64(before[id]) / baselineDays
+		// 之前没有崩溃过的分组是新分组，单独列出
+		if before[id] == 0 || float64(count) < baseline*growthFactor {
+			continue
+		}
+		growing = append(growing, groupGrowth(id, count, baseline))
+	}
+	sort.Slice(growing, func(i, j int) bool {
+		return float64(growing[i].Count)-growing[i].Baseline > float64(growing[j].Count)-growing[j].Baseline
+	})
+	if len(growing) > limit {
+		growing = growing[:limit]
+	}
+	return fillGroups(growing)
+}
+
+func groupGrowth(id uint, count int64, baseline float64) db.GroupGrowth {
+	growth := db.GroupGrowth{Count: count, Baseline: baseline}
+	growth.Group.ID = id
+	return growth
+}
+
+// fillGroups 查询分组的详细信息，已经不存在的分组被去掉
+func fillGroups(counts []db.GroupGrowth) ([]db.GroupGrowth, error) {
+	ids := make([]uint, 0, len(counts))
+	for _, c := range counts {
+		ids = append(ids, c.Group.ID)
+	}
+	groups, err := db.QueryGroups(ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]db.CrashGroup, len(groups))
+	for _, g := range groups {
+		byID[g.ID] = g
+	}
+	result := make([]db.GroupGrowth, 0, len(counts))
+	for _, c := range counts {
+		if g, ok := byID[c.Group.ID]; ok {
+			c.Group = g
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+// BuildDigest 生成day这一天的摘要，programs为空时包含所有程序，groups是另外列出的订阅的分组
+func BuildDigest(day string, programs []string, groups []uint) (*Digest, error) {
+	start, end, err := stats.DayRange(day)
+	if err != nil {
+		return nil, err
+	}
+	digest := &Digest{Day: day}
+	limit := digestLimit()
+	if digest.NewGroups, err = db.QueryNewGroups(start, end, programs, limit); err != nil {
+		return nil, err
+	}
+	if digest.Growing, err = growingGroups(day, start, programs, limit); err != nil {
+		return nil, err
+	}
+	if digest.Missing, err = db.QueryMissingSymbols(start, end, programs); err != nil {
+		return nil, err
+	}
+	if len(groups) > 0 {
+		counts, err := db.QueryGroupDayCounts(day, day, nil, groups)
+		if err != nil {
+			return nil, err
+		}
+		subscribed := make([]db.GroupGrowth, 0, len(groups))
+		for _, id := range groups {
+			subscribed = append(subscribed, groupGrowth(id, counts[id], 0))
+		}
+		if digest.Subscribed, err = fillGroups(subscribed); err != nil {
+			return nil, err
+		}
+	}
+	return digest, nil
+}
+
+// Render 返回摘要邮件的正文
+func (d *Digest) Render() (string, error) {
+	var buf bytes.Buffer
+	if err := digestTpl.Execute(&buf, d); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// SendDigest 把day这一天的摘要发给订阅了摘要的收件人，to不为空时只发给to并包含所有程序。
+// dryRun不为空时把邮件写到dryRun而不发送。返回收到摘要的收件人
+func SendDigest(day string, to []string, dryRun io.Writer) ([]string, error) {
+	recipients := conf.Xml.Email.Recipients
+	if len(to) > 0 {
+		recipients = make([]conf.RecipientConf, 0, len(to))
+		for _, addr := range to {
+			recipients = append(recipients, conf.RecipientConf{Address: addr, Digest: true})
+		}
+	}
+	subject := fmt.Sprintf("[bp-server] Crash digest for %s", day)
+	var sent []string
+	for _, r := range recipients {
+		if !r.Digest {
+			continue
+		}
+		digest, err := BuildDigest(day, r.Programs, r.Groups)
+		if err != nil {
+			return sent, err
+		}
+		body, err := digest.Render()
+		if err != nil {
+			return sent, err
+		}
+		if dryRun != nil {
+			dryRun.Write(Message(r.Address, subject, body))
+			fmt.Fprintln(dryRun)
+		} else if err := Send([]string{r.Address}, subject, body); err != nil {
+			return sent, fmt.Errorf("send digest to %s: %w", r.Address, err)
+		}
+		sent = append(sent, r.Address)
+	}
+	if dryRun == nil && len(sent) > 0 {
+		logrus.Infof("Sent email digest of %s to %v", day, sent)
+	}
+	return sent, nil
+}
@@ -0,0 +1,160 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package email
+
+import (
+	"bp-server/internal/conf"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPort = 25
+
+var (
+	dialTimeout = 10 * time.Second
+	// messageTimeout 是每封邮件给整个SMTP会话增加的时间，服务器不响应时会话在超时后失败
+	messageTimeout = 30 * time.Second
+)
+
+// Enabled 判断是否配置了SMTP服务器
+func Enabled() bool {
+	return conf.Xml.Email.Host != ""
+}
+
+// Message 返回发给一个收件人的纯文本邮件的完整内容
+func Message(to string, subject string, body string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", conf.Xml.Email.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// dial 连接SMTP服务器，连接在deadline之后的读写都会失败
+func dial(deadline time.Time) (*smtp.Client, error) {
+	cfg := conf.Xml.Email
+	port := cfg.Port
+	if port <= 0 {
+		port = defaultPort
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if cfg.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: cfg.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok && !cfg.TLS {
+		if err := client.StartTLS(&tls.Config{ServerName: cfg.Host}); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	if cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// Send 通过<email>配置的SMTP服务器给每个收件人单独发送一封纯文本邮件，收件人看不到其他收件人。
+// 给一个收件人发送失败时仍然发给其他收件人，返回第一个错误
+func Send(to []string, subject string, body string) error {
+	if !Enabled() {
+		return fmt.Errorf("email is not configured")
+	}
+	client, err := dial(time.Now().Add(dialTimeout + time.Duration(len(to))*messageTimeout))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	var firstErr error
+	for _, addr := range to {
+		if err := send(client, addr, subject, body); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("send to %s: %w", addr, err)
+			}
+			// 连接已经不能用了
+			if client.Reset() != nil {
+				return firstErr
+			}
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return client.Quit()
+}
+
+func send(client *smtp.Client, to string, subject string, body string) error {
+	if err := client.Mail(conf.Xml.Email.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(Message(to, subject, body)); err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,231 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package email
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/conf/conftest"
+	"bp-server/internal/db"
+	"bufio"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	conftest.Load()
+	db.Init()
+	os.Exit(m.Run())
+}
+
+// fakeSMTP 是测试用的SMTP服务器，只支持不加密、不认证的会话，拒绝以reject开头的收件人
+type fakeSMTP struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	messages []fakeMessage
+	// silent 为true时接受连接后不再响应
+	silent bool
+}
+
+type fakeMessage struct {
+	rcpt []string
+	data string
+}
+
+func newFakeSMTP(t *testing.T, silent bool) *fakeSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSMTP{listener: listener, silent: silent}
+	go f.serve()
+	t.Cleanup(func() { listener.Close() })
+	old := conf.Xml.Email
+	t.Cleanup(func() { conf.Xml.Email = old })
+	conf.Xml.Email.Host = "127.0.0.1"
+	conf.Xml.Email.Port = listener.Addr().(*net.TCPAddr).Port
+	conf.Xml.Email.Username = ""
+	conf.Xml.Email.TLS = false
+	conf.Xml.Email.From = "bp-server@example.com"
+	return f
+}
+
+func (f *fakeSMTP) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.session(conn)
+	}
+}
+
+func (f *fakeSMTP) session(conn net.Conn) {
+	defer conn.Close()
+	if f.silent {
+		// 读到客户端断开为止
+		bufio.NewReader(conn).ReadString(0)
+		return
+	}
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake ESMTP")
+	var rcpt []string
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250 fake")
+		case "MAIL":
+			rcpt = nil
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			addr := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if strings.HasPrefix(addr, "reject") {
+				text.PrintfLine("550 no such user")
+				continue
+			}
+			rcpt = append(rcpt, addr)
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			f.mutex.Lock()
+			f.messages = append(f.messages, fakeMessage{rcpt: rcpt, data: string(data)})
+			f.mutex.Unlock()
+			text.PrintfLine("250 OK")
+		case "RSET":
+			rcpt = nil
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (f *fakeSMTP) received() []fakeMessage {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]fakeMessage(nil), f.messages...)
+}
+
+func header(data string, name string) string {
+	for _, line := range strings.Split(data, "\n") {
+		if value, ok := strings.CutPrefix(line, name+": "); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func TestSendOneMessagePerRecipient(t *testing.T) {
+	fake := newFakeSMTP(t, false)
+	to := []string{"alice@example.com", "bob@example.com"}
+	if err := Send(to, "Crash", "line 1\nline 2"); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	messages := fake.received()
+	if len(messages) != len(to) {
+		t.Fatalf("got %d messages, want %d", len(messages), len(to))
+	}
+	for i, m := range messages {
+		if len(m.rcpt) != 1 || m.rcpt[0] != to[i] {
+			t.Errorf("message %d sent to %v, want %s", i, m.rcpt, to[i])
+		}
+		if got := header(m.data, "To"); got != to[i] {
+			t.Errorf("message %d has To '%s', want '%s'", i, got, to[i])
+		}
+		if !strings.Contains(m.data, "line 1\nline 2") {
+			t.Errorf("message %d lost the body: %q", i, m.data)
+		}
+	}
+}
+
+func TestSendRejectedRecipient(t *testing.T) {
+	fake := newFakeSMTP(t, false)
+	err := Send([]string{"reject@example.com", "carol@example.com"}, "Crash", "body")
+	if err == nil || !strings.Contains(err.Error(), "reject@example.com") {
+		t.Fatalf("Send returned %v, want an error for the rejected recipient", err)
+	}
+	messages := fake.received()
+	if len(messages) != 1 || messages[0].rcpt[0] != "carol@example.com" {
+		t.Fatalf("other recipients not served after a rejection: %+v", messages)
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	newFakeSMTP(t, true)
+	oldDial, oldMessage := dialTimeout, messageTimeout
+	dialTimeout, messageTimeout = 100*time.Millisecond, 100*time.Millisecond
+	defer func() { dialTimeout, messageTimeout = oldDial, oldMessage }()
+	start := time.Now()
+	if err := Send([]string{"dave@example.com"}, "Crash", "body"); err == nil {
+		t.Fatal("Send to a silent server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Send to a silent server took %v", elapsed)
+	}
+}
+
+func TestSendDigest(t *testing.T) {
+	fake := newFakeSMTP(t, false)
+	day := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	sent, err := SendDigest(day, []string{"erin@example.com"}, nil)
+	if err != nil || len(sent) != 1 {
+		t.Fatalf("SendDigest returned %v, %v", sent, err)
+	}
+	messages := fake.received()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	if subject := header(messages[0].data, "Subject"); !strings.Contains(subject, day) {
+		t.Errorf("digest subject '%s' lacks the day", subject)
+	}
+	if !strings.Contains(messages[0].data, "Crash digest for "+day) {
+		t.Errorf("digest body missing: %q", messages[0].data)
+	}
+	if len(messages[0].rcpt) != 1 || messages[0].rcpt[0] != "erin@example.com" {
+		t.Errorf("digest sent to %v", messages[0].rcpt)
+	}
+}
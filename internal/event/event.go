@@ -0,0 +1,107 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package event
+
+import (
+	"bp-server/internal/conf"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 事件类型
+const (
+	GroupNew        = "group.new"
+	GroupRegression = "group.regression"
+	Spike           = "spike.detected"
+	DumpFailed      = "dump.failed"
+)
+
+// Types 是所有的事件类型
+var Types = []string{GroupNew, GroupRegression, Spike, DumpFailed}
+
+// Event 是发给通知渠道的事件，没有意义的字段为空
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Program   string    `json:"program"`
+	Version   string    `json:"version,omitempty"`
+	GroupID   uint      `json:"group_id,omitempty"`
+	Signature string    `json:"signature,omitempty"`
+	DumpID    uint      `json:"dump_id,omitempty"`
+	Message   string    `json:"message"`
+	// URL 是事件在查看服务器上的页面，没有配置<net><public_url>时为空
+	URL string `json:"url,omitempty"`
+}
+
+var (
+	mutex    sync.RWMutex
+	handlers []func(Event)
+)
+
+// Subscribe 注册事件处理函数，处理函数在发布事件的goroutine里执行，不能阻塞
+func Subscribe(handler func(Event)) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	handlers = append(handlers, handler)
+}
+
+// Publish 把事件发给所有处理函数，Time为空时使用当前时间
+func Publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for _, handler := range handlers {
+		handler(ev)
+	}
+}
+
+// Link 返回查看服务器上path的完整地址，没有配置<net><public_url>时返回空
+func Link(format string, args ...any) string {
+	base := strings.TrimSuffix(conf.Xml.Net.PublicURL, "/")
+	if base == "" {
+		return ""
+	}
+	return base + fmt.Sprintf(format, args...)
+}
+
+// GroupURL 返回分组页面的完整地址
+func GroupURL(id uint) string {
+	return Link("/group/%d", id)
+}
+
+// DumpURL 返回dump页面的完整地址
+func DumpURL(id uint) string {
+	return Link("/view/%d", id)
+}
@@ -0,0 +1,307 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package minidump
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	headerSignature      = 0x504d444d // "MDMP"
+	cvSignaturePDB70     = 0x53445352 // "RSDS"
+	cvSignatureELF       = 0x4270454c // "BpEL"
+	streamTypeModuleList = 4
+	streamTypeSystemInfo = 7
+	moduleSize           = 108
+)
+
+// cpuNames 是MINIDUMP_SYSTEM_INFO.ProcessorArchitecture对应的名字，与minidump_stackwalk的输出一致
+var cpuNames = map[uint16]string{
+	0:      "x86",
+	1:      "mips",
+	3:      "ppc",
+	5:      "arm",
+	9:      "amd64",
+	12:     "arm64",
+	0x8001: "sparc",
+	0x8002: "ppc64",
+	0x8003: "arm64",
+	0x8004: "mips64",
+	0x8005: "riscv",
+	0x8006: "riscv64",
+}
+
+// platformNames 是MINIDUMP_SYSTEM_INFO.PlatformId对应的名字
+var platformNames = map[uint32]string{
+	2:      "Windows NT",
+	0x8000: "Unix",
+	0x8101: "Mac OS X",
+	0x8102: "iOS",
+	0x8201: "Linux",
+	0x8202: "Solaris",
+	0x8203: "Android",
+	0x8205: "NaCl",
+	0x8206: "Fuchsia",
+}
+
+var ErrNotMinidump = errors.New("not a minidump file")
+
+// Module 是minidump里记录的一个已加载模块，DebugFile和DebugID
+// 与dump_syms生成的符号目录结构 <DebugFile>/<DebugID>/ 对应
+type Module struct {
+	Name      string
+	DebugFile string
+	DebugID   string
+}
+
+// SymbolFile 返回该模块在符号目录中的.sym文件名，规则与breakpad的SimpleSymbolSupplier一致
+func (m *Module) SymbolFile() string {
+	name := m.DebugFile
+	if strings.HasSuffix(strings.ToLower(name), ".pdb") {
+		name = name[:len(name)-4]
+	}
+	return name + ".sym"
+}
+
+type Minidump struct {
+	// Time 是dump写入的时间，取自客户端的时钟
+	Time    time.Time
+	Modules []Module
+	// OS 是操作系统名，OSVersion是带版本号的操作系统，例如 Windows NT 10.0.19045
+	OS        string
+	OSVersion string
+	CPU       string
+}
+
+type systemInfo struct {
+	ProcessorArchitecture uint16
+	ProcessorLevel        uint16
+	ProcessorRevision     uint16
+	NumberOfProcessors    uint8
+	ProductType           uint8
+	MajorVersion          uint32
+	MinorVersion          uint32
+	BuildNumber           uint32
+	PlatformID            uint32
+}
+
+type header struct {
+	Signature          uint32
+	Version            uint32
+	NumberOfStreams    uint32
+	StreamDirectoryRva uint32
+	CheckSum           uint32
+	TimeDateStamp      uint32
+	Flags              uint64
+}
+
+type directory struct {
+	StreamType uint32
+	DataSize   uint32
+	Rva        uint32
+}
+
+// ParseFile 解析minidump文件，只读取bp-server关心的stream
+func ParseFile(filename string) (*Minidump, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(file)
+}
+
+func Parse(r io.ReaderAt) (*Minidump, error) {
+	hdr := header{}
+	if err := read(r, 0, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.Signature != headerSignature {
+		return nil, ErrNotMinidump
+	}
+	dump := &Minidump{}
+	if hdr.TimeDateStamp != 0 {
+		dump.Time = time.Unix(int64(hdr.TimeDateStamp), 0).UTC()
+	}
+	for i := uint32(0); i < hdr.NumberOfStreams; i++ {
+		dir := directory{}
+		if err := read(r, int64(hdr.StreamDirectoryRva)+int64(i)*12, &dir); err != nil {
+			return nil, err
+		}
+		switch dir.StreamType {
+		case streamTypeModuleList:
+			modules, err := parseModuleList(r, &dir)
+			if err != nil {
+				return nil, fmt.Errorf("parse module list: %w", err)
+			}
+			dump.Modules = modules
+		case streamTypeSystemInfo:
+			info := systemInfo{}
+			if err := read(r, int64(dir.Rva), &info); err != nil {
+				return nil, fmt.Errorf("parse system info: %w", err)
+			}
+			dump.setSystemInfo(&info)
+		}
+	}
+	return dump, nil
+}
+
+func (dump *Minidump) setSystemInfo(info *systemInfo) {
+	var ok bool
+	if dump.CPU, ok = cpuNames[info.ProcessorArchitecture]; !ok {
+		dump.CPU = fmt.Sprintf("unknown 0x%x", info.ProcessorArchitecture)
+	}
+	if dump.OS, ok = platformNames[info.PlatformID]; !ok {
+		dump.OS = fmt.Sprintf("unknown 0x%x", info.PlatformID)
+	}
+	dump.OSVersion = fmt.Sprintf("%s %d.%d.%d", dump.OS, info.MajorVersion, info.MinorVersion, info.BuildNumber)
+}
+
+// parseModuleList 解析模块列表。模块数量来自上传的文件，不能信任，
+// 要和stream的大小、文件的大小核对，也不能按它预先分配内存
+func parseModuleList(r io.ReaderAt, dir *directory) ([]Module, error) {
+	offset := int64(dir.Rva)
+	var count uint32
+	if err := read(r, offset, &count); err != nil {
+		return nil, err
+	}
+	if dir.DataSize < 4 || int64(count) > int64(dir.DataSize-4)/moduleSize {
+		return nil, fmt.Errorf("module count %d exceeds stream size %d", count, dir.DataSize)
+	}
+	if size := readerSize(r); size >= 0 && offset+4+int64(count)*moduleSize > size {
+		return nil, fmt.Errorf("module count %d exceeds file size %d", count, size)
+	}
+	var modules []Module
+	raw := make([]byte, moduleSize)
+	for i := uint32(0); i < count; i++ {
+		if _, err := r.ReadAt(raw, offset+4+int64(i)*moduleSize); err != nil {
+			return nil, err
+		}
+		nameRva := binary.LittleEndian.Uint32(raw[20:24])
+		cvSize := binary.LittleEndian.Uint32(raw[76:80])
+		cvRva := binary.LittleEndian.Uint32(raw[80:84])
+		name, err := readString(r, int64(nameRva))
+		if err != nil {
+			return nil, err
+		}
+		module := Module{Name: name}
+		if cvSize > 0 {
+			if err := parseCodeView(r, int64(cvRva), cvSize, &module); err != nil {
+				return nil, err
+			}
+		}
+		modules = append(modules, module)
+	}
+	return modules, nil
+}
+
+func parseCodeView(r io.ReaderAt, offset int64, size uint32, module *Module) error {
+	if size < 4 || size > 4096 {
+		return nil
+	}
+	cv := make([]byte, size)
+	if _, err := r.ReadAt(cv, offset); err != nil {
+		return err
+	}
+	switch binary.LittleEndian.Uint32(cv[0:4]) {
+	case cvSignaturePDB70:
+		if len(cv) < 24 {
+			return nil
+		}
+		age := binary.LittleEndian.Uint32(cv[20:24])
+		pdb := strings.TrimRight(string(cv[24:]), "\x00")
+		module.DebugFile = basename(pdb)
+		module.DebugID = formatGUID(cv[4:20]) + fmt.Sprintf("%X", age)
+	case cvSignatureELF:
+		buildID := make([]byte, 16)
+		copy(buildID, cv[4:])
+		module.DebugFile = basename(module.Name)
+		module.DebugID = formatGUID(buildID) + "0"
+	}
+	return nil
+}
+
+// formatGUID 按breakpad的习惯格式化GUID：前三段按小端读取，全部大写且不带分隔符
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08X%04X%04X%X",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:16])
+}
+
+func basename(name string) string {
+	return path.Base(strings.ReplaceAll(name, "\\", "/"))
+}
+
+func readString(r io.ReaderAt, offset int64) (string, error) {
+	var length uint32
+	if err := read(r, offset, &length); err != nil {
+		return "", err
+	}
+	if length > 64*1024 {
+		return "", fmt.Errorf("string at %d too long: %d", offset, length)
+	}
+	buf := make([]byte, length)
+	if _, err := r.ReadAt(buf, offset+4); err != nil {
+		return "", err
+	}
+	u16 := make([]uint16, length/2)
+	for i := range u16 {
+		u16[i] = binary.LittleEndian.Uint16(buf[i*2:])
+	}
+	return string(utf16.Decode(u16)), nil
+}
+
+// readerSize 返回r的大小，不知道时返回-1
+func readerSize(r io.ReaderAt) int64 {
+	switch v := r.(type) {
+	case interface{ Size() int64 }:
+		return v.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		if info, err := v.Stat(); err == nil {
+			return info.Size()
+		}
+	}
+	return -1
+}
+
+func read(r io.ReaderAt, offset int64, data any) error {
+	return binary.Read(io.NewSectionReader(r, offset, int64(binary.Size(data))), binary.LittleEndian, data)
+}
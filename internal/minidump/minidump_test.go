@@ -0,0 +1,86 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package minidump
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// buildDump 生成只有一个模块列表stream的minidump，模块列表写明count个模块，实际只带modules个
+func buildDump(count uint32, dataSize uint32, modules int) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, header{Signature: headerSignature, NumberOfStreams: 1, StreamDirectoryRva: 32})
+	binary.Write(buf, binary.LittleEndian, directory{StreamType: streamTypeModuleList, DataSize: dataSize, Rva: 44})
+	binary.Write(buf, binary.LittleEndian, count)
+	nameRva := uint32(48 + modules*moduleSize)
+	for i := 0; i < modules; i++ {
+		raw := make([]byte, moduleSize)
+		binary.LittleEndian.PutUint32(raw[20:24], nameRva)
+		buf.Write(raw)
+	}
+	name := []byte("a\x00.\x00d\x00l\x00l\x00")
+	binary.Write(buf, binary.LittleEndian, uint32(len(name)))
+	buf.Write(name)
+	return buf.Bytes()
+}
+
+func TestParseModules(t *testing.T) {
+	dump, err := Parse(bytes.NewReader(buildDump(2, 4+2*moduleSize, 2)))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(dump.Modules) != 2 || dump.Modules[0].Name != "a.dll" {
+		t.Fatalf("unexpected modules %+v", dump.Modules)
+	}
+}
+
+func TestParseOversizedModuleCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		count    uint32
+		dataSize uint32
+		modules  int
+	}{
+		{"count beyond stream", 0xffffffff, 4 + moduleSize, 1},
+		{"stream too small", 1, 2, 1},
+		{"count beyond file", 1000, 4 + 1000*moduleSize, 1},
+		{"truncated file", 3, 4 + 3*moduleSize, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(bytes.NewReader(buildDump(tt.count, tt.dataSize, tt.modules))); err == nil {
+				t.Fatal("Parse accepted an invalid module count")
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package processor
+
+import (
+	"bp-server/internal/breakpad"
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/dumps"
+	"bp-server/internal/event"
+	"bp-server/internal/job"
+	"bp-server/internal/signature"
+	"bp-server/internal/similar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	queueSize             = 1024
+	defaultSignatureDepth = 3
+	// pendingScanInterval 是扫描数据库里pending的dump的间隔，队列满时没放进去的、保存结果失败的dump由扫描重新放入队列
+	pendingScanInterval = time.Minute
+	defaultRetries      = 5
+	maxRetryWait        = time.Hour
+)
+
+var (
+	queue   = make(chan uint, queueSize)
+	stopped = make(chan struct{})
+	wg      sync.WaitGroup
+
+	// queued 是在队列里或者正在处理的dump，扫描时不重复放入
+	queued      = make(map[uint]bool)
+	queuedMutex sync.Mutex
+)
+
+// Start 启动处理dump的worker，并把数据库里还没处理的dump放入队列
+func Start() {
+	workers := conf.Xml.Process.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go worker()
+	}
+	if n := enqueuePending(); n > 0 {
+		logrus.Infof("Found %d unprocessed dumps", n)
+	}
+	job.Every("pending dumps", pendingScanInterval, func() {
+		if n := enqueuePending(); n > 0 {
+			logrus.Infof("Queued %d pending dumps", n)
+		}
+	})
+}
+
+// enqueuePending 把数据库里pending的dump放入队列，返回放入的数量
+func enqueuePending() int {
+	pending, err := db.QueryPendingDumps()
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, id := range pending {
+		if Enqueue(id) {
+			n++
+		}
+	}
+	return n
+}
+
+// Stop 停止处理，等待正在处理的dump结束。队列里剩下的dump状态仍是pending，下次启动时处理
+func Stop() {
+	close(stopped)
+	wg.Wait()
+}
+
+// Enqueue 把dump放入处理队列，不会阻塞。dump已经在队列里或者队列满时返回false，
+// 这时dump在数据库里仍是pending，由定期扫描重新放入队列
+func Enqueue(id uint) bool {
+	queuedMutex.Lock()
+	defer queuedMutex.Unlock()
+	if queued[id] {
+		return false
+	}
+	select {
+	case queue <- id:
+		queued[id] = true
+		return true
+	default:
+		logrus.Debugf("Processing queue is full, dump %d is left for the pending scan", id)
+		return false
+	}
+}
+
+func worker() {
+	defer wg.Done()
+	for {
+		select {
+		case id := <-queue:
+			Process(id)
+			queuedMutex.Lock()
+			delete(queued, id)
+			queuedMutex.Unlock()
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// WalkStack 对dump执行minidump_stackwalk，压缩存储的dump会先解压到临时文件
+func WalkStack(dump *db.Dump) (string, error) {
+	dumpPath, cleanup, err := dumps.Materialize(dump)
+	if err != nil {
+		logrus.Errorf("Read dump file '%s' failed: %v", dumps.Key(dump), err)
+		return "", err
+	}
+	defer cleanup()
+	return breakpad.WalkStack(dumpPath)
+}
+
+// retries 是stackwalk失败之后重试的次数
+func retries() int {
+	if conf.Xml.Process.Retries < 0 {
+		return 0
+	}
+	if conf.Xml.Process.Retries == 0 {
+		return defaultRetries
+	}
+	return conf.Xml.Process.Retries
+}
+
+// retryWait 返回第attempts次失败之后等待的时间，从pendingScanInterval开始每次加倍
+func retryWait(attempts int) time.Duration {
+	wait := pendingScanInterval
+	for i := 1; i < attempts && wait < maxRetryWait; i++ {
+		wait *= 2
+	}
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	return wait
+}
+
+// SignatureDepth 是配置的签名深度
+func SignatureDepth() int {
+	if conf.Xml.Process.SignatureDepth <= 0 {
+		return defaultSignatureDepth
+	}
+	return conf.Xml.Process.SignatureDepth
+}
+
+// Process 对dump执行stackwalk，保存结果并归入崩溃分组
+func Process(id uint) error {
+	dump, err := db.QueryDump(id)
+	if err != nil {
+		return err
+	}
+	// 扫描查到pending之后dump可能已经被处理完了
+	if dump.Status == db.StatusProcessed || dump.Status == db.StatusFailed {
+		return nil
+	}
+	text, err := WalkStack(dump)
+	if err != nil {
+		// 读文件失败或者stackwalker暂时不能执行时不应该永久失败，重试几次之后才标记为failed
+		attempts := dump.Attempts + 1
+		if attempts <= retries() {
+			retryAt := time.Now().Add(retryWait(attempts))
+			logrus.Warnf("Processing dump %d failed, retry at %v: %v", id, retryAt, err)
+			db.RetryDump(id, attempts, retryAt)
+			return err
+		}
+		logrus.Errorf("Processing dump %d failed after %d attempts: %v", id, attempts, err)
+		db.MarkDumpFailed(id, attempts)
+		event.Publish(event.Event{
+			Type:    event.DumpFailed,
+			Program: dump.Program,
+			Version: dump.Version,
+			DumpID:  dump.ID,
+			Message: fmt.Sprintf("Processing dump %d failed: %v", dump.ID, err),
+			URL:     event.DumpURL(dump.ID),
+		})
+		return err
+	}
+	frames := signature.Frames(text)
+	sig := Signature(dump.Program, frames)
+	stack := strings.Join(similar.Stack(dump.Program, frames), "\n")
+	group, err := db.SaveReport(dump, text, strings.Join(frames, "\n"), sig, stack)
+	if err != nil {
+		// dump仍是pending，下次扫描时重新处理
+		return err
+	}
+	logrus.Infof("Processed dump %d, group %d: %s", id, group.ID, sig)
+	publishGroupEvent(dump, group)
+	return nil
+}
+
+// publishGroupEvent 在dump产生了新分组或者重新打开了已修复的分组时发布事件
+func publishGroupEvent(dump *db.Dump, group *db.CrashGroup) {
+	ev := event.Event{
+		Program:   group.Program,
+		Version:   dump.Version,
+		GroupID:   group.ID,
+		Signature: group.Signature,
+		DumpID:    dump.ID,
+		URL:       event.GroupURL(group.ID),
+	}
+	switch {
+	case group.Reopened:
+		ev.Type = event.GroupRegression
+		ev.Message = fmt.Sprintf("Crash group %d fixed in %s crashed again in %s", group.ID, group.FixedVersion, dump.Version)
+	case group.Count == 0:
+		ev.Type = event.GroupNew
+		ev.Message = fmt.Sprintf("New crash group %d in %s %s", group.ID, group.Program, dump.Version)
+	default:
+		return
+	}
+	event.Publish(ev)
+}
@@ -0,0 +1,199 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package processor
+
+import (
+	"bp-server/internal/db"
+	"bp-server/internal/signature"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	reprocessBatch = 500
+	// maxSplitLevels 限制连续拆分的层数，避免拆分深度互相引用时死循环
+	maxSplitLevels = 8
+)
+
+// Signature 计算栈帧的签名。签名对应的分组被手动拆分过时，用拆分的深度重新计算
+func Signature(program string, frames []string) string {
+	rules := signature.ForProgram(program)
+	depth := SignatureDepth()
+	sig := rules.Generate(frames, depth)
+	for i := 0; i < maxSplitLevels; i++ {
+		group, err := db.FindGroup(program, sig)
+		if err != nil || group == nil || group.SplitDepth == 0 || group.SplitDepth == depth {
+			break
+		}
+		depth = group.SplitDepth
+		sig = rules.Generate(frames, depth)
+	}
+	return sig
+}
+
+func reportFrames(dumpID uint) ([]string, error) {
+	report, err := db.QueryReport(dumpID)
+	if err != nil {
+		return nil, err
+	}
+	if report.Frames != "" {
+		return strings.Split(report.Frames, "\n"), nil
+	}
+	return signature.Frames(report.Text), nil
+}
+
+// Regrouped 是重新计算签名后换了分组的dump
+type Regrouped struct {
+	Dump         db.Dump
+	OldSignature string
+	Signature    string
+}
+
+// ReprocessSignatures 用当前的签名规则重新计算已处理dump的签名，不重新执行stackwalk。
+// 签名对应的分组变化的dump移到新的分组，dryRun为true时只返回会移动的dump。program为空时处理所有程序
+func ReprocessSignatures(program string, dryRun bool) ([]Regrouped, error) {
+	return reprocess(program, nil, dryRun)
+}
+
+// reprocess 重新分组program的已处理dump，groups不为nil时只处理这些分组里的dump
+func reprocess(program string, groups map[uint]bool, dryRun bool) ([]Regrouped, error) {
+	var regrouped []Regrouped
+	signatures := map[uint]string{}
+	var afterID uint
+	for {
+		batch, err := db.QueryProcessedDumps(program, afterID, reprocessBatch)
+		if err != nil {
+			return regrouped, err
+		}
+		if len(batch) == 0 {
+			return regrouped, nil
+		}
+		for i := range batch {
+			dump := &batch[i]
+			afterID = dump.ID
+			if groups != nil && !groups[dump.GroupID] {
+				continue
+			}
+			frames, err := reportFrames(dump.ID)
+			if err != nil {
+				logrus.Warnf("Query report of dump %d failed: %v", dump.ID, err)
+				continue
+			}
+			sig := Signature(dump.Program, frames)
+			group, err := db.FindGroup(dump.Program, sig)
+			if err != nil {
+				return regrouped, err
+			}
+			if group != nil && group.ID == dump.GroupID {
+				continue
+			}
+			old, ok := signatures[dump.GroupID]
+			if !ok {
+				if group, err := db.QueryGroup(dump.GroupID); err == nil {
+					old = group.Signature
+				}
+				signatures[dump.GroupID] = old
+			}
+			regrouped = append(regrouped, Regrouped{Dump: *dump, OldSignature: old, Signature: sig})
+			if dryRun {
+				continue
+			}
+			if _, err := db.Regroup(dump, sig); err != nil {
+				return regrouped, err
+			}
+		}
+	}
+}
+
+// Merge 把src分组合并到dst分组，以后签名和src相同的dump也归入dst
+func Merge(src uint, dst uint, actor string) (*db.GroupChange, error) {
+	change, err := db.MergeGroups(src, dst, actor)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Crash group %d merged into %d by '%s', moved %d dumps", src, dst, actor, change.Moved)
+	return change, nil
+}
+
+// Split 用新的深度重新计算分组里dump的签名，把分组拆成更细的分组。
+// 以后签名落在这个分组的dump也用这个深度计算签名
+func Split(groupID uint, depth int, actor string) (*db.GroupChange, error) {
+	if depth <= 0 {
+		return nil, fmt.Errorf("invalid depth %d", depth)
+	}
+	group, err := db.QueryGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := db.QueryGroupDumpIDs(groupID)
+	if err != nil {
+		return nil, err
+	}
+	rules := signature.ForProgram(group.Program)
+	assignments := make([]db.Assignment, 0, len(ids))
+	for _, id := range ids {
+		frames, err := reportFrames(id)
+		if err != nil {
+			continue
+		}
+		assignments = append(assignments, db.Assignment{DumpID: id, Signature: rules.Generate(frames, depth)})
+	}
+	change, err := db.SplitGroup(groupID, depth, assignments, actor)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Crash group %d split by depth %d by '%s', moved %d dumps", groupID, depth, actor, change.Moved)
+	return change, nil
+}
+
+// Undo 撤销一次合并或拆分，并把修改之后归入受影响分组的dump按恢复后的规则重新分组
+func Undo(changeID uint, actor string) (*db.GroupChange, error) {
+	change, affected, err := db.UndoChange(changeID, actor)
+	if err != nil {
+		return nil, err
+	}
+	group, err := db.QueryGroup(change.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	groups := map[uint]bool{}
+	for _, id := range affected {
+		groups[id] = true
+	}
+	regrouped, err := reprocess(group.Program, groups, false)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Crash group change %d (%s of group %d) undone by '%s', regrouped %d dumps", changeID, change.Action, change.GroupID, actor, len(regrouped))
+	return change, nil
+}
@@ -0,0 +1,218 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package retention
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/dumps"
+	"bp-server/internal/job"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Pruned 是一个被清理(或dry-run下将被清理)的dump
+type Pruned struct {
+	Dump   db.Dump
+	Reason string
+}
+
+type cleaner struct {
+	dryRun bool
+	pruned map[uint]bool
+	result []Pruned
+}
+
+// Start 按配置定期清理dump
+func Start() {
+	if !conf.Xml.Retention.Enable {
+		return
+	}
+	job.Every("dump retention", time.Duration(conf.Xml.Retention.Interval)*time.Minute, func() {
+		if _, err := Cleanup(false); err != nil {
+			logrus.Errorf("Dump retention cleanup failed: %v", err)
+		}
+	})
+}
+
+// Cleanup 按保留策略清理dump文件和处理结果，dump记录被软删除以保留统计数据。
+// 程序自己的策略中非0的项覆盖全局策略，全局quota限制所有程序的总大小
+func Cleanup(dryRun bool) ([]Pruned, error) {
+	c := &cleaner{dryRun: dryRun, pruned: make(map[uint]bool)}
+	if err := backfillSizes(); err != nil {
+		return nil, err
+	}
+	global := conf.Xml.Retention.Policy
+	var ageOverrides, countOverrides []string
+	for _, p := range conf.Xml.Retention.Programs {
+		filter := db.DumpFilter{Program: p.Name}
+		if p.MaxAge > 0 {
+			ageOverrides = append(ageOverrides, p.Name)
+			if err := c.byAge(filter, p.MaxAge); err != nil {
+				return c.result, err
+			}
+		}
+		if p.MaxPerGroup > 0 {
+			countOverrides = append(countOverrides, p.Name)
+			if err := c.byGroupCount(filter, p.MaxPerGroup); err != nil {
+				return c.result, err
+			}
+		}
+		if p.Quota > 0 {
+			if err := c.byQuota(filter, p.Quota*1024*1024); err != nil {
+				return c.result, err
+			}
+		}
+	}
+	if global.MaxAge > 0 {
+		if err := c.byAge(db.DumpFilter{Exclude: ageOverrides}, global.MaxAge); err != nil {
+			return c.result, err
+		}
+	}
+	if global.MaxPerGroup > 0 {
+		if err := c.byGroupCount(db.DumpFilter{Exclude: countOverrides}, global.MaxPerGroup); err != nil {
+			return c.result, err
+		}
+	}
+	if global.Quota > 0 {
+		if err := c.byQuota(db.DumpFilter{}, global.Quota*1024*1024); err != nil {
+			return c.result, err
+		}
+	}
+	return c.result, nil
+}
+
+func (c *cleaner) byAge(filter db.DumpFilter, days int) error {
+	list, err := db.QueryDumpsBefore(filter, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return err
+	}
+	for i := range list {
+		c.prune(&list[i], fmt.Sprintf("older than %d days", days))
+	}
+	return nil
+}
+
+func (c *cleaner) byGroupCount(filter db.DumpFilter, max int) error {
+	groups, err := db.QueryGroupsExceeding(filter, max)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		list, err := db.QueryGroupOverflow(group, max)
+		if err != nil {
+			return err
+		}
+		for i := range list {
+			c.prune(&list[i], fmt.Sprintf("more than %d dumps in group %d", max, group))
+		}
+	}
+	return nil
+}
+
+func (c *cleaner) byQuota(filter db.DumpFilter, quota int64) error {
+	total, err := db.QueryDumpBytes(filter)
+	if err != nil {
+		return err
+	}
+	if c.dryRun {
+		for _, p := range c.result {
+			if filter.Program == "" || filter.Program == p.Dump.Program {
+				total -= p.Dump.Size
+			}
+		}
+	}
+	const batch = 100
+	var lastID uint
+	for total > quota {
+		list, err := db.QueryOldestDumps(filter, lastID, batch)
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			break
+		}
+		for i := range list {
+			lastID = list[i].ID
+			if total <= quota {
+				break
+			}
+			if c.prune(&list[i], fmt.Sprintf("over quota of %d bytes", quota)) {
+				total -= list[i].Size
+			}
+		}
+	}
+	return nil
+}
+
+func (c *cleaner) prune(dump *db.Dump, reason string) bool {
+	if c.pruned[dump.ID] {
+		return false
+	}
+	if !c.dryRun && Delete(dump, reason) != nil {
+		return false
+	}
+	c.pruned[dump.ID] = true
+	c.result = append(c.result, Pruned{Dump: *dump, Reason: reason})
+	return true
+}
+
+// Delete 删除dump的文件和处理结果，和按保留策略清理一样，所属分组的计数不变
+func Delete(dump *db.Dump, reason string) error {
+	if err := dumps.Remove(dump); err != nil {
+		logrus.Errorf("Remove dump file '%s' failed: %v", dumps.Key(dump), err)
+		return err
+	}
+	if err := db.PruneDump(dump.ID); err != nil {
+		return err
+	}
+	logrus.Infof("Pruned dump %d '%s' (%d bytes): %s", dump.ID, dumps.Key(dump), dump.Size, reason)
+	return nil
+}
+
+func backfillSizes() error {
+	list, err := db.QueryDumpsWithoutSize()
+	if err != nil {
+		return err
+	}
+	for i := range list {
+		size, err := dumps.Size(&list[i])
+		if err != nil {
+			continue
+		}
+		if err := db.UpdateDumpSize(list[i].ID, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"bp-server/internal/auth"
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const adminTemplate = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>Users</title>
+		<style>
+			th, td {
+				padding: 10px;
+			}
+			.error {
+				color: #b00000;
+			}
+		</style>
+	</head>
+	<body>
+		<a href="{{ prefix }}/list/0">Dumps</a>
+		<a href="{{ prefix }}/groups/0">Crash Groups</a>
+		<a href="{{ prefix }}/symbols/0">Symbols</a>
+		<a href="{{ prefix }}/webhooks/0">Webhooks</a>
+		{{ with .Error }}<p class="error">{{ . }}</p>{{ end }}
+		<h4>Users</h4>
+		<table>
+			<thead>
+				<tr>
+					<th>User</th>
+					<th>Status</th>
+					<th>Last Login</th>
+					<th>Grants</th>
+				</tr>
+			</thead>
+		<tbody>
+		{{range .Users }}
+			<tr>
+				<td>{{ .Username }}</td>
+				<td>{{ if .Disabled }}disabled{{ else }}active{{ end }}</td>
+				<td>{{ with .LastLogin }}{{ datetime . }}{{ end }}</td>
+				<td>
+				{{- range index $.Grants .ID }}
+					<form method="POST" action="{{ prefix }}/admin/grant">
+						{{ if eq .Program "*" }}all programs{{ else }}{{ .Program }}{{ end }}: {{ .Role }}
+						<input type="hidden" name="csrf_token" value="{{ $.CSRF }}">
+						<input type="hidden" name="username" value="{{ $.Username .UserID }}">
+						<input type="hidden" name="program" value="{{ .Program }}">
+						<input type="submit" value="Revoke">
+					</form>
+				{{- end }}
+				</td>
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+		<h4>Create or update a user</h4>
+		<form method="POST" action="{{ prefix }}/admin/user">
+			<input type="hidden" name="csrf_token" value="{{ .CSRF }}">
+			User <input type="text" name="username">
+			Password <input type="password" name="password" placeholder="unchanged if empty">
+			<label><input type="checkbox" name="disabled" value="true"> Disabled</label>
+			<input type="submit" value="Save">
+		</form>
+		<h4>Grant a role</h4>
+		<form method="POST" action="{{ prefix }}/admin/grant">
+			<input type="hidden" name="csrf_token" value="{{ .CSRF }}">
+			User <input type="text" name="username">
+			Program <input type="text" name="program" placeholder="* for all programs">
+			<select name="role">
+				{{- range .Roles }}
+				<option value="{{ . }}">{{ . }}</option>
+				{{- end }}
+			</select>
+			<input type="submit" value="Grant">
+		</form>
+	</body>
+</html>`
+
+type adminPage struct {
+	Users  []db.User
+	Grants map[uint][]db.Grant
+	Roles  []string
+	CSRF   string
+	Error  string
+}
+
+// Username 返回账号ID对应的用户名
+func (p *adminPage) Username(id uint) string {
+	for _, u := range p.Users {
+		if u.ID == id {
+			return u.Username
+		}
+	}
+	return ""
+}
+
+func (svr *Server) admin(ctx *gin.Context) {
+	data := &adminPage{Roles: db.Roles, CSRF: csrfToken(ctx), Error: ctx.Query("error")}
+	var err error
+	if data.Users, err = db.QueryUsers(); err != nil {
+		ctx.String(http.StatusOK, "Query users internal error")
+		return
+	}
+	if data.Grants, err = db.QueryAllGrants(); err != nil {
+		ctx.String(http.StatusOK, "Query grants internal error")
+		return
+	}
+	ctx.Status(http.StatusOK)
+	svr.adminTpl.Execute(ctx.Writer, data)
+}
+
+// backToAdmin 回到管理页面，err不为nil时在页面上显示
+func backToAdmin(ctx *gin.Context, err error) {
+	target := conf.Xml.Net.Prefix + "/admin"
+	if err != nil {
+		target += "?error=" + url.QueryEscape(err.Error())
+	}
+	ctx.Redirect(http.StatusSeeOther, target)
+}
+
+// saveUser 创建或修改账号，disabled为nil时已有账号保持原状态
+func saveUser(ctx *gin.Context, username string, password string, disabled *bool) (*db.User, error) {
+	state := false
+	if disabled != nil {
+		state = *disabled
+	} else if user, err := db.QueryUser(strings.TrimSpace(username)); err == nil {
+		state = user.Disabled
+	}
+	user, err := auth.SetUser(username, password, state)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("User '%s' saved by '%s', disabled: %v", user.Username, actor(ctx), user.Disabled)
+	return user, nil
+}
+
+func (svr *Server) adminSaveUser(ctx *gin.Context) {
+	disabled := ctx.PostForm("disabled") == "true"
+	_, err := saveUser(ctx, ctx.PostForm("username"), ctx.PostForm("password"), &disabled)
+	backToAdmin(ctx, err)
+}
+
+func (svr *Server) adminGrant(ctx *gin.Context) {
+	backToAdmin(ctx, auth.SetGrant(ctx.PostForm("username"), ctx.PostForm("program"), ctx.PostForm("role")))
+}
+
+type grantJSON struct {
+	Program string `json:"program"`
+	Role    string `json:"role"`
+}
+
+type userJSON struct {
+	Username  string      `json:"username"`
+	Disabled  bool        `json:"disabled"`
+	LastLogin *time.Time  `json:"last_login,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	Grants    []grantJSON `json:"grants"`
+}
+
+func toUserJSON(user *db.User, grants []db.Grant) userJSON {
+	result := userJSON{
+		Username:  user.Username,
+		Disabled:  user.Disabled,
+		LastLogin: user.LastLogin,
+		CreatedAt: user.CreatedAt,
+		Grants:    make([]grantJSON, 0, len(grants)),
+	}
+	for _, g := range grants {
+		result.Grants = append(result.Grants, grantJSON{Program: g.Program, Role: g.Role})
+	}
+	return result
+}
+
+func (svr *Server) apiUsers(ctx *gin.Context) {
+	users, err := db.QueryUsers()
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query users failed")
+		return
+	}
+	grants, err := db.QueryAllGrants()
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query grants failed")
+		return
+	}
+	result := make([]userJSON, 0, len(users))
+	for i := range users {
+		result = append(result, toUserJSON(&users[i], grants[users[i].ID]))
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (svr *Server) apiSaveUser(ctx *gin.Context) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Disabled *bool  `json:"disabled"`
+	}
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		apiError(ctx, http.StatusBadRequest, fmt.Sprintf("parse request body failed: %v", err))
+		return
+	}
+	user, err := saveUser(ctx, req.Username, req.Password, req.Disabled)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	grants, err := db.QueryGrants(user.ID)
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query grants failed")
+		return
+	}
+	ctx.JSON(http.StatusOK, toUserJSON(user, grants))
+}
+
+func (svr *Server) apiGrant(ctx *gin.Context) {
+	var req struct {
+		Username string `json:"username"`
+		Program  string `json:"program"`
+		Role     string `json:"role"`
+	}
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		apiError(ctx, http.StatusBadRequest, fmt.Sprintf("parse request body failed: %v", err))
+		return
+	}
+	if err := auth.SetGrant(req.Username, req.Program, req.Role); err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	user, err := db.QueryUser(req.Username)
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query user failed")
+		return
+	}
+	grants, err := db.QueryGrants(user.ID)
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query grants failed")
+		return
+	}
+	ctx.JSON(http.StatusOK, toUserJSON(user, grants))
+}
+
+type uploadKeyJSON struct {
+	ID          uint       `json:"id"`
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix"`
+	Programs    []string   `json:"programs"`
+	Permissions []string   `json:"permissions"`
+	CreatedBy   string     `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUsed    *time.Time `json:"last_used,omitempty"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy   string     `json:"revoked_by,omitempty"`
+	// Key 是密钥明文，只在创建时返回
+	Key string `json:"key,omitempty"`
+}
+
+func toUploadKeyJSON(key *db.UploadKey) uploadKeyJSON {
+	result := uploadKeyJSON{
+		ID:          key.ID,
+		Name:        key.Name,
+		Prefix:      key.Prefix,
+		Programs:    key.ProgramList(),
+		Permissions: []string{},
+		CreatedBy:   key.CreatedBy,
+		CreatedAt:   key.CreatedAt,
+		LastUsed:    key.LastUsed,
+		RevokedAt:   key.RevokedAt,
+		RevokedBy:   key.RevokedBy,
+	}
+	if key.Dump {
+		result.Permissions = append(result.Permissions, db.UploadDump)
+	}
+	if key.Symbol {
+		result.Permissions = append(result.Permissions, db.UploadSymbol)
+	}
+	return result
+}
+
+func (svr *Server) apiUploadKeys(ctx *gin.Context) {
+	keys, err := db.QueryUploadKeys()
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query upload keys failed")
+		return
+	}
+	result := make([]uploadKeyJSON, 0, len(keys))
+	for i := range keys {
+		result = append(result, toUploadKeyJSON(&keys[i]))
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (svr *Server) apiAddUploadKey(ctx *gin.Context) {
+	var req struct {
+		Name        string   `json:"name"`
+		Programs    []string `json:"programs"`
+		Permissions []string `json:"permissions"`
+	}
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		apiError(ctx, http.StatusBadRequest, fmt.Sprintf("parse request body failed: %v", err))
+		return
+	}
+	key, secret, err := auth.NewUploadKey(req.Name, req.Programs, req.Permissions, actor(ctx))
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	logrus.Infof("Upload key %d '%s' created by '%s'", key.ID, key.Name, actor(ctx))
+	result := toUploadKeyJSON(key)
+	result.Key = secret
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (svr *Server) apiRevokeUploadKey(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := auth.RevokeUploadKey(id, actor(ctx)); err != nil {
+		apiError(ctx, http.StatusNotFound, err.Error())
+		return
+	}
+	logrus.Infof("Upload key %d revoked by '%s'", id, actor(ctx))
+	ctx.JSON(http.StatusOK, gin.H{"id": id, "revoked": true})
+}
@@ -0,0 +1,154 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"bp-server/internal/db"
+	"bp-server/internal/retention"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+type dumpJSON struct {
+	ID            uint       `json:"id"`
+	OS            string     `json:"os"`
+	Program       string     `json:"program"`
+	Version       string     `json:"version"`
+	Build         string     `json:"build"`
+	Filename      string     `json:"filename"`
+	Size          int64      `json:"size"`
+	Hash          string     `json:"hash"`
+	Status        string     `json:"status"`
+	GroupID       uint       `json:"group_id"`
+	Duplicates    int64      `json:"duplicates"`
+	LastDuplicate *time.Time `json:"last_duplicate,omitempty"`
+	CrashTime     time.Time  `json:"crash_time"`
+	ClockSkew     int64      `json:"clock_skew"`
+	ClockSkewed   bool       `json:"clock_skewed"`
+	InstallHash   string     `json:"install_hash,omitempty"`
+	CrashLoop     bool       `json:"crash_loop"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+func toDumpJSON(dump *db.Dump) dumpJSON {
+	return dumpJSON{
+		ID:            dump.ID,
+		OS:            dump.OS,
+		Program:       dump.Program,
+		Version:       dump.Version,
+		Build:         dump.Build,
+		Filename:      dump.Filename,
+		Size:          dump.Size,
+		Hash:          dump.Hash,
+		Status:        dump.Status,
+		GroupID:       dump.GroupID,
+		Duplicates:    dump.Duplicates,
+		LastDuplicate: dump.LastDuplicate,
+		CrashTime:     dump.CrashTime,
+		ClockSkew:     dump.ClockSkew,
+		ClockSkewed:   dump.ClockSkewed,
+		InstallHash:   dump.InstallHash,
+		CrashLoop:     dump.CrashLoop,
+		CreatedAt:     dump.CreatedAt,
+	}
+}
+
+func apiError(ctx *gin.Context, code int, msg string) {
+	ctx.JSON(code, gin.H{"error": msg})
+}
+
+func (svr *Server) apiList(ctx *gin.Context) {
+	page, err := strconv.Atoi(ctx.Param("page"))
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, "parse parameter 'page' as integer failed")
+		return
+	}
+	filter, err := parseListFilter(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.Filter.Programs = visiblePrograms(ctx)
+	dumps, err := db.QueryDumpList(page, filter.Filter)
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query dump list failed")
+		return
+	}
+	result := make([]dumpJSON, 0, len(dumps))
+	for i := range dumps {
+		result = append(result, toDumpJSON(&dumps[i]))
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (svr *Server) apiDeleteDump(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	dump, err := db.QueryDump(id)
+	if err != nil {
+		apiError(ctx, http.StatusNotFound, "dump not found")
+		return
+	}
+	if !require(ctx, dump.Program, db.RoleAdmin) {
+		return
+	}
+	if err := retention.Delete(dump, fmt.Sprintf("deleted by %s", actor(ctx))); err != nil {
+		apiError(ctx, http.StatusInternalServerError, "delete dump failed")
+		return
+	}
+	ctx.JSON(http.StatusOK, toDumpJSON(dump))
+}
+
+func (svr *Server) apiDump(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil || id < 0 {
+		apiError(ctx, http.StatusBadRequest, "parse parameter 'id' as integer failed")
+		return
+	}
+	dump, err := db.QueryDump(uint(id))
+	if err != nil {
+		logrus.Warnf("/api/dump/:id: query dump %d failed: %v", id, err)
+		apiError(ctx, http.StatusNotFound, "dump not found")
+		return
+	}
+	if !require(ctx, dump.Program, db.RoleViewer) {
+		return
+	}
+	ctx.JSON(http.StatusOK, toDumpJSON(dump))
+}
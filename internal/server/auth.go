@@ -0,0 +1,294 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"bp-server/internal/auth"
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const loginTemplate = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>Sign in</title>
+		<style>
+			td {
+				padding: 10px;
+			}
+			.error {
+				color: #b00000;
+			}
+		</style>
+	</head>
+	<body>
+		<h3>bp-server</h3>
+		{{ with .Error }}<p class="error">{{ . }}</p>{{ end }}
+		<form method="POST" action="{{ prefix }}/login">
+			<input type="hidden" name="next" value="{{ .Next }}">
+			<table>
+				<tr>
+					<td>Username</td>
+					<td><input type="text" name="username" value="{{ .Username }}" autofocus></td>
+				</tr>
+				<tr>
+					<td>Password</td>
+					<td><input type="password" name="password"></td>
+				</tr>
+			</table>
+			<input type="submit" value="Sign in">
+		</form>
+	</body>
+</html>`
+
+// identityKey 是请求的用户在gin.Context里的键
+const identityKey = "identity"
+
+var errPermission = errors.New("permission denied")
+
+type loginPage struct {
+	Username string
+	Next     string
+	Error    string
+}
+
+// identity 返回请求的用户，没有开启登录时返回nil
+func identity(ctx *gin.Context) *auth.Identity {
+	if value, ok := ctx.Get(identityKey); ok {
+		return value.(*auth.Identity)
+	}
+	return nil
+}
+
+// csrfToken 返回页面表单需要提交的CSRF令牌
+func csrfToken(ctx *gin.Context) string {
+	if id := identity(ctx); id != nil {
+		return id.CSRF
+	}
+	return ""
+}
+
+// permissions 返回请求用户的权限，没有开启登录时返回nil，表示不限制
+func permissions(ctx *gin.Context) *auth.Permissions {
+	if id := identity(ctx); id != nil {
+		return id.Perms
+	}
+	return nil
+}
+
+// allowed 判断用户在程序上是否至少有role。没有开启登录时任何人都能查看和处理分组，
+// 但是删除和管理需要admin，不能匿名进行
+func allowed(ctx *gin.Context, program string, role string) bool {
+	perms := permissions(ctx)
+	if perms == nil {
+		return role != db.RoleAdmin
+	}
+	return perms.Can(program, role)
+}
+
+// isAdmin 判断用户是否对所有程序都是admin，没有开启登录时返回false
+func isAdmin(ctx *gin.Context) bool {
+	perms := permissions(ctx)
+	return perms != nil && perms.Global(db.RoleAdmin)
+}
+
+// visiblePrograms 返回用户能查看的程序，用于过滤列表，nil表示不限制
+func visiblePrograms(ctx *gin.Context) []string {
+	all, programs := permissions(ctx).Programs(db.RoleViewer)
+	if all {
+		return nil
+	}
+	return programs
+}
+
+// forbid 拒绝没有权限的请求
+func forbid(ctx *gin.Context) {
+	id := identity(ctx)
+	if id == nil {
+		logrus.Warnf("Denied %s %s from %s: login is not enabled", ctx.Request.Method, ctx.Request.URL.Path, ctx.ClientIP())
+		if isAPI(ctx) {
+			apiError(ctx, http.StatusForbidden, "permission denied, login is not enabled")
+		} else {
+			ctx.String(http.StatusForbidden, "Permission denied, login is not enabled")
+		}
+		ctx.Abort()
+		return
+	}
+	logrus.Warnf("Denied %s %s to user '%s'", ctx.Request.Method, ctx.Request.URL.Path, id.Username)
+	if isAPI(ctx) {
+		apiError(ctx, http.StatusForbidden, "permission denied")
+	} else {
+		ctx.String(http.StatusForbidden, "Permission denied")
+	}
+	ctx.Abort()
+}
+
+// require 检查用户在程序上是否至少有role，没有时拒绝请求并返回false
+func require(ctx *gin.Context, program string, role string) bool {
+	if allowed(ctx, program, role) {
+		return true
+	}
+	forbid(ctx)
+	return false
+}
+
+// requireGroup 检查用户在分组所属的程序上是否至少有role，分组不存在时交给处理函数报错
+func requireGroup(ctx *gin.Context, id uint, role string) bool {
+	if permissions(ctx) == nil {
+		return true
+	}
+	group, err := db.QueryGroup(id)
+	if err != nil {
+		return true
+	}
+	return require(ctx, group.Program, role)
+}
+
+// requireAdmin 是只允许对所有程序都是admin的用户访问的路由的中间件，没有开启登录时拒绝所有请求
+func (svr *Server) requireAdmin(ctx *gin.Context) {
+	if !isAdmin(ctx) {
+		forbid(ctx)
+	}
+}
+
+func isAPI(ctx *gin.Context) bool {
+	return strings.HasPrefix(ctx.Request.URL.Path, "/api/")
+}
+
+func cookiePath() string {
+	if conf.Xml.Net.Prefix == "" {
+		return "/"
+	}
+	return conf.Xml.Net.Prefix
+}
+
+// nextURL 只接受本站的路径作为登录后跳转的地址
+func nextURL(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return conf.Xml.Net.Prefix + "/list/0"
+	}
+	return next
+}
+
+// authenticate 要求查看服务器的请求已经登录，页面请求跳转到登录页，API请求返回401。
+// 修改数据的请求还要带上CSRF令牌
+func (svr *Server) authenticate(ctx *gin.Context) {
+	if !auth.Enabled() || ctx.FullPath() == "/login" {
+		return
+	}
+	id, err := auth.Authenticate(ctx.Request, ctx.RemoteIP())
+	if err != nil && err != auth.ErrInvalidLogin {
+		ctx.String(http.StatusInternalServerError, "Authentication internal error")
+		ctx.Abort()
+		return
+	}
+	if id == nil {
+		if isAPI(ctx) {
+			apiError(ctx, http.StatusUnauthorized, "authentication required")
+		} else {
+			next := conf.Xml.Net.Prefix + ctx.Request.URL.RequestURI()
+			ctx.Redirect(http.StatusFound, conf.Xml.Net.Prefix+"/login?next="+url.QueryEscape(next))
+		}
+		ctx.Abort()
+		return
+	}
+	if ctx.Request.Method != http.MethodGet && ctx.Request.Method != http.MethodHead {
+		token := ctx.GetHeader(auth.CSRFHeader)
+		if token == "" {
+			token = ctx.PostForm(auth.CSRFField)
+		}
+		if !id.CheckCSRF(token) {
+			logrus.Warnf("Rejected %s %s of user '%s': invalid CSRF token", ctx.Request.Method, ctx.Request.URL.Path, id.Username)
+			if isAPI(ctx) {
+				apiError(ctx, http.StatusForbidden, "invalid CSRF token")
+			} else {
+				ctx.String(http.StatusForbidden, "Invalid or missing CSRF token, reload the page and try again")
+			}
+			ctx.Abort()
+			return
+		}
+	}
+	ctx.Set(identityKey, id)
+}
+
+func (svr *Server) loginForm(ctx *gin.Context) {
+	ctx.Status(http.StatusOK)
+	svr.loginTpl.Execute(ctx.Writer, &loginPage{Next: nextURL(ctx.Query("next"))})
+}
+
+func (svr *Server) login(ctx *gin.Context) {
+	data := &loginPage{Username: strings.TrimSpace(ctx.PostForm("username")), Next: nextURL(ctx.PostForm("next"))}
+	_, token, err := auth.Login(data.Username, ctx.PostForm("password"))
+	if err != nil {
+		logrus.Warnf("Login of '%s' from %s failed: %v", data.Username, ctx.ClientIP(), err)
+		data.Error = "Invalid username or password"
+		if err != auth.ErrInvalidLogin {
+			data.Error = "Login internal error"
+		}
+		ctx.Status(http.StatusOK)
+		svr.loginTpl.Execute(ctx.Writer, data)
+		return
+	}
+	http.SetCookie(ctx.Writer, &http.Cookie{
+		Name:     auth.CookieName,
+		Value:    token,
+		Path:     cookiePath(),
+		MaxAge:   int(auth.SessionDuration().Seconds()),
+		Secure:   conf.Xml.Auth.SecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	ctx.Redirect(http.StatusSeeOther, data.Next)
+}
+
+func (svr *Server) logout(ctx *gin.Context) {
+	if cookie, err := ctx.Request.Cookie(auth.CookieName); err == nil {
+		auth.Logout(cookie.Value)
+	}
+	http.SetCookie(ctx.Writer, &http.Cookie{
+		Name:     auth.CookieName,
+		Path:     cookiePath(),
+		MaxAge:   -1,
+		Secure:   conf.Xml.Auth.SecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	ctx.Redirect(http.StatusSeeOther, conf.Xml.Net.Prefix+"/login")
+}
@@ -0,0 +1,1060 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"bp-server/internal/clock"
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/processor"
+	"bp-server/internal/similar"
+	"bp-server/internal/tracker"
+	"bp-server/internal/version"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const groupListTemplate = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>Crash Groups</title>
+		<style>
+			th, td {
+				padding: 10px;
+			}
+			.regression {
+				color: #b00000;
+			}
+		</style>
+	</head>
+	<body>
+		<a href="{{ prefix }}/list/0">Dumps</a>
+		<a href="{{ prefix }}/stats">Statistics</a>
+		<a href="{{ prefix }}/alerts/0">Spike Alerts</a>
+		{{- if .Admin }}
+		<a href="{{ prefix }}/webhooks/0">Webhooks</a>
+		{{- end }}
+		<form method="GET">
+			Program <input type="text" name="program" value="{{ .Filter.Program }}">
+			<select name="status">
+				<option value="">All statuses</option>
+				{{- range .Statuses }}
+				<option value="{{ . }}" {{- if eq . $.Filter.Status }} selected {{- end }}>{{ . }}</option>
+				{{- end }}
+			</select>
+			Sort by <select name="sort">
+				{{- range .Sorts }}
+				<option value="{{ . }}" {{- if eq . $.Filter.Sort }} selected {{- end }}>{{ . }}</option>
+				{{- end }}
+			</select>
+			<input type="submit" value="Filter">
+		</form>
+		<table>
+			<thead>
+				<tr>
+					<th>ID</th>
+					<th>Program</th>
+					<th>Signature</th>
+					<th>Count</th>
+					<th>Installs</th>
+					<th>Status</th>
+					<th>Assignee</th>
+					<th>Bug</th>
+					<th>First Seen</th>
+					<th>Last Seen</th>
+				</tr>
+			</thead>
+		<tbody>
+		{{range .Groups }}
+			<tr>
+				<td>{{ .ID }}</td>
+				<td>{{ .Program }}</td>
+				<td><a href="{{ prefix }}/group/ {{- .ID -}} ">{{ .Signature }}</a></td>
+				<td>{{ .Count }}</td>
+				<td>{{ .Installs }}{{ if .LoopInstalls }} <span class="regression">({{ .LoopInstalls }} looping)</span>{{ end }}</td>
+				<td>{{ .Status }}{{ if .Regression }} <span class="regression">(regression)</span>{{ end }}</td>
+				<td>{{ .Assignee }}</td>
+				<td>{{ if bugURL .BugID }}<a href="{{ bugURL .BugID }}">{{ .BugID }}</a>{{ else }}{{ .BugID }}{{ end }}</td>
+				<td>{{ datetime .FirstSeen }}</td>
+				<td>{{ datetime .LastSeen }}</td>
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+		{{ if gt .Page 0 }}<a href="{{ prefix }}/groups/ {{- .Prev -}} ? {{- .Query }}">Previous</a>{{ end }}
+		<a href="{{ prefix }}/groups/ {{- .Next -}} ? {{- .Query }}">Next</a>
+	</body>
+</html>`
+
+const groupTemplate = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>Crash Group {{ .Group.ID }}</title>
+		<style>
+			th, td {
+				padding: 10px;
+			}
+			.regression, .error {
+				color: #b00000;
+			}
+		</style>
+	</head>
+	<body>
+		<a href="{{ prefix }}/groups/0">Crash Groups</a>
+		<h3>{{ .Group.Program }}: {{ .Group.Signature }}</h3>
+		<p>
+			{{ .Group.Count }} crashes on {{ .Group.Installs }} installations, first seen {{ datetime .Group.FirstSeen }}, last seen {{ datetime .Group.LastSeen }}
+			{{- if .Group.LoopInstalls }}
+			<br><span class="regression">Crash loop: {{ .Group.LoopInstalls }} installations crashed here repeatedly within minutes</span>
+			{{- end }}
+			{{- if .Group.Regression }}
+			<br><span class="regression">Regression: crashed again after being fixed {{- with .Group.FixedVersion }} in {{ . }}{{ end }}</span>
+			{{- end }}
+			{{- with bugURL .Group.BugID }}
+			<br>Bug: <a href="{{ . }}">{{ $.Group.BugID }}</a>
+			{{- end }}
+			{{- with .Group.IssueURL }}
+			<br>Issue: <a href="{{ . }}">{{ . }}</a>
+			{{- with $.Group.IssueState }} ({{ . }}){{ end }}
+			{{- if $.Group.IssueClosed }} <span class="regression">closed</span>{{ end }}
+			{{- end }}
+			{{- with .MergedInto }}
+			<br>Merged into <a href="{{ prefix }}/group/ {{- . -}} ">group {{ . }}</a>
+			{{- end }}
+			{{- with .Group.SplitDepth }}
+			<br>Split by depth {{ . }}
+			{{- end }}
+		</p>
+		{{ with .Error }}<p class="error">{{ . }}</p>{{ end }}
+		{{- if .CanTriage }}
+		<form method="POST">
+			<input type="hidden" name="csrf_token" value="{{ .CSRF }}">
+			<table>
+				<tr>
+					<td>Status</td>
+					<td>
+						<select name="status">
+							{{- range .Statuses }}
+							<option value="{{ . }}" {{- if eq . $.Group.Status }} selected {{- end }}>{{ . }}</option>
+							{{- end }}
+						</select>
+						Fixed in version <input type="text" name="fixed_version" value="{{ .Group.FixedVersion }}">
+					</td>
+				</tr>
+				<tr>
+					<td>Assignee</td>
+					<td><input type="text" name="assignee" value="{{ .Group.Assignee }}"></td>
+				</tr>
+				<tr>
+					<td>Bug ID</td>
+					<td><input type="text" name="bug_id" value="{{ .Group.BugID }}"></td>
+				</tr>
+				<tr>
+					<td>Notes</td>
+					<td><textarea name="notes" rows="8" cols="80">{{ .Group.Notes }}</textarea></td>
+				</tr>
+			</table>
+			<input type="submit" value="Save">
+		</form>
+		<p>
+			{{- if and .Tracker (not .Group.IssueURL) }}
+			<form method="POST" action="{{ prefix }}/group/ {{- .Group.ID -}} /issue">
+				<input type="hidden" name="csrf_token" value="{{ .CSRF }}">
+				<input type="submit" value="Create {{ .Tracker }} issue">
+			</form>
+			{{- end }}
+			<form method="POST" action="{{ prefix }}/group/ {{- .Group.ID -}} /merge">
+				<input type="hidden" name="csrf_token" value="{{ .CSRF }}">
+				Merge into group <input type="number" name="target" min="1">
+				<input type="submit" value="Merge">
+			</form>
+			<form method="POST" action="{{ prefix }}/group/ {{- .Group.ID -}} /split">
+				<input type="hidden" name="csrf_token" value="{{ .CSRF }}">
+				Split by depth <input type="number" name="depth" min="1" value="{{ .NextDepth }}">
+				<input type="submit" value="Split">
+			</form>
+		</p>
+		{{- end }}
+		{{- if .Changes }}
+		<h4>History</h4>
+		<table>
+			<thead>
+				<tr>
+					<th>ID</th>
+					<th>Change</th>
+					<th>Dumps Moved</th>
+					<th>By</th>
+					<th>Time</th>
+					<th></th>
+				</tr>
+			</thead>
+		<tbody>
+		{{range .Changes }}
+			<tr>
+				<td>{{ .ID }}</td>
+				{{ if eq .Action "merge" -}}
+				<td>Merged group <a href="{{ prefix }}/group/ {{- .GroupID -}} ">{{ .GroupID }}</a> into <a href="{{ prefix }}/group/ {{- .TargetID -}} ">{{ .TargetID }}</a></td>
+				{{- else -}}
+				<td>Split group <a href="{{ prefix }}/group/ {{- .GroupID -}} ">{{ .GroupID }}</a> by depth {{ .Depth }}</td>
+				{{- end }}
+				<td>{{ .Moved }}</td>
+				<td>{{ .Actor }}</td>
+				<td>{{ datetime .CreatedAt }}</td>
+				{{ if .UndoneAt -}}
+				<td>Undone {{ datetime .UndoneAt }} {{- with .UndoneBy }} by {{ . }}{{ end }}</td>
+				{{- else if $.CanTriage -}}
+				<td><form method="POST" action="{{ prefix }}/change/ {{- .ID -}} /undo"><input type="hidden" name="csrf_token" value="{{ $.CSRF }}"><input type="submit" value="Undo"></form></td>
+				{{- end }}
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+		{{- end }}
+		{{- if .Similar }}
+		<h4>Similar crash groups</h4>
+		<table>
+			<thead>
+				<tr>
+					<th>ID</th>
+					<th>Similarity</th>
+					<th>Signature</th>
+					<th>Count</th>
+					<th>Status</th>
+				</tr>
+			</thead>
+		<tbody>
+		{{range .Similar }}
+			<tr>
+				<td>{{ .Group.ID }}</td>
+				<td>{{ percent .Score }}</td>
+				<td><a href="{{ prefix }}/group/ {{- .Group.ID -}} ">{{ .Group.Signature }}</a></td>
+				<td>{{ .Group.Count }}</td>
+				<td>{{ .Group.Status }}</td>
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+		{{- end }}
+		{{- if .Alerts }}
+		<h4>Spikes</h4>
+		<table>
+			<thead>
+				<tr>
+					<th>Day</th>
+					<th>Crashes</th>
+					<th>Baseline</th>
+				</tr>
+			</thead>
+		<tbody>
+		{{range .Alerts }}
+			<tr>
+				<td>{{ .Day }}</td>
+				<td>{{ .Count }}</td>
+				<td>{{ printf "%.1f" .Baseline }} per day</td>
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+		<a href="{{ prefix }}/alerts/0?group= {{- .Group.ID }}">All spikes</a>
+		{{- end }}
+		{{- if .Versions }}
+		<h4>Versions</h4>
+		<table>
+			<thead>
+				<tr>
+					<th>Version</th>
+					<th>Count</th>
+					<th>Installs</th>
+				</tr>
+			</thead>
+		<tbody>
+		{{range .Versions }}
+			<tr>
+				<td>{{ .Version }}</td>
+				<td>{{ .Count }}</td>
+				<td>{{ .Installs }}</td>
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+		{{- end }}
+		<h4>Latest dumps</h4>
+		<table>
+			<thead>
+				<tr>
+					<th>ID</th>
+					<th>OS</th>
+					<th>Version</th>
+					<th>Crash Time</th>
+					<th>Dump</th>
+					{{- if .CanDelete }}
+					<th></th>
+					{{- end }}
+				</tr>
+			</thead>
+		<tbody>
+		{{range .Dumps }}
+			<tr>
+				<td>{{ .ID }}</td>
+				<td>{{ .OS }}</td>
+				<td>{{ .Version }}</td>
+				<td>{{ datetime .CrashTime }}{{ if .CrashLoop }} <span class="regression">(loop)</span>{{ end }}</td>
+				<td><a href="{{ prefix }}/view/ {{- .ID -}} "> {{ .Filename }} </a></td>
+				{{- if $.CanDelete }}
+				<td><form method="POST" action="{{ prefix }}/dump/ {{- .ID -}} /delete"><input type="hidden" name="csrf_token" value="{{ $.CSRF }}"><input type="submit" value="Delete"></form></td>
+				{{- end }}
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+	</body>
+</html>`
+
+const (
+	// groupDumpsLimit 是分组页面上显示的最新dump数量
+	groupDumpsLimit = 20
+	// groupChangesLimit 是分组页面上显示的合并、拆分记录数量
+	groupChangesLimit = 50
+)
+
+type groupListPage struct {
+	Groups   []db.CrashGroup
+	Filter   db.GroupListFilter
+	Statuses []string
+	Sorts    []string
+	Page     int
+	Query    template.URL
+	Admin    bool
+}
+
+func (p *groupListPage) Prev() int { return p.Page - 1 }
+func (p *groupListPage) Next() int { return p.Page + 1 }
+
+type groupPage struct {
+	Group      *db.CrashGroup
+	Dumps      []db.Dump
+	Versions   []db.GroupVersion
+	Alerts     []db.SpikeAlert
+	Statuses   []string
+	MergedInto uint
+	Changes    []db.GroupChange
+	Similar    []similar.Match
+	// Tracker 是问题跟踪系统的名称，没有配置时为空
+	Tracker string
+	CSRF    string
+	Error   string
+	// CanTriage 和CanDelete 表示用户能否处理分组、删除dump
+	CanTriage bool
+	CanDelete bool
+}
+
+// NextDepth 是拆分表单默认的深度，比当前深度多一帧
+func (p *groupPage) NextDepth() int {
+	if p.Group.SplitDepth > 0 {
+		return p.Group.SplitDepth + 1
+	}
+	return processor.SignatureDepth() + 1
+}
+
+// bugURL 返回分组BugID的链接，BugID本身是链接时直接使用，没有配置<triage><bug_url>时返回空
+func bugURL(bugID string) string {
+	if bugID == "" {
+		return ""
+	}
+	if strings.HasPrefix(bugID, "http://") || strings.HasPrefix(bugID, "https://") {
+		return bugID
+	}
+	if conf.Xml.Triage.BugURL == "" {
+		return ""
+	}
+	return strings.ReplaceAll(conf.Xml.Triage.BugURL, "%s", url.PathEscape(bugID))
+}
+
+func datetime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(clock.Location("")).Format("Jan 02 2006 15:04:05 MST")
+}
+
+func (svr *Server) groupList(ctx *gin.Context) {
+	page, err := strconv.Atoi(ctx.Param("page"))
+	if err != nil {
+		logrus.Warnf("/groups/:page: parse 'page' failed: %v", err)
+		ctx.String(http.StatusOK, "Parse GET parameter 'page' as integer failed")
+		return
+	}
+	if page < 0 {
+		page = 0
+	}
+	data := &groupListPage{
+		Filter:   parseGroupListFilter(ctx),
+		Statuses: db.GroupStatuses,
+		Sorts:    db.GroupSorts,
+		Page:     page,
+		Query:    template.URL(ctx.Request.URL.Query().Encode()),
+		Admin:    isAdmin(ctx),
+	}
+	if !validGroupSort(data.Filter.Sort) {
+		ctx.String(http.StatusOK, "Invalid GET parameter 'sort'")
+		return
+	}
+	data.Groups, err = db.QueryGroupList(page, data.Filter)
+	if err != nil {
+		ctx.String(http.StatusOK, "Query crash group list internal error")
+		return
+	}
+	ctx.Status(http.StatusOK)
+	svr.groupListTpl.Execute(ctx.Writer, data)
+}
+
+func validGroupSort(sort string) bool {
+	if sort == "" {
+		return true
+	}
+	for _, s := range db.GroupSorts {
+		if s == sort {
+			return true
+		}
+	}
+	return false
+}
+
+// sortVersions 把分组的版本从新到旧排列
+func sortVersions(versions []db.GroupVersion) {
+	sort.Slice(versions, func(i, j int) bool {
+		return version.Compare(versions[i].Version, versions[j].Version) > 0
+	})
+}
+
+func parseGroupListFilter(ctx *gin.Context) db.GroupListFilter {
+	return db.GroupListFilter{
+		Program:  ctx.Query("program"),
+		Status:   ctx.Query("status"),
+		Sort:     ctx.Query("sort"),
+		Programs: visiblePrograms(ctx),
+	}
+}
+
+func parseGroupID(ctx *gin.Context) (uint, error) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("parse parameter 'id' as integer failed")
+	}
+	return uint(id), nil
+}
+
+func (svr *Server) renderGroup(ctx *gin.Context, id uint, message string) {
+	group, err := db.QueryGroup(id)
+	if err != nil {
+		msg := fmt.Sprintf("Query crash group with id '%d' failed", id)
+		logrus.Warn(msg)
+		ctx.String(http.StatusOK, msg)
+		return
+	}
+	if !require(ctx, group.Program, db.RoleViewer) {
+		return
+	}
+	data := &groupPage{
+		Group:     group,
+		Statuses:  db.GroupStatuses,
+		CSRF:      csrfToken(ctx),
+		Error:     message,
+		CanTriage: allowed(ctx, group.Program, db.RoleTriager),
+		CanDelete: allowed(ctx, group.Program, db.RoleAdmin),
+	}
+	if tracker.Enabled() {
+		data.Tracker = tracker.Name()
+	}
+	if data.Dumps, err = db.QueryGroupDumps(id, groupDumpsLimit); err != nil {
+		ctx.String(http.StatusOK, "Query dumps of crash group internal error")
+		return
+	}
+	if data.Versions, err = db.QueryGroupVersions(id); err != nil {
+		ctx.String(http.StatusOK, "Query versions of crash group internal error")
+		return
+	}
+	sortVersions(data.Versions)
+	if data.Alerts, err = db.QuerySpikeAlerts(0, db.SpikeFilter{GroupID: id}); err != nil {
+		ctx.String(http.StatusOK, "Query spike alerts of crash group internal error")
+		return
+	}
+	if len(data.Alerts) > groupAlertsLimit {
+		data.Alerts = data.Alerts[:groupAlertsLimit]
+	}
+	if data.MergedInto, err = db.QueryGroupAlias(group); err != nil {
+		ctx.String(http.StatusOK, "Query crash group alias internal error")
+		return
+	}
+	if data.Changes, err = db.QueryGroupChanges(id, groupChangesLimit); err != nil {
+		ctx.String(http.StatusOK, "Query crash group history internal error")
+		return
+	}
+	if data.Similar, err = similar.ForGroup(group); err != nil {
+		ctx.String(http.StatusOK, "Query similar crash groups internal error")
+		return
+	}
+	ctx.Status(http.StatusOK)
+	svr.groupTpl.Execute(ctx.Writer, data)
+}
+
+func (svr *Server) group(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		ctx.String(http.StatusOK, err.Error())
+		return
+	}
+	svr.renderGroup(ctx, id, "")
+}
+
+func (svr *Server) updateGroup(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		ctx.String(http.StatusOK, err.Error())
+		return
+	}
+	if !requireGroup(ctx, id, db.RoleTriager) {
+		return
+	}
+	triage := db.Triage{
+		Status:       ctx.PostForm("status"),
+		Assignee:     strings.TrimSpace(ctx.PostForm("assignee")),
+		Notes:        ctx.PostForm("notes"),
+		BugID:        strings.TrimSpace(ctx.PostForm("bug_id")),
+		FixedVersion: strings.TrimSpace(ctx.PostForm("fixed_version")),
+	}
+	if _, err := db.UpdateTriage(id, triage); err != nil {
+		svr.renderGroup(ctx, id, fmt.Sprintf("Save failed: %v", err))
+		return
+	}
+	logrus.Infof("Crash group %d triaged: status:%s, assignee:%s, bug:%s, fixed version:%s", id, triage.Status, triage.Assignee, triage.BugID, triage.FixedVersion)
+	ctx.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/group/%d", conf.Xml.Net.Prefix, id))
+}
+
+// actor 是记录在修改历史里的操作者，没有开启登录时是客户端地址
+func actor(ctx *gin.Context) string {
+	if id := identity(ctx); id != nil {
+		return id.Username
+	}
+	return ctx.ClientIP()
+}
+
+func (svr *Server) mergeGroup(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		ctx.String(http.StatusOK, err.Error())
+		return
+	}
+	if !requireGroup(ctx, id, db.RoleTriager) {
+		return
+	}
+	target, err := strconv.ParseUint(ctx.PostForm("target"), 10, 32)
+	if err != nil {
+		svr.renderGroup(ctx, id, "Merge failed: invalid target group")
+		return
+	}
+	if _, err := processor.Merge(id, uint(target), actor(ctx)); err != nil {
+		svr.renderGroup(ctx, id, fmt.Sprintf("Merge failed: %v", err))
+		return
+	}
+	ctx.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/group/%d", conf.Xml.Net.Prefix, target))
+}
+
+func (svr *Server) splitGroup(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		ctx.String(http.StatusOK, err.Error())
+		return
+	}
+	if !requireGroup(ctx, id, db.RoleTriager) {
+		return
+	}
+	depth, err := strconv.Atoi(ctx.PostForm("depth"))
+	if err != nil {
+		svr.renderGroup(ctx, id, "Split failed: invalid depth")
+		return
+	}
+	if _, err := processor.Split(id, depth, actor(ctx)); err != nil {
+		svr.renderGroup(ctx, id, fmt.Sprintf("Split failed: %v", err))
+		return
+	}
+	ctx.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/group/%d", conf.Xml.Net.Prefix, id))
+}
+
+// requireChange 检查用户能否撤销合并或拆分记录
+func requireChange(ctx *gin.Context, id uint) bool {
+	if permissions(ctx) == nil {
+		return true
+	}
+	change, err := db.QueryChange(id)
+	if err != nil {
+		return true
+	}
+	return requireGroup(ctx, change.GroupID, db.RoleTriager)
+}
+
+func (svr *Server) undoChange(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		ctx.String(http.StatusOK, err.Error())
+		return
+	}
+	if !requireChange(ctx, id) {
+		return
+	}
+	change, err := processor.Undo(id, actor(ctx))
+	if err != nil {
+		msg := fmt.Sprintf("Undo change %d failed: %v", id, err)
+		logrus.Warn(msg)
+		ctx.String(http.StatusOK, msg)
+		return
+	}
+	ctx.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/group/%d", conf.Xml.Net.Prefix, change.GroupID))
+}
+
+func (svr *Server) createIssue(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		ctx.String(http.StatusOK, err.Error())
+		return
+	}
+	if !requireGroup(ctx, id, db.RoleTriager) {
+		return
+	}
+	if _, err := tracker.CreateIssue(id); err != nil {
+		svr.renderGroup(ctx, id, fmt.Sprintf("Create issue failed: %v", err))
+		return
+	}
+	ctx.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/group/%d", conf.Xml.Net.Prefix, id))
+}
+
+type groupJSON struct {
+	ID           uint       `json:"id"`
+	Program      string     `json:"program"`
+	Signature    string     `json:"signature"`
+	Count        int64      `json:"count"`
+	FirstSeen    time.Time  `json:"first_seen"`
+	LastSeen     time.Time  `json:"last_seen"`
+	Status       string     `json:"status"`
+	Assignee     string     `json:"assignee"`
+	Notes        string     `json:"notes"`
+	BugID        string     `json:"bug_id"`
+	BugURL       string     `json:"bug_url,omitempty"`
+	FixedVersion string     `json:"fixed_version"`
+	FixedAt      *time.Time `json:"fixed_at,omitempty"`
+	Regression   bool       `json:"regression"`
+	SplitDepth   int        `json:"split_depth,omitempty"`
+	Installs     int64      `json:"installs"`
+	LoopInstalls int64      `json:"loop_installs"`
+	IssueURL     string     `json:"issue_url,omitempty"`
+	IssueState   string     `json:"issue_state,omitempty"`
+	IssueClosed  bool       `json:"issue_closed"`
+}
+
+func toGroupJSON(group *db.CrashGroup) groupJSON {
+	return groupJSON{
+		ID:           group.ID,
+		Program:      group.Program,
+		Signature:    group.Signature,
+		Count:        group.Count,
+		FirstSeen:    group.FirstSeen,
+		LastSeen:     group.LastSeen,
+		Status:       group.Status,
+		Assignee:     group.Assignee,
+		Notes:        group.Notes,
+		BugID:        group.BugID,
+		BugURL:       bugURL(group.BugID),
+		FixedVersion: group.FixedVersion,
+		FixedAt:      group.FixedAt,
+		Regression:   group.Regression,
+		SplitDepth:   group.SplitDepth,
+		Installs:     group.Installs,
+		LoopInstalls: group.LoopInstalls,
+		IssueURL:     group.IssueURL,
+		IssueState:   group.IssueState,
+		IssueClosed:  group.IssueClosed,
+	}
+}
+
+func (svr *Server) apiGroupList(ctx *gin.Context) {
+	page, err := strconv.Atoi(ctx.Param("page"))
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, "parse parameter 'page' as integer failed")
+		return
+	}
+	filter := parseGroupListFilter(ctx)
+	if !validGroupSort(filter.Sort) {
+		apiError(ctx, http.StatusBadRequest, fmt.Sprintf("invalid sort '%s'", filter.Sort))
+		return
+	}
+	groups, err := db.QueryGroupList(page, filter)
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query crash group list failed")
+		return
+	}
+	result := make([]groupJSON, 0, len(groups))
+	for i := range groups {
+		result = append(result, toGroupJSON(&groups[i]))
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (svr *Server) apiGroup(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	group, err := db.QueryGroup(id)
+	if err != nil {
+		apiError(ctx, http.StatusNotFound, "crash group not found")
+		return
+	}
+	if !require(ctx, group.Program, db.RoleViewer) {
+		return
+	}
+	ctx.JSON(http.StatusOK, toGroupJSON(group))
+}
+
+// triageJSON 里没有出现的字段保持原值
+type triageJSON struct {
+	Status       *string `json:"status"`
+	Assignee     *string `json:"assignee"`
+	Notes        *string `json:"notes"`
+	BugID        *string `json:"bug_id"`
+	FixedVersion *string `json:"fixed_version"`
+}
+
+func (svr *Server) apiUpdateGroup(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !requireGroup(ctx, id, db.RoleTriager) {
+		return
+	}
+	var req triageJSON
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		apiError(ctx, http.StatusBadRequest, fmt.Sprintf("parse request body failed: %v", err))
+		return
+	}
+	group, err := db.QueryGroup(id)
+	if err != nil {
+		apiError(ctx, http.StatusNotFound, "crash group not found")
+		return
+	}
+	triage := db.Triage{
+		Status:       group.Status,
+		Assignee:     group.Assignee,
+		Notes:        group.Notes,
+		BugID:        group.BugID,
+		FixedVersion: group.FixedVersion,
+	}
+	if req.Status != nil {
+		triage.Status = *req.Status
+	}
+	if req.Assignee != nil {
+		triage.Assignee = strings.TrimSpace(*req.Assignee)
+	}
+	if req.Notes != nil {
+		triage.Notes = *req.Notes
+	}
+	if req.BugID != nil {
+		triage.BugID = strings.TrimSpace(*req.BugID)
+	}
+	if req.FixedVersion != nil {
+		triage.FixedVersion = strings.TrimSpace(*req.FixedVersion)
+	}
+	if _, err := db.UpdateTriage(id, triage); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			apiError(ctx, http.StatusNotFound, "crash group not found")
+		} else {
+			apiError(ctx, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+	group, err = db.QueryGroup(id)
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query crash group failed")
+		return
+	}
+	logrus.Infof("Crash group %d triaged: status:%s, assignee:%s, bug:%s, fixed version:%s", id, triage.Status, triage.Assignee, triage.BugID, triage.FixedVersion)
+	ctx.JSON(http.StatusOK, toGroupJSON(group))
+}
+
+func (svr *Server) apiCreateIssue(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !requireGroup(ctx, id, db.RoleTriager) {
+		return
+	}
+	group, err := tracker.CreateIssue(id)
+	switch {
+	case err == nil:
+		ctx.JSON(http.StatusOK, toGroupJSON(group))
+	case db.IsNotFound(err):
+		apiError(ctx, http.StatusNotFound, "crash group not found")
+	case errors.Is(err, tracker.ErrIssueExists):
+		apiError(ctx, http.StatusConflict, err.Error())
+	case errors.Is(err, tracker.ErrNotConfigured):
+		apiError(ctx, http.StatusBadRequest, err.Error())
+	default:
+		apiError(ctx, http.StatusBadGateway, err.Error())
+	}
+}
+
+type changeJSON struct {
+	ID        uint       `json:"id"`
+	Action    string     `json:"action"`
+	GroupID   uint       `json:"group_id"`
+	TargetID  uint       `json:"target_id,omitempty"`
+	Depth     int        `json:"depth,omitempty"`
+	PrevDepth int        `json:"prev_depth,omitempty"`
+	Moved     int64      `json:"moved"`
+	Actor     string     `json:"actor"`
+	CreatedAt time.Time  `json:"created_at"`
+	UndoneAt  *time.Time `json:"undone_at,omitempty"`
+	UndoneBy  string     `json:"undone_by,omitempty"`
+}
+
+func toChangeJSON(change *db.GroupChange) changeJSON {
+	return changeJSON{
+		ID:        change.ID,
+		Action:    change.Action,
+		GroupID:   change.GroupID,
+		TargetID:  change.TargetID,
+		Depth:     change.Depth,
+		PrevDepth: change.PrevDepth,
+		Moved:     change.Moved,
+		Actor:     change.Actor,
+		CreatedAt: change.CreatedAt,
+		UndoneAt:  change.UndoneAt,
+		UndoneBy:  change.UndoneBy,
+	}
+}
+
+func changeError(ctx *gin.Context, err error) {
+	if db.IsNotFound(err) {
+		apiError(ctx, http.StatusNotFound, err.Error())
+	} else {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+	}
+}
+
+func (svr *Server) apiMergeGroup(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !requireGroup(ctx, id, db.RoleTriager) {
+		return
+	}
+	var req struct {
+		Target uint `json:"target"`
+	}
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		apiError(ctx, http.StatusBadRequest, fmt.Sprintf("parse request body failed: %v", err))
+		return
+	}
+	change, err := processor.Merge(id, req.Target, actor(ctx))
+	if err != nil {
+		changeError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, toChangeJSON(change))
+}
+
+func (svr *Server) apiSplitGroup(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !requireGroup(ctx, id, db.RoleTriager) {
+		return
+	}
+	var req struct {
+		Depth int `json:"depth"`
+	}
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		apiError(ctx, http.StatusBadRequest, fmt.Sprintf("parse request body failed: %v", err))
+		return
+	}
+	change, err := processor.Split(id, req.Depth, actor(ctx))
+	if err != nil {
+		changeError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, toChangeJSON(change))
+}
+
+func (svr *Server) apiGroupChanges(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !requireGroup(ctx, id, db.RoleViewer) {
+		return
+	}
+	changes, err := db.QueryGroupChanges(id, groupChangesLimit)
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query crash group history failed")
+		return
+	}
+	result := make([]changeJSON, 0, len(changes))
+	for i := range changes {
+		result = append(result, toChangeJSON(&changes[i]))
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+type groupVersionJSON struct {
+	Version  string `json:"version"`
+	Count    int64  `json:"count"`
+	Installs int64  `json:"installs"`
+}
+
+func (svr *Server) apiGroupVersions(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !requireGroup(ctx, id, db.RoleViewer) {
+		return
+	}
+	versions, err := db.QueryGroupVersions(id)
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query versions of crash group failed")
+		return
+	}
+	sortVersions(versions)
+	result := make([]groupVersionJSON, 0, len(versions))
+	for _, v := range versions {
+		result = append(result, groupVersionJSON{Version: v.Version, Count: v.Count, Installs: v.Installs})
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (svr *Server) apiUndoChange(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !requireChange(ctx, id) {
+		return
+	}
+	change, err := processor.Undo(id, actor(ctx))
+	if err != nil {
+		changeError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, toChangeJSON(change))
+}
+
+type similarJSON struct {
+	Score float64   `json:"score"`
+	Group groupJSON `json:"group"`
+}
+
+func writeSimilar(ctx *gin.Context, matches []similar.Match) {
+	result := make([]similarJSON, 0, len(matches))
+	for i := range matches {
+		result = append(result, similarJSON{Score: matches[i].Score, Group: toGroupJSON(&matches[i].Group)})
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (svr *Server) apiSimilarGroups(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	group, err := db.QueryGroup(id)
+	if err != nil {
+		apiError(ctx, http.StatusNotFound, "crash group not found")
+		return
+	}
+	if !require(ctx, group.Program, db.RoleViewer) {
+		return
+	}
+	matches, err := similar.ForGroup(group)
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query similar crash groups failed")
+		return
+	}
+	writeSimilar(ctx, matches)
+}
+
+func (svr *Server) apiSimilarDump(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	dump, err := db.QueryDump(id)
+	if err != nil {
+		apiError(ctx, http.StatusNotFound, "dump not found")
+		return
+	}
+	if !require(ctx, dump.Program, db.RoleViewer) {
+		return
+	}
+	matches, err := similar.ForDump(dump)
+	if err != nil {
+		apiError(ctx, http.StatusNotFound, "dump has not been processed")
+		return
+	}
+	writeSimilar(ctx, matches)
+}
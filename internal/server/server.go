@@ -31,14 +31,23 @@
 package server
 
 import (
-	"bp-server/internal/breakpad"
+	"bp-server/internal/auth"
+	"bp-server/internal/clock"
+	"bp-server/internal/compress"
 	"bp-server/internal/conf"
 	"bp-server/internal/db"
+	"bp-server/internal/dumps"
+	"bp-server/internal/minidump"
+	"bp-server/internal/processor"
+	"bp-server/internal/retention"
+	"bp-server/internal/symbols"
+	"bp-server/internal/usage"
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
-	"path"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -57,9 +66,38 @@ const listTemplate = `
 			th, td {
 				padding: 10px;
 			}
+			.skewed {
+				color: #b00000;
+			}
 		</style>
 	</head>
 	<body>
+		{{- with .Identity }}
+		<form method="POST" action="{{ prefix }}/logout">
+			Signed in as {{ .Username }}
+			{{- if .CanLogout }}
+			<input type="hidden" name="csrf_token" value="{{ .CSRF }}">
+			<input type="submit" value="Sign out">
+			{{- end }}
+		</form>
+		{{- end }}
+		<a href="{{ prefix }}/groups/0">Crash Groups</a>
+		<a href="{{ prefix }}/stats">Statistics</a>
+		<a href="{{ prefix }}/symbols/0">Symbols</a>
+		{{- if .Admin }}
+		<a href="{{ prefix }}/webhooks/0">Webhooks</a>
+		<a href="{{ prefix }}/admin">Users</a>
+		{{- end }}
+		<form method="GET">
+			<select name="time">
+				<option value="crash" {{- if not .Filter.ByReceived }} selected {{- end }}>Crash time</option>
+				<option value="received" {{- if .Filter.ByReceived }} selected {{- end }}>Received time</option>
+			</select>
+			From <input type="date" name="from" value="{{ .From }}">
+			To <input type="date" name="to" value="{{ .To }}">
+			Time zone <input type="text" name="tz" value="{{ .TZ }}" placeholder="{{ .Location }}">
+			<input type="submit" value="Filter">
+		</form>
 		<table>
 			<thead>
 				<tr>
@@ -69,33 +107,56 @@ const listTemplate = `
 					<th>Version</th>
 					<th>Build Time</th>
 					<th>Crash Time</th>
+					<th>Received Time</th>
+					<th>Duplicates</th>
+					<th>Group</th>
 					<th>Dump</th>
+					<th></th>
 				</tr>
 			</thead>
 		<tbody>
-		{{range . }}
+		{{range .Dumps }}
 			<tr>
 				<td>{{ .ID }}</td>
 				<td>{{ .OS }}</td>
 				<td>{{ .Program }}</td>
 				<td>{{ .Version }}</td>
 				<td>{{ .Build }}</td>
-				<td>{{ .CreatedAt.Format "Jan 02 2006 15:04:05" }}</td>
-				<td><a href="%s/view/ {{- .ID -}} "> {{ .Filename }} </a></td>
+				{{ if .ClockSkewed -}}
+				<td class="skewed" title="Client clock is off by {{ .ClockSkew }} seconds">{{ $.Format .CrashTime }} *</td>
+				{{- else -}}
+				<td>{{ $.Format .CrashTime }}</td>
+				{{- end }}
+				<td>{{ $.Format .CreatedAt }}</td>
+				<td>{{ .Duplicates }}</td>
+				<td>{{ if .GroupID }}<a href="{{ prefix }}/group/ {{- .GroupID -}} ">{{ .GroupID }}</a>{{ end }}</td>
+				<td><a href="{{ prefix }}/view/ {{- .ID -}} "> {{ .Filename }} </a></td>
+				<td><a href="{{ prefix }}/download/ {{- .ID -}} ">Download</a></td>
 			</tr>
 		{{end}}
 		</tbody>
 		</table>
+		{{ if gt .Page 0 }}<a href="{{ prefix }}/list/ {{- .Prev -}} ? {{- .Query }}">Previous</a>{{ end }}
+		<a href="{{ prefix }}/list/ {{- .Next -}} ? {{- .Query }}">Next</a>
 	</body>
 </html>`
 
 type Server struct {
-	tpl          *template.Template
-	routerView   *gin.Engine
-	routerUpload *gin.Engine
-	stopedChan   chan struct{}
-	httpView     *http.Server
-	httpUpload   *http.Server
+	tpl            *template.Template
+	groupListTpl   *template.Template
+	groupTpl       *template.Template
+	statsTpl       *template.Template
+	webhookListTpl *template.Template
+	webhookTpl     *template.Template
+	alertListTpl   *template.Template
+	loginTpl       *template.Template
+	symbolListTpl  *template.Template
+	adminTpl       *template.Template
+	routerView     *gin.Engine
+	routerUpload   *gin.Engine
+	stopedChan     chan struct{}
+	httpView       *http.Server
+	httpUpload     *http.Server
 }
 
 func toGinMode(mode string) string {
@@ -110,24 +171,80 @@ func toGinMode(mode string) string {
 
 func New() *Server {
 	gin.SetMode(toGinMode(conf.Xml.Net.Mode))
-	template2 := fmt.Sprintf(listTemplate, conf.Xml.Net.Prefix)
-	tpl, err := template.New("list").Parse(template2)
-	if err != nil {
-		panic(err)
-	}
 	return &Server{
-		tpl:          tpl,
-		routerView:   gin.Default(),
-		routerUpload: gin.Default(),
-		stopedChan:   make(chan struct{}, 2),
+		tpl:            parseTemplate("list", listTemplate),
+		groupListTpl:   parseTemplate("groups", groupListTemplate),
+		groupTpl:       parseTemplate("group", groupTemplate),
+		statsTpl:       parseTemplate("stats", statsTemplate),
+		webhookListTpl: parseTemplate("webhooks", webhookListTemplate),
+		webhookTpl:     parseTemplate("webhook", webhookTemplate),
+		alertListTpl:   parseTemplate("alerts", alertListTemplate),
+		loginTpl:       parseTemplate("login", loginTemplate),
+		symbolListTpl:  parseTemplate("symbols", symbolListTemplate),
+		adminTpl:       parseTemplate("admin", adminTemplate),
+		routerView:     gin.Default(),
+		routerUpload:   gin.Default(),
+		stopedChan:     make(chan struct{}, 2),
 	}
 }
 
 func (svr *Server) Start() {
+	svr.routerView.Use(svr.authenticate)
+	svr.routerView.GET("/login", svr.loginForm)
+	svr.routerView.POST("/login", svr.login)
+	svr.routerView.POST("/logout", svr.logout)
 	svr.routerView.GET("/list/:page", svr.list)
 	svr.routerView.GET("/view/:id", svr.view)
+	svr.routerView.GET("/download/:id", svr.download)
+	svr.routerView.GET("/api/list/:page", svr.apiList)
+	svr.routerView.GET("/api/dump/:id", svr.apiDump)
+	svr.routerView.GET("/groups/:page", svr.groupList)
+	svr.routerView.GET("/group/:id", svr.group)
+	svr.routerView.POST("/group/:id", svr.updateGroup)
+	svr.routerView.GET("/api/groups/:page", svr.apiGroupList)
+	svr.routerView.GET("/api/group/:id", svr.apiGroup)
+	svr.routerView.POST("/api/group/:id", svr.apiUpdateGroup)
+	svr.routerView.POST("/group/:id/merge", svr.mergeGroup)
+	svr.routerView.POST("/group/:id/split", svr.splitGroup)
+	svr.routerView.POST("/group/:id/issue", svr.createIssue)
+	svr.routerView.POST("/change/:id/undo", svr.undoChange)
+	svr.routerView.GET("/api/group/:id/changes", svr.apiGroupChanges)
+	svr.routerView.GET("/api/group/:id/versions", svr.apiGroupVersions)
+	svr.routerView.POST("/api/group/:id/merge", svr.apiMergeGroup)
+	svr.routerView.POST("/api/group/:id/split", svr.apiSplitGroup)
+	svr.routerView.POST("/api/group/:id/issue", svr.apiCreateIssue)
+	svr.routerView.POST("/api/change/:id/undo", svr.apiUndoChange)
+	svr.routerView.GET("/api/group/:id/similar", svr.apiSimilarGroups)
+	svr.routerView.GET("/api/dump/:id/similar", svr.apiSimilarDump)
+	svr.routerView.GET("/stats", svr.stats)
+	svr.routerView.GET("/api/stats", svr.apiStats)
+	svr.routerView.GET("/alerts/:page", svr.alertList)
+	svr.routerView.GET("/api/alerts/:page", svr.apiAlertList)
+	svr.routerView.GET("/webhooks/:page", svr.requireAdmin, svr.webhookList)
+	svr.routerView.GET("/webhook/:id", svr.requireAdmin, svr.webhook)
+	svr.routerView.POST("/webhook/:id/replay", svr.requireAdmin, svr.replayWebhook)
+	svr.routerView.GET("/api/webhooks/:page", svr.requireAdmin, svr.apiWebhookList)
+	svr.routerView.GET("/api/webhook/:id", svr.requireAdmin, svr.apiWebhook)
+	svr.routerView.POST("/api/webhook/:id/replay", svr.requireAdmin, svr.apiReplayWebhook)
+	svr.routerView.POST("/dump/:id/delete", svr.deleteDump)
+	svr.routerView.POST("/api/dump/:id/delete", svr.apiDeleteDump)
+	svr.routerView.GET("/symbols/:page", svr.symbolList)
+	svr.routerView.POST("/symbol/:entry/:id/delete", svr.deleteSymbol)
+	svr.routerView.GET("/api/symbols/:page", svr.apiSymbolList)
+	svr.routerView.POST("/api/symbol/:entry/:id/delete", svr.apiDeleteSymbol)
+	svr.routerView.GET("/admin", svr.requireAdmin, svr.admin)
+	svr.routerView.POST("/admin/user", svr.requireAdmin, svr.adminSaveUser)
+	svr.routerView.POST("/admin/grant", svr.requireAdmin, svr.adminGrant)
+	svr.routerView.GET("/api/admin/users", svr.requireAdmin, svr.apiUsers)
+	svr.routerView.POST("/api/admin/user", svr.requireAdmin, svr.apiSaveUser)
+	svr.routerView.POST("/api/admin/grant", svr.requireAdmin, svr.apiGrant)
+	svr.routerView.GET("/api/admin/keys", svr.requireAdmin, svr.apiUploadKeys)
+	svr.routerView.POST("/api/admin/keys", svr.requireAdmin, svr.apiAddUploadKey)
+	svr.routerView.POST("/api/admin/key/:id/revoke", svr.requireAdmin, svr.apiRevokeUploadKey)
 	svr.routerUpload.POST("/updump", svr.uploadDump)
 	svr.routerUpload.POST("/upsym", svr.uploadSymbol)
+	svr.routerUpload.POST("/ping", svr.ping)
+	svr.routerUpload.POST("/token", svr.uploadToken)
 	svr.httpUpload = &http.Server{
 		Addr:    conf.Xml.Net.UploadIP + ":" + fmt.Sprint(conf.Xml.Net.UploadPort),
 		Handler: svr.routerUpload,
@@ -136,14 +253,21 @@ func (svr *Server) Start() {
 		Addr:    conf.Xml.Net.ViewIP + ":" + fmt.Sprint(conf.Xml.Net.ViewPort),
 		Handler: svr.routerView,
 	}
+	var err error
+	if svr.httpUpload.TLSConfig, err = newTLSConfig("upload_tls", conf.Xml.Net.UploadTLS); err != nil {
+		logrus.Fatal(err)
+	}
+	if svr.httpView.TLSConfig, err = newTLSConfig("view_tls", conf.Xml.Net.ViewTLS); err != nil {
+		logrus.Fatal(err)
+	}
 	go func() {
-		if err := svr.httpUpload.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := listen(svr.httpUpload); err != nil && err != http.ErrServerClosed {
 			logrus.Errorf("Upload HTTP listen error: %s", err)
 		}
 		svr.stopedChan <- struct{}{}
 	}()
 	go func() {
-		if err := svr.httpView.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := listen(svr.httpView); err != nil && err != http.ErrServerClosed {
 			logrus.Errorf("View HTTP listen error: %s", err)
 		}
 		svr.stopedChan <- struct{}{}
@@ -172,6 +296,80 @@ func (svr *Server) PrintStats() {
 	//
 }
 
+var templateFuncs = template.FuncMap{
+	"prefix": func() string {
+		return conf.Xml.Net.Prefix
+	},
+	"datetime": datetime,
+	"percent": func(score float64) string {
+		return fmt.Sprintf("%.0f%%", score*100)
+	},
+	// rate 显示无崩溃比例，没有使用数据时为负数
+	"rate": func(rate float64) string {
+		if rate < 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.2f%%", rate*100)
+	},
+	"bugURL":     bugURL,
+	"pathEscape": url.PathEscape,
+}
+
+func parseTemplate(name string, text string) *template.Template {
+	tpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		panic(err)
+	}
+	return tpl
+}
+
+type listPage struct {
+	Dumps    []db.Dump
+	Filter   db.DumpListFilter
+	Page     int
+	From     string
+	To       string
+	TZ       string
+	Location *time.Location
+	Query    template.URL
+	Identity *auth.Identity
+	Admin    bool
+}
+
+func (p *listPage) Prev() int { return p.Page - 1 }
+func (p *listPage) Next() int { return p.Page + 1 }
+
+func (p *listPage) Format(t time.Time) string {
+	return t.In(p.Location).Format("Jan 02 2006 15:04:05 MST")
+}
+
+// parseListFilter 解析列表的过滤参数：time=crash|received，from/to是tz时区下的日期(包含to当天)
+func parseListFilter(ctx *gin.Context) (*listPage, error) {
+	p := &listPage{
+		From:     ctx.Query("from"),
+		To:       ctx.Query("to"),
+		TZ:       ctx.Query("tz"),
+		Location: clock.Location(ctx.Query("tz")),
+		Query:    template.URL(ctx.Request.URL.Query().Encode()),
+	}
+	p.Filter.ByReceived = ctx.Query("time") == "received"
+	if p.From != "" {
+		from, err := time.ParseInLocation("2006-01-02", p.From, p.Location)
+		if err != nil {
+			return nil, fmt.Errorf("parse 'from' failed: %v", err)
+		}
+		p.Filter.From = from
+	}
+	if p.To != "" {
+		to, err := time.ParseInLocation("2006-01-02", p.To, p.Location)
+		if err != nil {
+			return nil, fmt.Errorf("parse 'to' failed: %v", err)
+		}
+		p.Filter.To = to.AddDate(0, 0, 1)
+	}
+	return p, nil
+}
+
 func (svr *Server) list(ctx *gin.Context) {
 	page, err := strconv.Atoi(ctx.Param("page"))
 	if err != nil {
@@ -182,14 +380,24 @@ func (svr *Server) list(ctx *gin.Context) {
 	if page < 0 {
 		page = 0
 	}
-	dumps, err := db.QueryDumpList(page)
+	data, err := parseListFilter(ctx)
+	if err != nil {
+		logrus.Warnf("/list/:page: %v", err)
+		ctx.String(http.StatusOK, err.Error())
+		return
+	}
+	data.Page = page
+	data.Identity = identity(ctx)
+	data.Admin = isAdmin(ctx)
+	data.Filter.Programs = visiblePrograms(ctx)
+	data.Dumps, err = db.QueryDumpList(page, data.Filter)
 	if err != nil {
 		logrus.Error("QueryDumpList failed ", err)
 		ctx.String(http.StatusOK, "Query dump list internal error")
 		return
 	}
 	ctx.Status(http.StatusOK)
-	svr.tpl.Execute(ctx.Writer, dumps)
+	svr.tpl.Execute(ctx.Writer, data)
 }
 
 func (svr *Server) view(ctx *gin.Context) {
@@ -209,8 +417,14 @@ func (svr *Server) view(ctx *gin.Context) {
 		ctx.String(http.StatusOK, msg)
 		return
 	}
-	fullpath := path.Join(conf.Xml.DumpPath, dump.Program, dump.Version, dump.Filename)
-	content, err := breakpad.WalkStack(fullpath)
+	if !require(ctx, dump.Program, db.RoleViewer) {
+		return
+	}
+	if report, err := db.QueryReport(dump.ID); err == nil {
+		ctx.String(http.StatusOK, report.Text)
+		return
+	}
+	content, err := processor.WalkStack(dump)
 	if err != nil {
 		ctx.String(http.StatusOK, "Get crash info failed")
 		return
@@ -218,6 +432,135 @@ func (svr *Server) view(ctx *gin.Context) {
 	ctx.String(http.StatusOK, content)
 }
 
+// download 返回原始的dump文件。客户端接受dump的压缩方式时直接发送压缩数据并设置Content-Encoding，
+// 否则边解压边发送
+func (svr *Server) download(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		logrus.Warnf("/download/:id: parse 'id' failed: %v", err)
+		ctx.String(http.StatusOK, "Parse GET parameter 'id' as integer failed")
+		return
+	}
+	dump, err := db.QueryDump(uint(id))
+	if err != nil {
+		msg := fmt.Sprintf("Query dump with id '%d' failed", id)
+		logrus.Warn(msg)
+		ctx.String(http.StatusOK, msg)
+		return
+	}
+	if !require(ctx, dump.Program, db.RoleViewer) {
+		return
+	}
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", dump.Filename))
+	method := compress.Normalized(dump.Compress)
+	if method != compress.None && acceptsEncoding(ctx.GetHeader("Accept-Encoding"), method) {
+		reader, size, err := dumps.OpenRaw(dump)
+		if err != nil {
+			logrus.Warnf("Open dump file '%s' failed: %v", dumps.Key(dump), err)
+			ctx.String(http.StatusOK, "Open dump file failed")
+			return
+		}
+		defer reader.Close()
+		ctx.Header("Vary", "Accept-Encoding")
+		ctx.DataFromReader(http.StatusOK, size, "application/octet-stream", reader, map[string]string{"Content-Encoding": method})
+		return
+	}
+	reader, err := dumps.Open(dump)
+	if err != nil {
+		logrus.Warnf("Open dump file '%s' failed: %v", dumps.Key(dump), err)
+		ctx.String(http.StatusOK, "Open dump file failed")
+		return
+	}
+	defer reader.Close()
+	ctx.DataFromReader(http.StatusOK, -1, "application/octet-stream", reader, nil)
+}
+
+// deleteDump 删除dump，需要在dump所属的程序上是admin，完成后回到分组页面
+func (svr *Server) deleteDump(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		ctx.String(http.StatusOK, err.Error())
+		return
+	}
+	dump, err := db.QueryDump(id)
+	if err != nil {
+		msg := fmt.Sprintf("Query dump with id '%d' failed", id)
+		logrus.Warn(msg)
+		ctx.String(http.StatusOK, msg)
+		return
+	}
+	if !require(ctx, dump.Program, db.RoleAdmin) {
+		return
+	}
+	if err := retention.Delete(dump, fmt.Sprintf("deleted by %s", actor(ctx))); err != nil {
+		ctx.String(http.StatusOK, "Delete dump internal error")
+		return
+	}
+	if dump.GroupID != 0 {
+		ctx.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/group/%d", conf.Xml.Net.Prefix, dump.GroupID))
+	} else {
+		ctx.Redirect(http.StatusSeeOther, conf.Xml.Net.Prefix+"/list/0")
+	}
+}
+
+func acceptsEncoding(header string, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(name), encoding) && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// allowUpload 开启了上传密钥时校验请求的上传令牌或密钥，不能上传时写好响应并返回false。
+// 上传令牌只能上传dump，校验过的客户端证书只能代替密钥上传符号，what是日志和响应里的操作名
+func allowUpload(ctx *gin.Context, program string, version string, permission string, what string) bool {
+	if !auth.UploadKeysEnabled() {
+		return true
+	}
+	if state := ctx.Request.TLS; state != nil && len(state.VerifiedChains) > 0 && permission == db.UploadSymbol {
+		logrus.Debugf("%s of '%s' by client certificate '%s'", what, program, state.VerifiedChains[0][0].Subject.CommonName)
+		return true
+	}
+	token := ctx.GetHeader(auth.UploadTokenHeader)
+	if token == "" {
+		token = ctx.PostForm(auth.UploadTokenField)
+	}
+	if token != "" && permission == db.UploadDump {
+		err := auth.VerifyUploadToken(token, program, version)
+		if err == nil {
+			return true
+		}
+		logrus.Warnf("%s of '%s' %s failed from %s: %v", what, program, version, ctx.ClientIP(), err)
+		if errors.Is(err, auth.ErrTokenMismatch) {
+			ctx.String(http.StatusForbidden, fmt.Sprintf("%s failed: %v", what, err))
+		} else {
+			ctx.String(http.StatusUnauthorized, fmt.Sprintf("%s failed: %v", what, err))
+		}
+		return false
+	}
+	secret := ctx.GetHeader(auth.UploadKeyHeader)
+	if secret == "" {
+		secret = ctx.PostForm(auth.UploadKeyField)
+	}
+	key, err := auth.CheckUploadKey(secret, program, permission)
+	if err == nil {
+		return true
+	}
+	switch {
+	case errors.Is(err, auth.ErrUploadDenied):
+		logrus.Warnf("%s failed: key '%s' may not upload %s of '%s'", what, key.Name, permission, program)
+		ctx.String(http.StatusForbidden, fmt.Sprintf("%s failed: %v", what, err))
+	case errors.Is(err, auth.ErrNoUploadKey), errors.Is(err, auth.ErrInvalidUploadKey):
+		logrus.Warnf("%s failed from %s: %v", what, ctx.ClientIP(), err)
+		ctx.String(http.StatusUnauthorized, fmt.Sprintf("%s failed: %v", what, err))
+	default:
+		ctx.String(http.StatusOK, "Query API key from database failed")
+	}
+	return false
+}
+
 func (svr *Server) uploadDump(ctx *gin.Context) {
 	OS := ctx.PostForm("os")
 	buildTime := ctx.PostForm("build")
@@ -228,6 +571,22 @@ func (svr *Server) uploadDump(ctx *gin.Context) {
 		ctx.String(http.StatusOK, "Upload dump failed: invalid parameters")
 		return
 	}
+	if !allowUpload(ctx, programName, version, db.UploadDump, "Upload dump") {
+		return
+	}
+	crashTime, err := clock.Parse(ctx.PostForm("crash_time"))
+	if err != nil {
+		logrus.Warnf("Upload dump failed: parse 'crash_time': %v", err)
+		ctx.String(http.StatusOK, "Upload dump failed: invalid parameters")
+		return
+	}
+	clientTime, err := clock.Parse(ctx.PostForm("client_time"))
+	if err != nil {
+		logrus.Warnf("Upload dump failed: parse 'client_time': %v", err)
+		ctx.String(http.StatusOK, "Upload dump failed: invalid parameters")
+		return
+	}
+	received := time.Now()
 	file, err := ctx.FormFile("file")
 	if err != nil {
 		msg := fmt.Sprintf("Upload dump failed: %v", err)
@@ -235,30 +594,194 @@ func (svr *Server) uploadDump(ctx *gin.Context) {
 		ctx.String(http.StatusOK, msg)
 		return
 	}
-	fullpath := path.Join(conf.Xml.DumpPath, programName, version, file.Filename)
-	err = ctx.SaveUploadedFile(file, fullpath)
+	src, err := file.Open()
 	if err != nil {
-		logrus.Warnf("Save dump file to disk failed: %v", err)
+		logrus.Warnf("Open uploaded dump '%s' failed: %v", file.Filename, err)
 		ctx.String(http.StatusOK, "Save dump file to disk failed")
 		return
 	}
-	err = db.AddDump(OS, programName, version, file.Filename, buildTime)
+	defer src.Close()
+	md, err := minidump.Parse(src)
+	if err != nil {
+		logrus.Warnf("Parse uploaded dump '%s' failed: %v", file.Filename, err)
+	} else if crashTime.IsZero() {
+		crashTime = md.Time
+	}
+	hash, method, size, err := dumps.Save(src)
 	if err != nil {
+		logrus.Warnf("Save dump file to disk failed: %v", err)
+		ctx.String(http.StatusOK, "Save dump file to disk failed")
+		return
+	}
+	crash := clock.Resolve(received, crashTime, clientTime)
+	if crash.Skewed {
+		logrus.Infof("Upload dump: %s has skewed client clock, skew:%ds, reported crash time:%v", file.Filename, crash.Skew, crashTime)
+	}
+	dump := &db.Dump{
+		OS:       OS,
+		Program:  programName,
+		Version:  version,
+		Filename: file.Filename,
+		Build:    buildTime,
+		Size:     size,
+		Compress: method,
+		Hash:     hash,
+
+		CrashTime:   crash.Time,
+		ClockSkew:   crash.Skew,
+		ClockSkewed: crash.Skewed,
+
+		InstallHash: usage.HashInstall(ctx.PostForm("install_id")),
+	}
+	if md != nil {
+		dump.OSVersion = md.OSVersion
+		dump.CPU = md.CPU
+	}
+	if err = db.AddDump(dump); err == db.ErrDuplicateDump {
+		original, err := db.QueryDumpByHash(programName, hash)
+		if err != nil || original == nil {
+			ctx.String(http.StatusOK, "Query meta info from database failed")
+			return
+		}
+		if original.Compress != method {
+			dumps.Discard(hash, method)
+		}
+		db.AddDuplicate(original.ID)
+		logrus.Infof("Upload dump: %s is a duplicate of dump %d, program:%s, version:%s", file.Filename, original.ID, programName, version)
+		ctx.String(http.StatusOK, "Success")
+		return
+	} else if err != nil {
 		ctx.String(http.StatusOK, "Add meta info to database failed")
 		return
 	}
-	logrus.Printf("Upload dump: %s, size: %d, program:%s, version:%s, build time:%s", file.Filename, file.Size, programName, version, buildTime)
+	if md != nil {
+		modules := make([]db.DumpModule, 0, len(md.Modules))
+		for _, m := range md.Modules {
+			if m.DebugFile != "" && m.DebugID != "" {
+				modules = append(modules, db.DumpModule{DebugFile: m.DebugFile, DebugID: m.DebugID})
+			}
+		}
+		db.AddDumpModules(dump.ID, modules)
+	}
+	processor.Enqueue(dump.ID)
+	logrus.Printf("Upload dump: %s, size: %d, stored: %d, program:%s, version:%s, build time:%s", file.Filename, file.Size, size, programName, version, buildTime)
+	ctx.String(http.StatusOK, "Success")
+}
+
+// pingForm 是使用上报的参数，可以用表单或JSON提交，Sessions为0时按1次会话计算
+type pingForm struct {
+	Program   string `form:"program" json:"program"`
+	Version   string `form:"version" json:"version"`
+	InstallID string `form:"install_id" json:"install_id"`
+	Sessions  int64  `form:"sessions" json:"sessions"`
+}
+
+func (svr *Server) ping(ctx *gin.Context) {
+	form := pingForm{}
+	if err := ctx.ShouldBind(&form); err != nil || form.Program == "" || form.Version == "" ||
+		form.Sessions < 0 || form.Sessions > usage.MaxSessions {
+		logrus.Warn("Usage ping failed: invalid parameters")
+		ctx.String(http.StatusOK, "Usage ping failed: invalid parameters")
+		return
+	}
+	if !allowUpload(ctx, form.Program, form.Version, db.UploadDump, "Usage ping") {
+		return
+	}
+	if form.Sessions == 0 {
+		form.Sessions = 1
+	}
+	if err := usage.Record(form.Program, form.Version, form.InstallID, form.Sessions); err != nil {
+		ctx.String(http.StatusOK, "Add usage to database failed")
+		return
+	}
 	ctx.String(http.StatusOK, "Success")
 }
 
+// tokenForm 是领取上传令牌的参数，Hours只在带了API密钥时有效，为0时按握手令牌的有效时间
+type tokenForm struct {
+	Program string `form:"program" json:"program"`
+	Version string `form:"version" json:"version"`
+	Hours   int    `form:"hours" json:"hours"`
+}
+
+// uploadToken 签发上传令牌。带了能上传程序dump的API密钥时可以领取长期的令牌打包进发布的程序，
+// 否则要开启握手，而且只给上传过符号的版本签发
+func (svr *Server) uploadToken(ctx *gin.Context) {
+	if !auth.UploadTokensEnabled() {
+		ctx.String(http.StatusNotFound, "Upload tokens are not configured")
+		return
+	}
+	form := tokenForm{}
+	if err := ctx.ShouldBind(&form); err != nil || form.Program == "" || form.Version == "" || form.Hours < 0 {
+		logrus.Warn("Issue upload token failed: invalid parameters")
+		ctx.String(http.StatusBadRequest, "Issue upload token failed: invalid parameters")
+		return
+	}
+	ttl := auth.HandshakeTTL()
+	secret := ctx.GetHeader(auth.UploadKeyHeader)
+	if secret == "" {
+		secret = ctx.PostForm(auth.UploadKeyField)
+	}
+	if secret != "" {
+		if !allowUpload(ctx, form.Program, form.Version, db.UploadDump, "Issue upload token") {
+			return
+		}
+		if form.Hours > 0 {
+			ttl = time.Duration(form.Hours) * time.Hour
+		}
+		if ttl > auth.MaxBuildTTL() {
+			ttl = auth.MaxBuildTTL()
+		}
+	} else {
+		if !conf.Xml.Auth.Upload.Token.Handshake {
+			ctx.String(http.StatusUnauthorized, "Issue upload token failed: missing API key")
+			return
+		}
+		known, err := db.HasReleaseSymbols(form.Program, form.Version)
+		if err != nil {
+			ctx.String(http.StatusOK, "Query symbols from database failed")
+			return
+		}
+		if !known {
+			logrus.Warnf("Refused upload token for unknown release '%s' %s from %s", form.Program, form.Version, ctx.ClientIP())
+			ctx.String(http.StatusForbidden, "Issue upload token failed: unknown program version")
+			return
+		}
+	}
+	token, expires, err := auth.IssueUploadToken(form.Program, form.Version, ttl)
+	if err != nil {
+		ctx.String(http.StatusOK, fmt.Sprintf("Issue upload token failed: %v", err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"token": token, "expires_at": expires})
+}
+
 func (svr *Server) uploadSymbol(ctx *gin.Context) {
 	entry := ctx.PostForm("entry")
 	id := ctx.PostForm("id")
+	programName := ctx.PostForm("program")
+	version := ctx.PostForm("version")
 	if entry == "" || id == "" {
 		logrus.Errorf("Upload symbol file failed: invalid parameters")
 		ctx.String(http.StatusOK, "Upload file symbol failed: invalid parameters")
 		return
 	}
+	if !allowUpload(ctx, programName, version, db.UploadSymbol, "Upload symbol file") {
+		return
+	}
+	if auth.UploadKeysEnabled() {
+		// 同一个entry/id的符号只存一份，覆盖它需要能给所有上传过它的程序上传符号，包括没有记录程序的旧符号
+		owners, err := db.QuerySymbolOwners(entry, id)
+		if err != nil {
+			ctx.String(http.StatusOK, "Query meta info from database failed")
+			return
+		}
+		for _, owner := range owners {
+			if owner != programName && !allowUpload(ctx, owner, version, db.UploadSymbol, "Upload symbol file") {
+				return
+			}
+		}
+	}
 	file, err := ctx.FormFile("file")
 	if err != nil {
 		msg := fmt.Sprintf("Upload symbol file failed: %v", err)
@@ -266,13 +789,20 @@ func (svr *Server) uploadSymbol(ctx *gin.Context) {
 		ctx.String(http.StatusOK, msg)
 		return
 	}
-	fullpath := path.Join(conf.Xml.SymbolPath, entry, id, file.Filename)
-	err = ctx.SaveUploadedFile(file, fullpath)
+	src, err := file.Open()
+	if err != nil {
+		logrus.Errorf("Open uploaded symbol file '%s' failed with: %v", file.Filename, err)
+		ctx.String(http.StatusOK, "Save file failed")
+		return
+	}
+	defer src.Close()
+	fullpath, err := symbols.Save(entry, id, file.Filename, src)
 	if err != nil {
-		logrus.Errorf("Save uploaded symbol file '%s' to '%s' failed with: %v", file.Filename, fullpath, err)
+		logrus.Errorf("Save uploaded symbol file '%s' failed with: %v", file.Filename, err)
 		ctx.String(http.StatusOK, "Save file failed")
 	} else {
 		logrus.Infof("Saved uploaded symbol file '%s' to '%s'", file.Filename, fullpath)
+		db.AddSymbol(entry, id, file.Filename, programName, version)
 		ctx.String(http.StatusOK, "Success")
 	}
 }
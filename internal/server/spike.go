@@ -0,0 +1,185 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"bp-server/internal/db"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const alertListTemplate = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>Spike Alerts</title>
+		<style>
+			th, td {
+				padding: 10px;
+			}
+		</style>
+	</head>
+	<body>
+		<a href="{{ prefix }}/groups/0">Crash Groups</a>
+		<a href="{{ prefix }}/stats">Statistics</a>
+		<form method="GET">
+			Program <input type="text" name="program" value="{{ .Filter.Program }}">
+			<input type="submit" value="Filter">
+		</form>
+		<table>
+			<thead>
+				<tr>
+					<th>Day</th>
+					<th>Program</th>
+					<th>Spike</th>
+					<th>Crashes</th>
+					<th>Baseline</th>
+					<th>Score</th>
+					<th>Detected</th>
+				</tr>
+			</thead>
+		<tbody>
+		{{range .Alerts }}
+			<tr>
+				<td>{{ .Day }}</td>
+				<td>{{ .Program }}</td>
+				{{ if eq .Kind "group" -}}
+				<td><a href="{{ prefix }}/group/ {{- .GroupID -}} ">Group {{ .GroupID }}</a></td>
+				{{- else -}}
+				<td>Version {{ .Version }}</td>
+				{{- end }}
+				<td>{{ .Count }}</td>
+				<td>{{ printf "%.1f" .Baseline }} &plusmn; {{ printf "%.1f" .StdDev }}</td>
+				<td>{{ printf "%.1f" .Score }}</td>
+				<td>{{ datetime .CreatedAt }}</td>
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+		{{ if gt .Page 0 }}<a href="{{ prefix }}/alerts/ {{- .Prev -}} ? {{- .Query }}">Previous</a>{{ end }}
+		<a href="{{ prefix }}/alerts/ {{- .Next -}} ? {{- .Query }}">Next</a>
+	</body>
+</html>`
+
+// groupAlertsLimit 是分组页面上显示的突增记录数量
+const groupAlertsLimit = 10
+
+type alertListPage struct {
+	Alerts []db.SpikeAlert
+	Filter db.SpikeFilter
+	Page   int
+	Query  template.URL
+}
+
+func (p *alertListPage) Prev() int { return p.Page - 1 }
+func (p *alertListPage) Next() int { return p.Page + 1 }
+
+// parseSpikeFilter 解析program和group参数
+func parseSpikeFilter(ctx *gin.Context) db.SpikeFilter {
+	filter := db.SpikeFilter{Program: ctx.Query("program"), Programs: visiblePrograms(ctx)}
+	if id, err := strconv.ParseUint(ctx.Query("group"), 10, 32); err == nil {
+		filter.GroupID = uint(id)
+	}
+	return filter
+}
+
+func (svr *Server) alertList(ctx *gin.Context) {
+	page, err := strconv.Atoi(ctx.Param("page"))
+	if err != nil {
+		logrus.Warnf("/alerts/:page: parse 'page' failed: %v", err)
+		ctx.String(http.StatusOK, "Parse GET parameter 'page' as integer failed")
+		return
+	}
+	if page < 0 {
+		page = 0
+	}
+	data := &alertListPage{
+		Filter: parseSpikeFilter(ctx),
+		Page:   page,
+		Query:  template.URL(ctx.Request.URL.Query().Encode()),
+	}
+	if data.Alerts, err = db.QuerySpikeAlerts(page, data.Filter); err != nil {
+		ctx.String(http.StatusOK, "Query spike alerts internal error")
+		return
+	}
+	ctx.Status(http.StatusOK)
+	svr.alertListTpl.Execute(ctx.Writer, data)
+}
+
+type alertJSON struct {
+	ID        uint      `json:"id"`
+	Day       string    `json:"day"`
+	Kind      string    `json:"kind"`
+	Program   string    `json:"program"`
+	Version   string    `json:"version,omitempty"`
+	GroupID   uint      `json:"group_id,omitempty"`
+	Count     int64     `json:"count"`
+	Baseline  float64   `json:"baseline"`
+	StdDev    float64   `json:"stddev"`
+	Score     float64   `json:"score"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (svr *Server) apiAlertList(ctx *gin.Context) {
+	page, err := strconv.Atoi(ctx.Param("page"))
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, "parse parameter 'page' as integer failed")
+		return
+	}
+	alerts, err := db.QuerySpikeAlerts(page, parseSpikeFilter(ctx))
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query spike alerts failed")
+		return
+	}
+	result := make([]alertJSON, 0, len(alerts))
+	for _, a := range alerts {
+		result = append(result, alertJSON{
+			ID:        a.ID,
+			Day:       a.Day,
+			Kind:      a.Kind,
+			Program:   a.Program,
+			Version:   a.Version,
+			GroupID:   a.GroupID,
+			Count:     a.Count,
+			Baseline:  a.Baseline,
+			StdDev:    a.StdDev,
+			Score:     a.Score,
+			CreatedAt: a.CreatedAt,
+		})
+	}
+	ctx.JSON(http.StatusOK, result)
+}
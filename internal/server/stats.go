@@ -0,0 +1,454 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"bp-server/internal/chart"
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/stats"
+	"bp-server/internal/usage"
+	"bp-server/internal/version"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const statsTemplate = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>Crash Statistics</title>
+	</head>
+	<body>
+		<a href="{{ prefix }}/list/0">Dumps</a>
+		<a href="{{ prefix }}/groups/0">Crash Groups</a>
+		<a href="{{ prefix }}/alerts/0">Spike Alerts</a>
+		<form method="GET">
+			<select name="program" onchange="this.form.version.value=''; this.form.submit()">
+				{{- range .Programs }}
+				<option value="{{ . }}" {{- if eq . $.Filter.Program }} selected {{- end }}>{{ . }}</option>
+				{{- end }}
+			</select>
+			<select name="version">
+				<option value="">All versions</option>
+				{{- range .Versions }}
+				<option value="{{ . }}" {{- if eq . $.Filter.Version }} selected {{- end }}>{{ . }}</option>
+				{{- end }}
+			</select>
+			Last <input type="number" name="days" min="1" max="{{ .MaxDays }}" value="{{ .Days }}"> days
+			<input type="submit" value="Show">
+		</form>
+		<h3>Crashes per day</h3>
+		{{ .Daily }}
+		<h3>Release health</h3>
+		<table>
+			<thead>
+				<tr>
+					<th>Version</th>
+					<th>Crashes</th>
+					<th>Sessions</th>
+					<th>Crash-free sessions</th>
+					<th>Crashed users</th>
+					<th>Users</th>
+					<th>Crash-free users</th>
+				</tr>
+			</thead>
+			<tbody>
+			{{- range .Releases }}
+				<tr>
+					<td>{{ .Version }}</td>
+					<td>{{ .Crashes }}</td>
+					<td>{{ .Sessions }}</td>
+					<td>{{ rate .CrashFreeSessions }}</td>
+					<td>{{ .CrashedUsers }}</td>
+					<td>{{ .Users }}</td>
+					<td>{{ rate .CrashFreeUsers }}</td>
+				</tr>
+			{{- end }}
+			</tbody>
+		</table>
+		<h3>Top crash groups {{- with .Filter.Version }} in {{ . }}{{ end }}</h3>
+		{{ .TopGroups }}
+		<h3>OS versions</h3>
+		{{ .OSVersions }}
+		<h3>CPU</h3>
+		{{ .CPUs }}
+	</body>
+</html>`
+
+const (
+	defaultStatDays = 30
+	maxStatDays     = 366
+	// maxDailySeries 是每日图表里单独显示的版本数，其余版本合并为other
+	maxDailySeries = 8
+	topGroupsLimit = 20
+	// distributionLimit 是分布图里显示的项目数
+	distributionLimit = 15
+)
+
+type statsPage struct {
+	Programs   []string
+	Versions   []string
+	Filter     db.StatFilter
+	Days       int
+	MaxDays    int
+	Daily      template.HTML
+	Releases   []release
+	TopGroups  template.HTML
+	OSVersions template.HTML
+	CPUs       template.HTML
+}
+
+// statsData 是统计页面和API共用的数据
+type statsData struct {
+	Filter     db.StatFilter
+	Days       []string
+	Daily      []chart.Series
+	Releases   []release
+	TopGroups  []groupCount
+	OSVersions []db.StatCount
+	CPUs       []db.StatCount
+}
+
+// release 是一个版本的健康情况，无崩溃比例为负数表示没有使用上报
+type release struct {
+	db.ReleaseHealth
+	CrashFreeSessions float64
+	CrashFreeUsers    float64
+}
+
+type groupCount struct {
+	Group *db.CrashGroup
+	Count int64
+}
+
+// statPrograms 返回用户能查看的有统计的程序
+func statPrograms(ctx *gin.Context) ([]string, error) {
+	programs, err := db.QueryStatPrograms()
+	if err != nil {
+		return nil, err
+	}
+	visible := make([]string, 0, len(programs))
+	for _, program := range programs {
+		if allowed(ctx, program, db.RoleViewer) {
+			visible = append(visible, program)
+		}
+	}
+	return visible, nil
+}
+
+// parseStatFilter 解析program、version和days参数，没有指定program时使用第一个程序
+func parseStatFilter(ctx *gin.Context, programs []string) (db.StatFilter, []string, error) {
+	days := defaultStatDays
+	if value := ctx.Query("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxStatDays {
+			return db.StatFilter{}, nil, fmt.Errorf("'days' must be between 1 and %d", maxStatDays)
+		}
+		days = n
+	}
+	filter := db.StatFilter{Program: ctx.Query("program"), Version: ctx.Query("version")}
+	if filter.Program == "" && len(programs) > 0 {
+		filter.Program = programs[0]
+	}
+	now := time.Now()
+	labels := make([]string, 0, days)
+	for i := days - 1; i >= 0; i-- {
+		labels = append(labels, stats.Day(now.AddDate(0, 0, -i)))
+	}
+	filter.From, filter.To = labels[0], labels[len(labels)-1]
+	return filter, labels, nil
+}
+
+func queryStats(filter db.StatFilter, days []string) (*statsData, error) {
+	data := &statsData{Filter: filter, Days: days}
+	daily, err := db.QueryDailyStats(filter)
+	if err != nil {
+		return nil, err
+	}
+	data.Daily = dailySeries(days, daily)
+	if data.Releases, err = queryReleases(filter); err != nil {
+		return nil, err
+	}
+	counts, err := db.QueryStatDistribution(filter, "group_id", topGroupsLimit)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range counts {
+		id, _ := strconv.ParseUint(c.Key, 10, 32)
+		group, err := db.QueryGroup(uint(id))
+		if err != nil {
+			continue
+		}
+		data.TopGroups = append(data.TopGroups, groupCount{Group: group, Count: c.Count})
+	}
+	if data.OSVersions, err = db.QueryStatDistribution(filter, "os_version", distributionLimit); err != nil {
+		return nil, err
+	}
+	if data.CPUs, err = db.QueryStatDistribution(filter, "cpu", distributionLimit); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// queryReleases 返回filter范围内每个版本的健康情况，版本从新到旧排列
+func queryReleases(filter db.StatFilter) ([]release, error) {
+	health, err := db.QueryReleaseHealth(filter)
+	if err != nil {
+		return nil, err
+	}
+	releases := make([]release, 0, len(health))
+	for _, h := range health {
+		releases = append(releases, release{
+			ReleaseHealth:     h,
+			CrashFreeSessions: usage.Rate(h.Crashes, h.Sessions),
+			CrashFreeUsers:    usage.Rate(h.CrashedUsers, h.Users),
+		})
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		return version.Compare(releases[i].Version, releases[j].Version) > 0
+	})
+	return releases, nil
+}
+
+// dailySeries 把每天每个版本的数量转成按版本的序列，数量最多的几个版本单独显示
+func dailySeries(days []string, counts []db.StatCount) []chart.Series {
+	index := make(map[string]int, len(days))
+	for i, day := range days {
+		index[day] = i
+	}
+	totals := map[string]int64{}
+	for _, c := range counts {
+		totals[c.Key] += c.Count
+	}
+	versions := make([]string, 0, len(totals))
+	for v := range totals {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if totals[versions[i]] != totals[versions[j]] {
+			return totals[versions[i]] > totals[versions[j]]
+		}
+		return version.Compare(versions[i], versions[j]) > 0
+	})
+	seriesIndex := map[string]int{}
+	var series []chart.Series
+	for i, v := range versions {
+		if i == maxDailySeries {
+			series = append(series, chart.Series{Name: "other", Values: make([]int64, len(days))})
+			break
+		}
+		seriesIndex[v] = i
+		series = append(series, chart.Series{Name: v, Values: make([]int64, len(days))})
+	}
+	for _, c := range counts {
+		day, ok := index[c.Day]
+		if !ok {
+			continue
+		}
+		s, ok := seriesIndex[c.Key]
+		if !ok {
+			s = maxDailySeries
+		}
+		series[s].Values[day] += c.Count
+	}
+	return series
+}
+
+func distributionBars(counts []db.StatCount) []chart.Bar {
+	bars := make([]chart.Bar, 0, len(counts))
+	for _, c := range counts {
+		label := c.Key
+		if label == "" {
+			label = "unknown"
+		}
+		bars = append(bars, chart.Bar{Label: label, Value: c.Count})
+	}
+	return bars
+}
+
+func (svr *Server) stats(ctx *gin.Context) {
+	programs, err := statPrograms(ctx)
+	if err != nil {
+		ctx.String(http.StatusOK, "Query crash statistics internal error")
+		return
+	}
+	filter, days, err := parseStatFilter(ctx, programs)
+	if err != nil {
+		ctx.String(http.StatusOK, err.Error())
+		return
+	}
+	if !require(ctx, filter.Program, db.RoleViewer) {
+		return
+	}
+	versions, err := db.QueryStatVersions(filter.Program)
+	if err != nil {
+		ctx.String(http.StatusOK, "Query crash statistics internal error")
+		return
+	}
+	sort.Slice(versions, func(i, j int) bool { return version.Compare(versions[i], versions[j]) > 0 })
+	data, err := queryStats(filter, days)
+	if err != nil {
+		ctx.String(http.StatusOK, "Query crash statistics internal error")
+		return
+	}
+	groups := make([]chart.Bar, 0, len(data.TopGroups))
+	for _, g := range data.TopGroups {
+		groups = append(groups, chart.Bar{
+			Label: fmt.Sprintf("#%d %s", g.Group.ID, g.Group.Signature),
+			Value: g.Count,
+			Link:  fmt.Sprintf("%s/group/%d", conf.Xml.Net.Prefix, g.Group.ID),
+		})
+	}
+	page := &statsPage{
+		Programs:   programs,
+		Versions:   versions,
+		Filter:     filter,
+		Days:       len(days),
+		MaxDays:    maxStatDays,
+		Daily:      chart.StackedBars(days, data.Daily),
+		Releases:   data.Releases,
+		TopGroups:  chart.HorizontalBars(groups),
+		OSVersions: chart.HorizontalBars(distributionBars(data.OSVersions)),
+		CPUs:       chart.HorizontalBars(distributionBars(data.CPUs)),
+	}
+	ctx.Status(http.StatusOK)
+	svr.statsTpl.Execute(ctx.Writer, page)
+}
+
+type statCountJSON struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// seriesJSON 的Counts和statsJSON的Days一一对应
+type seriesJSON struct {
+	Version string  `json:"version"`
+	Counts  []int64 `json:"counts"`
+}
+
+// releaseJSON 的无崩溃比例在没有使用上报时为null
+type releaseJSON struct {
+	Version           string   `json:"version"`
+	Crashes           int64    `json:"crashes"`
+	Sessions          int64    `json:"sessions"`
+	CrashFreeSessions *float64 `json:"crash_free_sessions"`
+	CrashedUsers      int64    `json:"crashed_users"`
+	Users             int64    `json:"users"`
+	CrashFreeUsers    *float64 `json:"crash_free_users"`
+}
+
+func optionalRate(rate float64) *float64 {
+	if rate < 0 {
+		return nil
+	}
+	return &rate
+}
+
+type topGroupJSON struct {
+	Count int64     `json:"count"`
+	Group groupJSON `json:"group"`
+}
+
+type statsJSON struct {
+	Program    string          `json:"program"`
+	Version    string          `json:"version,omitempty"`
+	Days       []string        `json:"days"`
+	Daily      []seriesJSON    `json:"daily"`
+	Releases   []releaseJSON   `json:"releases"`
+	TopGroups  []topGroupJSON  `json:"top_groups"`
+	OSVersions []statCountJSON `json:"os_versions"`
+	CPUs       []statCountJSON `json:"cpus"`
+}
+
+func toStatCountJSON(counts []db.StatCount) []statCountJSON {
+	result := make([]statCountJSON, 0, len(counts))
+	for _, c := range counts {
+		result = append(result, statCountJSON{Key: c.Key, Count: c.Count})
+	}
+	return result
+}
+
+func (svr *Server) apiStats(ctx *gin.Context) {
+	programs, err := statPrograms(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query crash statistics failed")
+		return
+	}
+	filter, days, err := parseStatFilter(ctx, programs)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !require(ctx, filter.Program, db.RoleViewer) {
+		return
+	}
+	data, err := queryStats(filter, days)
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query crash statistics failed")
+		return
+	}
+	result := statsJSON{
+		Program:    filter.Program,
+		Version:    filter.Version,
+		Days:       days,
+		Daily:      make([]seriesJSON, 0, len(data.Daily)),
+		Releases:   make([]releaseJSON, 0, len(data.Releases)),
+		TopGroups:  make([]topGroupJSON, 0, len(data.TopGroups)),
+		OSVersions: toStatCountJSON(data.OSVersions),
+		CPUs:       toStatCountJSON(data.CPUs),
+	}
+	for _, s := range data.Daily {
+		result.Daily = append(result.Daily, seriesJSON{Version: s.Name, Counts: s.Values})
+	}
+	for _, r := range data.Releases {
+		result.Releases = append(result.Releases, releaseJSON{
+			Version:           r.Version,
+			Crashes:           r.Crashes,
+			Sessions:          r.Sessions,
+			CrashFreeSessions: optionalRate(r.CrashFreeSessions),
+			CrashedUsers:      r.CrashedUsers,
+			Users:             r.Users,
+			CrashFreeUsers:    optionalRate(r.CrashFreeUsers),
+		})
+	}
+	for _, g := range data.TopGroups {
+		result.TopGroups = append(result.TopGroups, topGroupJSON{Count: g.Count, Group: toGroupJSON(g.Group)})
+	}
+	ctx.JSON(http.StatusOK, result)
+}
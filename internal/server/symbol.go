@@ -0,0 +1,225 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/symbols"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const symbolListTemplate = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>Symbols</title>
+		<style>
+			th, td {
+				padding: 10px;
+			}
+			.error {
+				color: #b00000;
+			}
+		</style>
+	</head>
+	<body>
+		<a href="{{ prefix }}/list/0">Dumps</a>
+		<a href="{{ prefix }}/groups/0">Crash Groups</a>
+		<form method="GET">
+			Program <input type="text" name="program" value="{{ .Filter.Program }}">
+			Entry <input type="text" name="entry" value="{{ .Filter.Entry }}">
+			<input type="submit" value="Filter">
+		</form>
+		{{ with .Error }}<p class="error">{{ . }}</p>{{ end }}
+		<table>
+			<thead>
+				<tr>
+					<th>Entry</th>
+					<th>Debug ID</th>
+					<th>File</th>
+					<th>Program</th>
+					<th>Version</th>
+					<th>Uploaded</th>
+					<th></th>
+				</tr>
+			</thead>
+		<tbody>
+		{{range .Symbols }}
+			<tr>
+				<td>{{ .Entry }}</td>
+				<td>{{ .DebugID }}</td>
+				<td>{{ .Filename }}</td>
+				<td>{{ .Program }}</td>
+				<td>{{ .Version }}</td>
+				<td>{{ datetime .CreatedAt }}</td>
+				<td>{{ if call $.CanDelete .Program }}<form method="POST" action="{{ prefix }}/symbol/ {{- pathEscape .Entry -}} / {{- pathEscape .DebugID -}} /delete"><input type="hidden" name="csrf_token" value="{{ $.CSRF }}"><input type="submit" value="Delete"></form>{{ end }}</td>
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+		{{ if gt .Page 0 }}<a href="{{ prefix }}/symbols/ {{- .Prev -}} ? {{- .Query }}">Previous</a>{{ end }}
+		<a href="{{ prefix }}/symbols/ {{- .Next -}} ? {{- .Query }}">Next</a>
+	</body>
+</html>`
+
+type symbolListPage struct {
+	Symbols   []db.Symbol
+	Filter    db.SymbolFilter
+	Page      int
+	Query     template.URL
+	CSRF      string
+	Error     string
+	CanDelete func(program string) bool
+}
+
+func (p *symbolListPage) Prev() int { return p.Page - 1 }
+func (p *symbolListPage) Next() int { return p.Page + 1 }
+
+func parseSymbolFilter(ctx *gin.Context) db.SymbolFilter {
+	return db.SymbolFilter{Program: ctx.Query("program"), Entry: ctx.Query("entry"), Programs: visiblePrograms(ctx)}
+}
+
+func (svr *Server) symbolList(ctx *gin.Context) {
+	page, err := strconv.Atoi(ctx.Param("page"))
+	if err != nil {
+		logrus.Warnf("/symbols/:page: parse 'page' failed: %v", err)
+		ctx.String(http.StatusOK, "Parse GET parameter 'page' as integer failed")
+		return
+	}
+	if page < 0 {
+		page = 0
+	}
+	data := &symbolListPage{
+		Filter: parseSymbolFilter(ctx),
+		Page:   page,
+		Query:  template.URL(ctx.Request.URL.Query().Encode()),
+		CSRF:   csrfToken(ctx),
+		Error:  ctx.Query("error"),
+		CanDelete: func(program string) bool {
+			return allowed(ctx, program, db.RoleAdmin)
+		},
+	}
+	if data.Symbols, err = db.QuerySymbolList(page, data.Filter); err != nil {
+		ctx.String(http.StatusOK, "Query symbols internal error")
+		return
+	}
+	ctx.Status(http.StatusOK)
+	svr.symbolListTpl.Execute(ctx.Writer, data)
+}
+
+// deleteSymbol 删除 <entry>/<id> 的符号，用户必须在上传过它的所有程序上都是admin
+func deleteSymbol(ctx *gin.Context, entry string, id string) (int64, error) {
+	owners, err := db.QuerySymbolOwners(entry, id)
+	if err != nil {
+		return 0, err
+	}
+	for _, program := range owners {
+		if !allowed(ctx, program, db.RoleAdmin) {
+			return 0, errPermission
+		}
+	}
+	if len(owners) == 0 && !allowed(ctx, "", db.RoleAdmin) {
+		return 0, errPermission
+	}
+	return symbols.Delete(entry, id, fmt.Sprintf("deleted by %s", actor(ctx)))
+}
+
+func (svr *Server) deleteSymbol(ctx *gin.Context) {
+	_, err := deleteSymbol(ctx, ctx.Param("entry"), ctx.Param("id"))
+	if err == errPermission {
+		forbid(ctx)
+		return
+	}
+	target := conf.Xml.Net.Prefix + "/symbols/0"
+	if err != nil {
+		target += "?error=" + url.QueryEscape(fmt.Sprintf("Delete failed: %v", err))
+	}
+	ctx.Redirect(http.StatusSeeOther, target)
+}
+
+type symbolJSON struct {
+	ID        uint      `json:"id"`
+	Entry     string    `json:"entry"`
+	DebugID   string    `json:"debug_id"`
+	Filename  string    `json:"filename"`
+	Program   string    `json:"program"`
+	Version   string    `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (svr *Server) apiSymbolList(ctx *gin.Context) {
+	page, err := strconv.Atoi(ctx.Param("page"))
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, "parse parameter 'page' as integer failed")
+		return
+	}
+	list, err := db.QuerySymbolList(page, parseSymbolFilter(ctx))
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query symbols failed")
+		return
+	}
+	result := make([]symbolJSON, 0, len(list))
+	for _, s := range list {
+		result = append(result, symbolJSON{
+			ID:        s.ID,
+			Entry:     s.Entry,
+			DebugID:   s.DebugID,
+			Filename:  s.Filename,
+			Program:   s.Program,
+			Version:   s.Version,
+			CreatedAt: s.CreatedAt,
+		})
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (svr *Server) apiDeleteSymbol(ctx *gin.Context) {
+	size, err := deleteSymbol(ctx, ctx.Param("entry"), ctx.Param("id"))
+	if err == errPermission {
+		forbid(ctx)
+		return
+	}
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"entry": ctx.Param("entry"), "debug_id": ctx.Param("id"), "size": size})
+}
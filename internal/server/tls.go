@@ -0,0 +1,168 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"bp-server/internal/conf"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// certCheckInterval 内不重复检查证书文件是否修改
+const certCheckInterval = 5 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader 在握手时提供证书，证书或私钥文件的修改时间变了就重新加载，加载失败时继续用旧的证书
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// load 加载证书，文件没有修改时什么也不做
+func (r *certReloader) load() error {
+	certMod, err := modTime(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyMod, err := modTime(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil {
+		logrus.Infof("Reloaded TLS certificate '%s'", r.certFile)
+	}
+	r.cert, r.certMod, r.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.checked) >= certCheckInterval {
+		r.checked = now
+		if err := r.load(); err != nil {
+			logrus.Errorf("Reload TLS certificate '%s' failed, keep using the old one: %v", r.certFile, err)
+		}
+	}
+	return r.cert, nil
+}
+
+// newTLSConfig 根据配置生成端口的TLS配置，没有配置证书时返回nil，使用HTTP
+func newTLSConfig(name string, c conf.TLSConf) (*tls.Config, error) {
+	if c.Cert == "" && c.Key == "" {
+		if c.ClientCA != "" {
+			return nil, fmt.Errorf("<%s><client_ca> needs <cert> and <key>", name)
+		}
+		return nil, nil
+	}
+	if c.Cert == "" || c.Key == "" {
+		return nil, fmt.Errorf("<%s> needs both <cert> and <key>", name)
+	}
+	reloader := &certReloader{certFile: c.Cert, keyFile: c.Key, checked: time.Now()}
+	if err := reloader.load(); err != nil {
+		return nil, fmt.Errorf("load <%s> certificate failed: %w", name, err)
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[strings.TrimSpace(c.MinVersion)]
+		if !ok {
+			return nil, fmt.Errorf("invalid <%s><min_version> '%s'", name, c.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	if c.ClientCA == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(c.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("read <%s><client_ca> failed: %w", name, err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in <%s><client_ca> '%s'", name, c.ClientCA)
+	}
+	switch strings.TrimSpace(c.ClientAuth) {
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "", "optional":
+		// 崩溃的客户端一般没有证书，默认只校验提供了的证书
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("invalid <%s><client_auth> '%s', use require or optional", name, c.ClientAuth)
+	}
+	return config, nil
+}
+
+// listen 启动端口，配置了TLS时使用HTTPS
+func listen(server *http.Server) error {
+	if server.TLSConfig == nil {
+		return server.ListenAndServe()
+	}
+	return server.ListenAndServeTLS("", "")
+}
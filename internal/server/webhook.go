@@ -0,0 +1,359 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/webhook"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const webhookListTemplate = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>Webhook Deliveries</title>
+		<style>
+			th, td {
+				padding: 10px;
+			}
+			.failed {
+				color: #b00000;
+			}
+		</style>
+	</head>
+	<body>
+		<a href="{{ prefix }}/groups/0">Crash Groups</a>
+		<form method="GET">
+			<select name="webhook">
+				<option value="">All webhooks</option>
+				{{- range .Webhooks }}
+				<option value="{{ . }}" {{- if eq . $.Webhook }} selected {{- end }}>{{ . }}</option>
+				{{- end }}
+			</select>
+			<input type="submit" value="Filter">
+		</form>
+		<table>
+			<thead>
+				<tr>
+					<th>ID</th>
+					<th>Webhook</th>
+					<th>Event</th>
+					<th>Status</th>
+					<th>Attempts</th>
+					<th>Created</th>
+					<th>Next Attempt</th>
+				</tr>
+			</thead>
+		<tbody>
+		{{range .Deliveries }}
+			<tr>
+				<td><a href="{{ prefix }}/webhook/ {{- .ID -}} ">{{ .ID }}</a></td>
+				<td>{{ .Webhook }}</td>
+				<td>{{ .Event }}</td>
+				<td {{- if eq .Status "failed" }} class="failed" {{- end }}>{{ .Status }}</td>
+				<td>{{ .Attempts }}</td>
+				<td>{{ datetime .CreatedAt }}</td>
+				<td>{{ if eq .Status "pending" }}{{ datetime .NextAttempt }}{{ end }}</td>
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+		{{ if gt .Page 0 }}<a href="{{ prefix }}/webhooks/ {{- .Prev -}} ? {{- .Query }}">Previous</a>{{ end }}
+		<a href="{{ prefix }}/webhooks/ {{- .Next -}} ? {{- .Query }}">Next</a>
+	</body>
+</html>`
+
+const webhookTemplate = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>Webhook Delivery {{ .Delivery.ID }}</title>
+		<style>
+			th, td {
+				padding: 10px;
+			}
+			.failed, .error {
+				color: #b00000;
+			}
+		</style>
+	</head>
+	<body>
+		<a href="{{ prefix }}/webhooks/0">Webhook Deliveries</a>
+		<h3>{{ .Delivery.Event }} to {{ .Delivery.Webhook }}</h3>
+		<p>
+			Status: {{ .Delivery.Status }}, {{ .Delivery.Attempts }} attempts, created {{ datetime .Delivery.CreatedAt }}
+			{{- with .Delivery.DeliveredAt }}, delivered {{ datetime . }}{{ end }}
+			{{- with .Delivery.ReplayOf }}
+			<br>Replay of <a href="{{ prefix }}/webhook/ {{- . -}} ">delivery {{ . }}</a>
+			{{- end }}
+		</p>
+		{{ with .Error }}<p class="error">{{ . }}</p>{{ end }}
+		<form method="POST" action="{{ prefix }}/webhook/ {{- .Delivery.ID -}} /replay">
+			<input type="hidden" name="csrf_token" value="{{ .CSRF }}">
+			<input type="submit" value="Replay">
+		</form>
+		<h4>Payload</h4>
+		<pre>{{ .Delivery.Payload }}</pre>
+		<h4>Attempts</h4>
+		<table>
+			<thead>
+				<tr>
+					<th>Time</th>
+					<th>Status Code</th>
+					<th>Duration</th>
+					<th>Error</th>
+					<th>Response</th>
+				</tr>
+			</thead>
+		<tbody>
+		{{range .Attempts }}
+			<tr>
+				<td>{{ datetime .CreatedAt }}</td>
+				<td>{{ if .StatusCode }}{{ .StatusCode }}{{ end }}</td>
+				<td>{{ .Duration }}ms</td>
+				<td class="failed">{{ .Error }}</td>
+				<td><pre>{{ .Response }}</pre></td>
+			</tr>
+		{{end}}
+		</tbody>
+		</table>
+	</body>
+</html>`
+
+type webhookListPage struct {
+	Deliveries []db.WebhookDelivery
+	Webhooks   []string
+	Webhook    string
+	Page       int
+	Query      template.URL
+}
+
+func (p *webhookListPage) Prev() int { return p.Page - 1 }
+func (p *webhookListPage) Next() int { return p.Page + 1 }
+
+type webhookPage struct {
+	Delivery *db.WebhookDelivery
+	Attempts []db.WebhookAttempt
+	CSRF     string
+	Error    string
+}
+
+func webhookNames() []string {
+	names := make([]string, 0, len(conf.Xml.Webhooks.Hooks))
+	for _, hook := range conf.Xml.Webhooks.Hooks {
+		names = append(names, hook.Name)
+	}
+	return names
+}
+
+func (svr *Server) webhookList(ctx *gin.Context) {
+	page, err := strconv.Atoi(ctx.Param("page"))
+	if err != nil {
+		logrus.Warnf("/webhooks/:page: parse 'page' failed: %v", err)
+		ctx.String(http.StatusOK, "Parse GET parameter 'page' as integer failed")
+		return
+	}
+	if page < 0 {
+		page = 0
+	}
+	data := &webhookListPage{
+		Webhooks: webhookNames(),
+		Webhook:  ctx.Query("webhook"),
+		Page:     page,
+		Query:    template.URL(ctx.Request.URL.Query().Encode()),
+	}
+	if data.Deliveries, err = db.QueryDeliveryList(page, data.Webhook); err != nil {
+		ctx.String(http.StatusOK, "Query webhook deliveries internal error")
+		return
+	}
+	ctx.Status(http.StatusOK)
+	svr.webhookListTpl.Execute(ctx.Writer, data)
+}
+
+func (svr *Server) renderWebhook(ctx *gin.Context, id uint, message string) {
+	delivery, err := db.QueryDelivery(id)
+	if err != nil {
+		msg := fmt.Sprintf("Query webhook delivery with id '%d' failed", id)
+		logrus.Warn(msg)
+		ctx.String(http.StatusOK, msg)
+		return
+	}
+	data := &webhookPage{Delivery: delivery, CSRF: csrfToken(ctx), Error: message}
+	if data.Attempts, err = db.QueryAttempts(id); err != nil {
+		ctx.String(http.StatusOK, "Query webhook attempts internal error")
+		return
+	}
+	ctx.Status(http.StatusOK)
+	svr.webhookTpl.Execute(ctx.Writer, data)
+}
+
+func (svr *Server) webhook(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		ctx.String(http.StatusOK, err.Error())
+		return
+	}
+	svr.renderWebhook(ctx, id, "")
+}
+
+func (svr *Server) replayWebhook(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		ctx.String(http.StatusOK, err.Error())
+		return
+	}
+	delivery, err := webhook.Replay(id)
+	if err != nil {
+		svr.renderWebhook(ctx, id, fmt.Sprintf("Replay failed: %v", err))
+		return
+	}
+	ctx.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/webhook/%d", conf.Xml.Net.Prefix, delivery.ID))
+}
+
+type attemptJSON struct {
+	StatusCode int       `json:"status_code,omitempty"`
+	Response   string    `json:"response,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Duration   int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type deliveryJSON struct {
+	ID          uint            `json:"id"`
+	Webhook     string          `json:"webhook"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt *time.Time      `json:"next_attempt,omitempty"`
+	ReplayOf    uint            `json:"replay_of,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	DeliveredAt *time.Time      `json:"delivered_at,omitempty"`
+	Log         []attemptJSON   `json:"log,omitempty"`
+}
+
+func toDeliveryJSON(delivery *db.WebhookDelivery) deliveryJSON {
+	result := deliveryJSON{
+		ID:          delivery.ID,
+		Webhook:     delivery.Webhook,
+		Event:       delivery.Event,
+		Status:      delivery.Status,
+		Attempts:    delivery.Attempts,
+		ReplayOf:    delivery.ReplayOf,
+		CreatedAt:   delivery.CreatedAt,
+		DeliveredAt: delivery.DeliveredAt,
+	}
+	if delivery.Status == db.DeliveryPending {
+		result.NextAttempt = &delivery.NextAttempt
+	}
+	return result
+}
+
+func (svr *Server) apiWebhookList(ctx *gin.Context) {
+	page, err := strconv.Atoi(ctx.Param("page"))
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, "parse parameter 'page' as integer failed")
+		return
+	}
+	deliveries, err := db.QueryDeliveryList(page, ctx.Query("webhook"))
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query webhook deliveries failed")
+		return
+	}
+	result := make([]deliveryJSON, 0, len(deliveries))
+	for i := range deliveries {
+		result = append(result, toDeliveryJSON(&deliveries[i]))
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (svr *Server) apiWebhook(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	delivery, err := db.QueryDelivery(id)
+	if err != nil {
+		apiError(ctx, http.StatusNotFound, "webhook delivery not found")
+		return
+	}
+	attempts, err := db.QueryAttempts(id)
+	if err != nil {
+		apiError(ctx, http.StatusInternalServerError, "query webhook attempts failed")
+		return
+	}
+	result := toDeliveryJSON(delivery)
+	result.Payload = json.RawMessage(delivery.Payload)
+	result.Log = make([]attemptJSON, 0, len(attempts))
+	for _, a := range attempts {
+		result.Log = append(result.Log, attemptJSON{
+			StatusCode: a.StatusCode,
+			Response:   a.Response,
+			Error:      a.Error,
+			Duration:   a.Duration,
+			CreatedAt:  a.CreatedAt,
+		})
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (svr *Server) apiReplayWebhook(ctx *gin.Context) {
+	id, err := parseGroupID(ctx)
+	if err != nil {
+		apiError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	delivery, err := webhook.Replay(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			apiError(ctx, http.StatusNotFound, "webhook delivery not found")
+		} else {
+			apiError(ctx, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, toDeliveryJSON(delivery))
+}
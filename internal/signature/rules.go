@@ -0,0 +1,216 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package signature
+
+import (
+	"bp-server/internal/conf"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxNormalizePasses 限制规范化规则的重复次数，避免替换结果一直变化的规则死循环
+const maxNormalizePasses = 16
+
+type normalizeRule struct {
+	pattern *regexp.Regexp
+	replace string
+}
+
+// Rules 是一个程序生成签名时使用的规则(Socorro风格)：
+// normalize改写函数名，irrelevant的帧被忽略，prefix的帧保留但不计入深度，
+// skip的帧是主动崩溃的辅助函数，它和它上面的帧都被忽略
+type Rules struct {
+	normalize  []normalizeRule
+	irrelevant []*regexp.Regexp
+	prefix     []*regexp.Regexp
+	skip       []*regexp.Regexp
+}
+
+var (
+	globalRules  = &Rules{}
+	programRules = map[string]*Rules{}
+)
+
+// Init 编译配置的签名规则
+func Init() {
+	rules, err := Compile(conf.Xml.Signature.SignatureRules)
+	if err != nil {
+		panic(fmt.Sprintf("config file 'signature': %v", err))
+	}
+	globalRules = rules
+	for _, program := range conf.Xml.Signature.Programs {
+		rules, err := Compile(conf.Xml.Signature.SignatureRules, program.SignatureRules)
+		if err != nil {
+			panic(fmt.Sprintf("config file 'signature', program '%s': %v", program.Name, err))
+		}
+		programRules[program.Name] = rules
+	}
+}
+
+// ForProgram 返回程序使用的规则，没有单独配置的程序使用全局规则
+func ForProgram(program string) *Rules {
+	if rules, ok := programRules[program]; ok {
+		return rules
+	}
+	return globalRules
+}
+
+// Compile 编译规则，后面的规则追加到前面的规则之后
+func Compile(sets ...conf.SignatureRules) (*Rules, error) {
+	rules := &Rules{}
+	for _, set := range sets {
+		for _, n := range set.Normalize {
+			re, err := regexp.Compile(n.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("normalize '%s': %w", n.Pattern, err)
+			}
+			rules.normalize = append(rules.normalize, normalizeRule{pattern: re, replace: n.Replace})
+		}
+		var err error
+		if rules.irrelevant, err = compileAll(rules.irrelevant, set.Irrelevant); err != nil {
+			return nil, fmt.Errorf("irrelevant %w", err)
+		}
+		if rules.prefix, err = compileAll(rules.prefix, set.Prefix); err != nil {
+			return nil, fmt.Errorf("prefix %w", err)
+		}
+		if rules.skip, err = compileAll(rules.skip, set.Skip); err != nil {
+			return nil, fmt.Errorf("skip %w", err)
+		}
+	}
+	return rules, nil
+}
+
+// compileAll 编译的表达式匹配整个字符串
+func compileAll(dst []*regexp.Regexp, patterns []string) ([]*regexp.Regexp, error) {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", pattern, err)
+		}
+		dst = append(dst, re)
+	}
+	return dst, nil
+}
+
+// Normalize 对函数名反复应用normalize规则，直到不再变化
+func (r *Rules) Normalize(function string) string {
+	for i := 0; i < maxNormalizePasses; i++ {
+		prev := function
+		for _, n := range r.normalize {
+			function = n.pattern.ReplaceAllString(function, n.replace)
+		}
+		if function == prev {
+			break
+		}
+	}
+	return strings.TrimSpace(function)
+}
+
+// matches 判断帧的函数名或模块名是否匹配规则
+func matches(list []*regexp.Regexp, module string, function string) bool {
+	for _, re := range list {
+		if re.MatchString(function) || (module != "" && re.MatchString(module)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Module 返回帧的模块名
+func Module(frame string) string {
+	if i := strings.IndexAny(frame, "!@"); i >= 0 {
+		return frame[:i]
+	}
+	return ""
+}
+
+// Generate 用栈顶的帧生成崩溃签名，depth是计入深度的帧数，小于等于0时使用全部帧。
+// 所有帧都被规则忽略时退回到只做规范化的栈顶帧
+func (r *Rules) Generate(frames []string, depth int) string {
+	if len(frames) == 0 {
+		return "EMPTY: no crashing thread"
+	}
+	if sig := r.generate(frames, depth, true); sig != "" {
+		return sig
+	}
+	return r.generate(frames, depth, false)
+}
+
+// skipHelpers 去掉最深的skip帧和它上面的所有帧
+func (r *Rules) skipHelpers(frames []string) []string {
+	for i := len(frames) - 1; i >= 0; i-- {
+		module, function := Module(frames[i]), r.Normalize(Function(frames[i]))
+		if matches(r.skip, module, function) {
+			return frames[i+1:]
+		}
+	}
+	return frames
+}
+
+// Stack 返回栈顶最多n帧规范化后的函数名，去掉了skip和irrelevant的帧，用于比较栈的相似度
+func (r *Rules) Stack(frames []string, n int) []string {
+	var stack []string
+	for _, frame := range r.skipHelpers(frames) {
+		if len(stack) >= n {
+			break
+		}
+		module, function := Module(frame), r.Normalize(Function(frame))
+		if !matches(r.irrelevant, module, function) {
+			stack = append(stack, function)
+		}
+	}
+	return stack
+}
+
+func (r *Rules) generate(frames []string, depth int, filter bool) string {
+	if filter {
+		frames = r.skipHelpers(frames)
+	}
+	var parts []string
+	counted := 0
+	for _, frame := range frames {
+		module, function := Module(frame), r.Normalize(Function(frame))
+		if filter && matches(r.irrelevant, module, function) {
+			continue
+		}
+		parts = append(parts, function)
+		if filter && matches(r.prefix, module, function) {
+			continue
+		}
+		counted++
+		if depth > 0 && counted >= depth {
+			break
+		}
+	}
+	return strings.Join(parts, " | ")
+}
@@ -0,0 +1,85 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package signature
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	crashedThread = regexp.MustCompile(`^Thread \d+ \(crashed\)`)
+	frameLine     = regexp.MustCompile(`^\s*\d+\s{2}(\S.*)$`)
+	sourceSuffix  = regexp.MustCompile(`\s+\[[^\]]*\]$`)
+	offsetSuffix  = regexp.MustCompile(`\s+\+\s+(0x[0-9a-fA-F]+)$`)
+)
+
+// Frames 从minidump_stackwalk的输出里提取崩溃线程的栈帧，
+// 每一帧规范化为 module!function 或者 module@0xoffset (没有符号时)
+func Frames(report string) []string {
+	var frames []string
+	inCrashed := false
+	for _, line := range strings.Split(report, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if !inCrashed {
+			inCrashed = crashedThread.MatchString(line)
+			continue
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "Thread ") {
+			break
+		}
+		match := frameLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		frames = append(frames, normalizeFrame(match[1]))
+	}
+	return frames
+}
+
+func normalizeFrame(frame string) string {
+	frame = sourceSuffix.ReplaceAllString(frame, "")
+	if !strings.Contains(frame, "!") {
+		if match := offsetSuffix.FindStringSubmatch(frame); match != nil {
+			return offsetSuffix.ReplaceAllString(frame, "") + "@" + match[1]
+		}
+		return frame
+	}
+	return offsetSuffix.ReplaceAllString(frame, "")
+}
+
+// Function 返回帧的函数名部分，没有符号的帧原样返回 module@0xoffset
+func Function(frame string) string {
+	if i := strings.Index(frame, "!"); i >= 0 {
+		return frame[i+1:]
+	}
+	return frame
+}
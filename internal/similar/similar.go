@@ -0,0 +1,226 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package similar
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/job"
+	"bp-server/internal/signature"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFrames   = 10
+	defaultMinScore = 0.6
+	defaultLimit    = 10
+	// candidateLimit 是每次最多比较的分组数
+	candidateLimit = 200
+	// fillBatch 是后台每次补充栈的分组数
+	fillBatch = 500
+)
+
+// Match 是一个相似的分组，Score在0到1之间，1表示栈完全相同
+type Match struct {
+	Group db.CrashGroup
+	Score float64
+}
+
+func frameCount() int {
+	if conf.Xml.Similar.Frames <= 0 {
+		return defaultFrames
+	}
+	return conf.Xml.Similar.Frames
+}
+
+func minScore() float64 {
+	if conf.Xml.Similar.MinScore <= 0 {
+		return defaultMinScore
+	}
+	return conf.Xml.Similar.MinScore
+}
+
+func limit() int {
+	if conf.Xml.Similar.Limit <= 0 {
+		return defaultLimit
+	}
+	return conf.Xml.Similar.Limit
+}
+
+// Stack 返回用于比较相似度的栈，即程序的签名规则规范化后的栈顶帧
+func Stack(program string, frames []string) []string {
+	return signature.ForProgram(program).Stack(frames, frameCount())
+}
+
+// Score 用两个栈之间以帧为单位的编辑距离计算相似度
+func Score(a []string, b []string) float64 {
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(distance(a, b))/float64(longest)
+}
+
+// distance 是Levenshtein距离，插入、删除、替换一帧的代价都是1
+func distance(a []string, b []string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+func reportFrames(dumpID uint) ([]string, error) {
+	report, err := db.QueryReport(dumpID)
+	if err != nil {
+		return nil, err
+	}
+	if report.Frames != "" {
+		return strings.Split(report.Frames, "\n"), nil
+	}
+	return signature.Frames(report.Text), nil
+}
+
+// Start 在后台给旧版本建立的、还没有保存栈的分组补上栈
+func Start() {
+	job.Every("group stacks", 10*time.Minute, fillStacks)
+}
+
+// fillStacks 用分组里最新的dump计算分组的栈并保存
+func fillStacks() {
+	groups, err := db.QueryGroupsWithoutStack(fillBatch)
+	if err != nil {
+		return
+	}
+	filled := 0
+	for _, group := range groups {
+		dumps, err := db.QueryGroupDumps(group.ID, 1)
+		if err != nil || len(dumps) == 0 {
+			continue
+		}
+		frames, err := reportFrames(dumps[0].ID)
+		if err != nil {
+			continue
+		}
+		if stack := Stack(group.Program, frames); len(stack) > 0 {
+			if db.SetGroupStack(group.ID, strings.Join(stack, "\n")) == nil {
+				filled++
+			}
+		}
+	}
+	if filled > 0 {
+		logrus.Infof("Saved stacks of %d crash groups", filled)
+	}
+}
+
+// Nearest 返回程序里和stack最相似的分组，按相似度从高到低排列，不包括exclude分组。
+// 只比较栈顶是stack前两帧之一的分组，多一个或少一个内联帧的栈仍然能找到
+func Nearest(program string, stack []string, exclude uint) ([]Match, error) {
+	if len(stack) == 0 {
+		return nil, nil
+	}
+	var tops []string
+	for _, frame := range stack[:minInt(2, len(stack))] {
+		tops = append(tops, db.TopFrame(frame))
+	}
+	groups, err := db.QuerySimilarCandidates(program, tops, exclude, candidateLimit)
+	if err != nil {
+		return nil, err
+	}
+	threshold := minScore()
+	var matches []Match
+	for i := range groups {
+		if groups[i].Stack == "" {
+			continue
+		}
+		other := strings.Split(groups[i].Stack, "\n")
+		if score := Score(stack, other); score >= threshold {
+			matches = append(matches, Match{Group: groups[i], Score: score})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].Group.Count > matches[j].Group.Count
+	})
+	if len(matches) > limit() {
+		matches = matches[:limit()]
+	}
+	return matches, nil
+}
+
+// ForGroup 返回和分组相似的其它分组，还没有保存栈的分组没有结果
+func ForGroup(group *db.CrashGroup) ([]Match, error) {
+	if group.Stack == "" {
+		return nil, nil
+	}
+	return Nearest(group.Program, strings.Split(group.Stack, "\n"), group.ID)
+}
+
+// ForDump 返回和dump的栈最相似的分组，包括dump自己所在的分组
+func ForDump(dump *db.Dump) ([]Match, error) {
+	frames, err := reportFrames(dump.ID)
+	if err != nil {
+		logrus.Warnf("Query report of dump %d failed: %v", dump.ID, err)
+		return nil, err
+	}
+	return Nearest(dump.Program, Stack(dump.Program, frames), 0)
+}
@@ -0,0 +1,228 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package spike
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/event"
+	"bp-server/internal/job"
+	"bp-server/internal/stats"
+	"fmt"
+	"math"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultInterval     = 10
+	defaultBaselineDays = 7
+	defaultMinCount     = 10
+	defaultMinActive    = 3
+)
+
+// Start 检测一次并定期检测崩溃数的突增
+func Start() {
+	if !conf.Xml.Spike.Enable {
+		return
+	}
+	interval := conf.Xml.Spike.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	detect := func() {
+		if _, err := Detect(time.Now()); err != nil {
+			logrus.Errorf("Spike detection failed: %v", err)
+		}
+	}
+	go detect()
+	job.Every("spike detection", time.Duration(interval)*time.Minute, detect)
+}
+
+func baselineDays() int {
+	if conf.Xml.Spike.BaselineDays <= 0 {
+		return defaultBaselineDays
+	}
+	return conf.Xml.Spike.BaselineDays
+}
+
+func minCount() int64 {
+	if conf.Xml.Spike.MinCount <= 0 {
+		return defaultMinCount
+	}
+	return conf.Xml.Spike.MinCount
+}
+
+func minActiveDays() int {
+	if conf.Xml.Spike.MinBaselineDays <= 0 {
+		return defaultMinActive
+	}
+	return conf.Xml.Spike.MinBaselineDays
+}
+
+// activeDays 返回基线里有崩溃的天数
+func activeDays(daily []int64) int {
+	n := 0
+	for _, count := range daily {
+		if count > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Baseline 返回每天崩溃数的平均数和标准差
+func Baseline(daily []int64) (float64, float64) {
+	if len(daily) == 0 {
+		return 0, 0
+	}
+	var sum float64
+	for _, n := range daily {
+		sum += float64(n)
+	}
+	mean := sum / float64(len(daily))
+	var variance float64
+	for _, n := range daily {
+		variance += (float64(n) - mean) * (float64(n) - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(daily)))
+}
+
+// Score 返回count比平均数高出的标准差个数。崩溃数近似泊松分布，
+// 标准差至少取平均数的平方根，并且不小于1，避免平稳的基线把很小的波动放大
+func Score(count int64, mean float64, stddev float64) float64 {
+	stddev = math.Max(stddev, math.Max(math.Sqrt(mean), 1))
+	return (float64(count) - mean) / stddev
+}
+
+// IsSpike 判断当天的崩溃数相对于基线是否是突增，active是基线里有崩溃的天数。
+// 新的版本或分组没有基线，任何崩溃数都会超过平均数的倍数，所以有崩溃的天数不够时不算突增
+func IsSpike(count int64, mean float64, stddev float64, active int) bool {
+	if count < minCount() || active < minActiveDays() {
+		return false
+	}
+	if m := conf.Xml.Spike.Multiple; m > 0 && float64(count) > mean*m {
+		return true
+	}
+	if z := conf.Xml.Spike.ZScore; z > 0 && Score(count, mean, stddev) >= z {
+		return true
+	}
+	return false
+}
+
+type key struct {
+	program string
+	version string
+	groupID uint
+}
+
+// Detect 用每日统计检测now这一天到目前为止的突增，保存记录并为新的突增发布事件，返回新的突增
+func Detect(now time.Time) ([]db.SpikeAlert, error) {
+	days := baselineDays()
+	today := stats.Day(now)
+	from := stats.Day(now.AddDate(0, 0, -days))
+	var detected []db.SpikeAlert
+	for _, kind := range []string{db.SpikeGroup, db.SpikeRelease} {
+		counts, err := db.QuerySpikeCounts(kind, from, today)
+		if err != nil {
+			return detected, err
+		}
+		current := map[key]int64{}
+		history := map[key]map[string]int64{}
+		for _, c := range counts {
+			k := key{c.Program, c.Version, c.GroupID}
+			if c.Day == today {
+				current[k] = c.Count
+				continue
+			}
+			if history[k] == nil {
+				history[k] = map[string]int64{}
+			}
+			history[k][c.Day] = c.Count
+		}
+		for k, count := range current {
+			daily := make([]int64, 0, days)
+			for i := 1; i <= days; i++ {
+				daily = append(daily, history[k][stats.Day(now.AddDate(0, 0, -i))])
+			}
+			mean, stddev := Baseline(daily)
+			if !IsSpike(count, mean, stddev, activeDays(daily)) {
+				continue
+			}
+			alert := db.SpikeAlert{
+				Day:      today,
+				Kind:     kind,
+				Program:  k.program,
+				Version:  k.version,
+				GroupID:  k.groupID,
+				Count:    count,
+				Baseline: mean,
+				StdDev:   stddev,
+				Score:    Score(count, mean, stddev),
+			}
+			created, err := db.SaveSpikeAlert(&alert)
+			if err != nil {
+				return detected, err
+			}
+			if created {
+				detected = append(detected, alert)
+				publish(&alert, days)
+			}
+		}
+	}
+	return detected, nil
+}
+
+// publish 为新的突增发布事件
+func publish(alert *db.SpikeAlert, days int) {
+	ev := event.Event{
+		Type:    event.Spike,
+		Program: alert.Program,
+		Version: alert.Version,
+		GroupID: alert.GroupID,
+	}
+	if alert.Kind == db.SpikeGroup {
+		ev.Message = fmt.Sprintf("Crash group %d spiked: %d crashes today, %.1f per day in the last %d days",
+			alert.GroupID, alert.Count, alert.Baseline, days)
+		ev.URL = event.GroupURL(alert.GroupID)
+		if group, err := db.QueryGroup(alert.GroupID); err == nil {
+			ev.Signature = group.Signature
+		}
+	} else {
+		ev.Message = fmt.Sprintf("%s %s spiked: %d crashes today, %.1f per day in the last %d days",
+			alert.Program, alert.Version, alert.Count, alert.Baseline, days)
+		ev.URL = event.Link("/stats?program=%s&version=%s", url.QueryEscape(alert.Program), url.QueryEscape(alert.Version))
+	}
+	logrus.Warn(ev.Message)
+	event.Publish(ev)
+}
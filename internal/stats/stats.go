@@ -0,0 +1,132 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package stats
+
+import (
+	"bp-server/internal/clock"
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/job"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultInterval = 10
+	cursorName      = "daily"
+	batchSize       = 10000
+	dayLayout       = "2006-01-02"
+)
+
+// mutex 避免定时汇总和手动重建同时执行
+var mutex sync.Mutex
+
+// Start 汇总一次并定期把新增和修改过的dump汇总到每日统计
+func Start() {
+	interval := conf.Xml.Stats.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	go func() {
+		if _, err := Rollup(false); err != nil {
+			logrus.Errorf("Crash stats rollup failed: %v", err)
+		}
+	}()
+	job.Every("crash stats", time.Duration(interval)*time.Minute, func() {
+		if _, err := Rollup(false); err != nil {
+			logrus.Errorf("Crash stats rollup failed: %v", err)
+		}
+	})
+}
+
+// Day 返回t在统计时区下的日期
+func Day(t time.Time) string {
+	return t.In(clock.Location("")).Format(dayLayout)
+}
+
+// DayRange 返回日期在统计时区下的起止时间
+func DayRange(day string) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation(dayLayout, day, clock.Location(""))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return start, start.AddDate(0, 0, 1), nil
+}
+
+// Rollup 重新汇总上次汇总之后有dump新增或修改(包括重新分组)的日期，full为true时重建全部统计。
+// 返回重新汇总的天数
+func Rollup(full bool) (int, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if full {
+		if err := db.ClearStats(); err != nil {
+			return 0, err
+		}
+	}
+	cursor, err := db.QueryStatCursor(cursorName)
+	if err != nil {
+		return 0, err
+	}
+	days := map[string]bool{}
+	next := cursor
+	var afterID uint
+	for {
+		batch, err := db.QueryUpdatedDumps(cursor, afterID, batchSize)
+		if err != nil {
+			return 0, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, t := range batch {
+			afterID = t.ID
+			days[Day(t.CrashTime)] = true
+			if t.UpdatedAt.After(next) {
+				next = t.UpdatedAt
+			}
+		}
+	}
+	for day := range days {
+		start, end, err := DayRange(day)
+		if err != nil {
+			return 0, err
+		}
+		if err := db.RebuildDayStats(day, start, end); err != nil {
+			return 0, err
+		}
+	}
+	if len(days) > 0 {
+		logrus.Infof("Crash stats of %d days updated", len(days))
+	}
+	return len(days), db.SaveStatCursor(cursorName, next)
+}
@@ -0,0 +1,192 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Local 把对象保存在root目录下，key对应相对路径
+type Local struct {
+	root string
+}
+
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+func (l *Local) Root() string {
+	return l.root
+}
+
+func (l *Local) LocalPath(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(Key(key)))
+}
+
+func (l *Local) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	fullpath := l.LocalPath(key)
+	var n int64
+	err := withDir(fullpath, func() (err error) {
+		n, err = l.writeFile(fullpath, r)
+		return err
+	})
+	return n, err
+}
+
+// mkdirRetries 是创建文件时目录被删除后重试的次数
+const mkdirRetries = 3
+
+// withDir 创建fullpath所在的目录后执行create。Delete会删除变空的目录，并发删除同一目录下最后一个文件时
+// 目录可能在MkdirAll过程中或者之后被删掉，MkdirAll或create返回ENOENT时重新创建目录再试
+func withDir(fullpath string, create func() error) error {
+	var err error
+	for i := 0; i < mkdirRetries; i++ {
+		err = os.MkdirAll(filepath.Dir(fullpath), 0750)
+		if err == nil {
+			err = create()
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// writeFile 先写同目录下的临时文件再rename
+func (Local) writeFile(fullpath string, r io.Reader) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(fullpath), ".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp.Name(), fullpath)
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(l.LocalPath(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	return file, err
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := os.Stat(l.LocalPath(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: Key(key), Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *Local) Move(ctx context.Context, from string, to string) error {
+	fullpath := l.LocalPath(to)
+	err := withDir(fullpath, func() error {
+		err := os.Rename(l.LocalPath(from), fullpath)
+		if os.IsNotExist(err) {
+			if _, statErr := os.Lstat(l.LocalPath(from)); os.IsNotExist(statErr) {
+				return ErrNotExist
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return l.Delete(ctx, from)
+}
+
+// Delete 删除文件，并删除因此变空的上级目录
+func (l *Local) Delete(ctx context.Context, key string) error {
+	fullpath := l.LocalPath(key)
+	if err := os.Remove(fullpath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	root := filepath.Clean(l.root)
+	for dir := filepath.Dir(fullpath); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// List 跳过以.开头的文件和目录，例如临时文件和放在存储目录下的符号缓存，和S3一致
+func (l *Local) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	err := filepath.WalkDir(l.root, func(fullpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if hiddenName(d.Name()) && fullpath != l.root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, fullpath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+	})
+	return err
+}
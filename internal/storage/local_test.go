@@ -0,0 +1,80 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLocalPutWhileDeleting(t *testing.T) {
+	l := NewLocal(t.TempDir())
+	ctx := context.Background()
+	for i := 0; i < 200; i++ {
+		if _, err := l.Put(ctx, "a/b/old.dmp", strings.NewReader("old")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Delete(ctx, "a/b/old.dmp")
+		}()
+		// Delete删除变空的a/b时不能让同一目录下的Put失败
+		if _, err := l.Put(ctx, "a/b/new.dmp", strings.NewReader("new")); err != nil {
+			t.Fatalf("Put while deleting failed: %v", err)
+		}
+		wg.Wait()
+		if err := l.Delete(ctx, "a/b/new.dmp"); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+}
+
+func TestLocalListSkipsHidden(t *testing.T) {
+	l := NewLocal(t.TempDir())
+	ctx := context.Background()
+	for _, key := range []string{".incoming/x.dmp", "a/.tmp-1", "a/b.dmp"} {
+		if _, err := l.Put(ctx, key, strings.NewReader("minidump")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	var keys []string
+	err := l.List(ctx, "", func(info ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil || len(keys) != 1 || keys[0] != "a/b.dmp" {
+		t.Fatalf("List returned %v, %v", keys, err)
+	}
+}
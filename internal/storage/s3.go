@@ -0,0 +1,174 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"bp-server/internal/conf"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3PartSize 是分片上传的分片大小
+const s3PartSize = 16 * 1024 * 1024
+
+// S3 把对象保存在S3兼容的对象存储里，所有key都加上prefix。
+// 使用path-style访问，可以直接对接MinIO之类的本地服务
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3(cfg *conf.S3Conf, prefix string) (*S3, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure:       cfg.Secure,
+		Region:       cfg.Region,
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3{client: client, bucket: cfg.Bucket, prefix: cfg.Prefix + prefix}, nil
+}
+
+func (s *S3) key(key string) string {
+	return s.prefix + Key(key)
+}
+
+// Put 先读入最多一个分片，对象不超过一个分片时用一次PUT上传，否则分片上传。
+// 不给大小和PartSize时minio会按最大对象算分片，每次上传都要分配约0.5GiB的缓冲
+func (s *S3) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	opts := minio.PutObjectOptions{
+		ContentType:    "application/octet-stream",
+		SendContentMd5: true,
+		// 不使用aws-chunked流式签名，兼容更多S3实现
+		DisableContentSha256: true,
+	}
+	head := &bytes.Buffer{}
+	n, err := io.CopyN(head, r, s3PartSize+1)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	size := int64(-1)
+	var body io.Reader = head
+	if n <= s3PartSize {
+		size = n
+	} else {
+		body = io.MultiReader(head, r)
+		opts.PartSize = s3PartSize
+	}
+	info, err := s.client.PutObject(ctx, s.bucket, s.key(key), body, size, opts)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, s.key(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, convertError(err)
+	}
+	// GetObject不会发请求，Stat一次以便在这里就返回ErrNotExist
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, convertError(err)
+	}
+	return object, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, s.key(key), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return &ObjectInfo{Key: Key(key), Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	return convertError(s.client.RemoveObject(ctx, s.bucket, s.key(key), minio.RemoveObjectOptions{}))
+}
+
+// Move 用服务端复制再删除源对象，数据不经过本地
+func (s *S3) Move(ctx context.Context, from string, to string) error {
+	_, err := s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: s.key(to)},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: s.key(from)})
+	if err != nil {
+		return convertError(err)
+	}
+	return convertError(s.client.RemoveObject(ctx, s.bucket, s.key(from), minio.RemoveObjectOptions{}))
+}
+
+// List 和Local一样跳过以.开头的文件和目录
+func (s *S3) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.prefix + prefix,
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			return object.Err
+		}
+		key := strings.TrimPrefix(object.Key, s.prefix)
+		if hiddenKey(key) {
+			continue
+		}
+		err := fn(ObjectInfo{
+			Key:     key,
+			Size:    object.Size,
+			ModTime: object.LastModified,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func convertError(err error) error {
+	if err == nil {
+		return nil
+	}
+	code := minio.ToErrorResponse(err).Code
+	if code == "NoSuchKey" || code == "NotFound" {
+		return ErrNotExist
+	}
+	return err
+}
@@ -0,0 +1,308 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"bp-server/internal/conf"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 是测试用的S3服务，只实现了S3存储用到的接口：单次PUT、分片上传、复制、GET、HEAD、DELETE和ListObjectsV2
+type fakeS3 struct {
+	mutex     sync.Mutex
+	objects   map[string][]byte
+	parts     map[string]map[string][]byte
+	uploads   int
+	puts      int
+	multipart int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte), parts: make(map[string]map[string][]byte)}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	query := req.URL.Query()
+	switch {
+	case req.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		f.list(w, bucket, query.Get("prefix"))
+	case req.Method == http.MethodPost && query.Has("uploads"):
+		f.uploads++
+		id := fmt.Sprintf("upload-%d", f.uploads)
+		f.parts[id] = make(map[string][]byte)
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case req.Method == http.MethodPut && query.Has("uploadId"):
+		data, _ := io.ReadAll(req.Body)
+		f.parts[query.Get("uploadId")][fmt.Sprintf("%05s", query.Get("partNumber"))] = data
+		w.Header().Set("ETag", etag(data))
+	case req.Method == http.MethodPost && query.Has("uploadId"):
+		parts := f.parts[query.Get("uploadId")]
+		numbers := make([]string, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Strings(numbers)
+		data := []byte{}
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+		}
+		f.objects[key] = data
+		f.multipart++
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: etag(data)})
+	case req.Method == http.MethodPut && req.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(req.Header.Get("X-Amz-Copy-Source"))
+		_, from, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+		data, ok := f.objects[from]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			writeXML(w, struct {
+				XMLName xml.Name `xml:"Error"`
+				Code    string
+				Message string
+			}{Code: "NoSuchKey", Message: "The specified key does not exist."})
+			return
+		}
+		f.objects[key] = data
+		writeXML(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified string
+		}{ETag: etag(data), LastModified: time.Now().UTC().Format(time.RFC3339)})
+	case req.Method == http.MethodPut:
+		data, _ := io.ReadAll(req.Body)
+		f.objects[key] = data
+		f.puts++
+		w.Header().Set("ETag", etag(data))
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			if req.Method == http.MethodGet {
+				writeXML(w, struct {
+					XMLName xml.Name `xml:"Error"`
+					Code    string
+					Message string
+				}{Code: "NoSuchKey", Message: "The specified key does not exist."})
+			}
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if req.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case req.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, prefix string) {
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+		ETag         string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: bucket, Prefix: prefix}
+	for key, data := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{
+				Key:          key,
+				Size:         len(data),
+				LastModified: time.Now().UTC().Format(time.RFC3339),
+				ETag:         etag(data),
+			})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func newTestS3(t *testing.T) (*S3, *fakeS3) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	s, err := NewS3(&conf.S3Conf{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Region:    "us-east-1",
+		Bucket:    "crash",
+		Prefix:    "test/",
+		AccessKey: "key",
+		SecretKey: "secret",
+	}, "dumps/")
+	if err != nil {
+		t.Fatalf("NewS3 failed: %v", err)
+	}
+	return s, fake
+}
+
+func TestS3RoundTrip(t *testing.T) {
+	s, fake := newTestS3(t)
+	ctx := context.Background()
+	content := []byte("minidump")
+	n, err := s.Put(ctx, "a/b.dmp", bytes.NewReader(content))
+	if err != nil || n != int64(len(content)) {
+		t.Fatalf("Put returned %d, %v", n, err)
+	}
+	if fake.puts != 1 || fake.multipart != 0 {
+		t.Fatalf("small object used %d puts and %d multipart uploads", fake.puts, fake.multipart)
+	}
+	if _, ok := fake.objects["test/dumps/a/b.dmp"]; !ok {
+		t.Fatalf("object stored under unexpected key, have %v", fake.objects)
+	}
+	info, err := s.Stat(ctx, "a/b.dmp")
+	if err != nil || info.Size != int64(len(content)) || info.Key != "a/b.dmp" {
+		t.Fatalf("Stat returned %+v, %v", info, err)
+	}
+	reader, err := s.Get(ctx, "a/b.dmp")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	got, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("Get returned %q, %v", got, err)
+	}
+	var keys []string
+	err = s.List(ctx, "a/", func(info ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil || len(keys) != 1 || keys[0] != "a/b.dmp" {
+		t.Fatalf("List returned %v, %v", keys, err)
+	}
+	if err := s.Delete(ctx, "a/b.dmp"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := s.Get(ctx, "a/b.dmp"); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("Get after Delete returned %v", err)
+	}
+	if _, err := s.Stat(ctx, "a/b.dmp"); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("Stat after Delete returned %v", err)
+	}
+}
+
+func TestS3Move(t *testing.T) {
+	s, fake := newTestS3(t)
+	ctx := context.Background()
+	if _, err := s.Put(ctx, ".incoming/x.dmp", strings.NewReader("minidump")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	var keys []string
+	listKeys := func(info ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	}
+	if err := s.List(ctx, "", listKeys); err != nil || len(keys) != 0 {
+		t.Fatalf("List returned temporary objects %v, %v", keys, err)
+	}
+	if err := s.Move(ctx, ".incoming/x.dmp", "sha256/ab/cd/x.dmp"); err != nil {
+		t.Fatalf("Move failed: %v", err)
+	}
+	if string(fake.objects["test/dumps/sha256/ab/cd/x.dmp"]) != "minidump" {
+		t.Fatalf("moved object missing, have %v", fake.objects)
+	}
+	if _, ok := fake.objects["test/dumps/.incoming/x.dmp"]; ok {
+		t.Fatal("source object left behind after Move")
+	}
+	if err := s.List(ctx, "", listKeys); err != nil || len(keys) != 1 || keys[0] != "sha256/ab/cd/x.dmp" {
+		t.Fatalf("List returned %v, %v", keys, err)
+	}
+	if err := s.Move(ctx, ".incoming/x.dmp", "y.dmp"); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("Move of missing object returned %v", err)
+	}
+}
+
+func TestS3PutLargeObject(t *testing.T) {
+	s, fake := newTestS3(t)
+	content := bytes.Repeat([]byte("0123456789abcdef"), (s3PartSize+s3PartSize/2)/16)
+	// 不带大小的Reader，和压缩后上传的数据一样
+	n, err := s.Put(context.Background(), "big.dmp", io.MultiReader(bytes.NewReader(content)))
+	if err != nil || n != int64(len(content)) {
+		t.Fatalf("Put returned %d, %v", n, err)
+	}
+	if fake.multipart != 1 || len(fake.parts["upload-1"]) != 2 {
+		t.Fatalf("large object used %d multipart uploads with %d parts", fake.multipart, len(fake.parts["upload-1"]))
+	}
+	if !bytes.Equal(fake.objects["test/dumps/big.dmp"], content) {
+		t.Fatal("large object content differs")
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package storage
+
+import (
+	"bp-server/internal/conf"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	TypeLocal = "local"
+	TypeS3    = "s3"
+)
+
+// ErrNotExist 表示对象不存在
+var ErrNotExist = errors.New("object does not exist")
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage 是dump和符号文件的对象存储，key是以/分隔的相对路径
+type Storage interface {
+	// Put 写入对象，写入完成前读者看不到新内容。返回写入的字节数
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// Move 把对象from移到to，to已经存在时被覆盖
+	Move(ctx context.Context, from string, to string) error
+	// List 按key的字典序遍历prefix下的所有对象，fn返回错误时停止遍历
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+// LocalPather 由能直接提供本地文件路径的Storage实现
+type LocalPather interface {
+	LocalPath(key string) string
+	Root() string
+}
+
+var (
+	Dumps   Storage
+	Symbols Storage
+)
+
+// Init 按配置创建dump和符号文件的存储
+func Init() {
+	var err error
+	switch strings.ToLower(conf.Xml.Storage.Type) {
+	case "", TypeLocal:
+		Dumps = NewLocal(conf.Xml.DumpPath)
+		Symbols = NewLocal(conf.Xml.SymbolPath)
+	case TypeS3:
+		s3Conf := &conf.Xml.Storage.S3
+		if Dumps, err = NewS3(s3Conf, "dumps/"); err == nil {
+			Symbols, err = NewS3(s3Conf, "symbols/")
+		}
+	default:
+		err = fmt.Errorf("unknown type '%s'", conf.Xml.Storage.Type)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("config file 'storage': %v", err))
+	}
+}
+
+// Key 把路径片段拼成key，并去掉会逃出存储根目录的部分
+func Key(parts ...string) string {
+	key := path.Join(parts...)
+	key = path.Clean("/" + strings.ReplaceAll(key, "\\", "/"))
+	return strings.TrimPrefix(key, "/")
+}
+
+// hiddenName 以.开头的文件和目录是临时文件或缓存，例如.incoming下还没确定key的上传，List不返回它们
+func hiddenName(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// hiddenKey key的某一级是hiddenName时返回true
+func hiddenKey(key string) bool {
+	for _, name := range strings.Split(key, "/") {
+		if hiddenName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// CopyToFile 把对象下载到本地文件
+func CopyToFile(ctx context.Context, s Storage, key string, filename string) error {
+	reader, err := s.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = Local{}.writeFile(filename, reader)
+	return err
+}
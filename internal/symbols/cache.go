@@ -0,0 +1,213 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package symbols
+
+import (
+	"bp-server/internal/compress"
+	"bp-server/internal/storage"
+	"container/list"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var symCache *cache
+
+// cacheItem 的version是取出文件时存储里对象的key、大小和修改时间，启动时从目录恢复的文件没有version
+type cacheItem struct {
+	rel     string
+	version string
+	size    int64
+	refs    int
+}
+
+// cache 是解压后符号文件的磁盘LRU缓存，总大小超过budget时从最久未使用的文件开始删除，
+// 正在被stackwalk使用的文件不会被删除
+type cache struct {
+	dir    string
+	budget int64
+	mutex  sync.Mutex
+	lru    *list.List
+	items  map[string]*list.Element
+	size   int64
+}
+
+func newCache(dir string, budget int64) *cache {
+	c := &cache{
+		dir:    dir,
+		budget: budget,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element),
+	}
+	c.load()
+	return c
+}
+
+// load 启动时扫描缓存目录，按修改时间恢复LRU顺序。上次没写完的临时文件直接删除
+func (c *cache) load() {
+	type file struct {
+		rel     string
+		size    int64
+		modTime int64
+	}
+	var files []file
+	filepath.WalkDir(c.dir, func(fullpath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			os.Remove(fullpath)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(c.dir, fullpath)
+		rel = filepath.ToSlash(rel)
+		files = append(files, file{rel: rel, size: info.Size(), modTime: info.ModTime().UnixNano()})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime > files[j].modTime })
+	for _, f := range files {
+		c.items[f.rel] = c.lru.PushBack(&cacheItem{rel: f.rel, size: f.size})
+		c.size += f.size
+	}
+	c.evict()
+}
+
+// acquireCached 如果rel的version版本已经在缓存中则增加引用并返回true
+func (c *cache) acquireCached(rel string, version string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.items[rel]; ok && elem.Value.(*cacheItem).version == version {
+		elem.Value.(*cacheItem).refs++
+		c.lru.MoveToFront(elem)
+		return true
+	}
+	return false
+}
+
+// acquire 从符号存储中取出key，按m解压后放入缓存的rel位置，并增加引用。
+// 旧版本正在被使用时也可以替换，文件是先写临时文件再rename的，正在读的进程仍然读到旧文件
+func (c *cache) acquire(rel string, key string, m string, version string) error {
+	fullpath := filepath.Join(c.dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(fullpath), 0750); err != nil {
+		return err
+	}
+	object, err := storage.Symbols.Get(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+	reader, err := compress.NewReader(m, object)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if _, err = compress.WriteFile(fullpath, reader, compress.None); err != nil {
+		return err
+	}
+	info, err := os.Stat(fullpath)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.items[rel]; ok {
+		item := elem.Value.(*cacheItem)
+		c.size += info.Size() - item.size
+		item.size = info.Size()
+		item.version = version
+		item.refs++
+		c.lru.MoveToFront(elem)
+	} else {
+		c.items[rel] = c.lru.PushFront(&cacheItem{rel: rel, version: version, size: info.Size(), refs: 1})
+		c.size += info.Size()
+	}
+	return nil
+}
+
+// invalidate 在符号被重新上传后删除缓存中没有被使用的旧版本
+func (c *cache) invalidate(rel string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.items[rel]
+	if !ok || elem.Value.(*cacheItem).refs > 0 {
+		return
+	}
+	if err := os.Remove(filepath.Join(c.dir, filepath.FromSlash(rel))); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Remove cached symbol file '%s' failed: %v", rel, err)
+		return
+	}
+	c.lru.Remove(elem)
+	delete(c.items, rel)
+	c.size -= elem.Value.(*cacheItem).size
+}
+
+func (c *cache) release(rels []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, rel := range rels {
+		if elem, ok := c.items[rel]; ok {
+			elem.Value.(*cacheItem).refs--
+		}
+	}
+	c.evict()
+}
+
+// evict 调用者需持有mutex
+func (c *cache) evict() {
+	if c.budget <= 0 {
+		return
+	}
+	for elem := c.lru.Back(); elem != nil && c.size > c.budget; {
+		prev := elem.Prev()
+		item := elem.Value.(*cacheItem)
+		if item.refs <= 0 {
+			if err := os.Remove(filepath.Join(c.dir, filepath.FromSlash(item.rel))); err != nil && !os.IsNotExist(err) {
+				logrus.Warnf("Remove cached symbol file '%s' failed: %v", item.rel, err)
+			} else {
+				c.lru.Remove(elem)
+				delete(c.items, item.rel)
+				c.size -= item.size
+			}
+		}
+		elem = prev
+	}
+}
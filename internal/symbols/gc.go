@@ -0,0 +1,200 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package symbols
+
+import (
+	"bp-server/internal/compress"
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/job"
+	"bp-server/internal/storage"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Deletion 是一次符号回收删除(或在dry-run下将要删除)的 <entry>/<id> 目录
+type Deletion struct {
+	Entry   string
+	DebugID string
+	Size    int64
+}
+
+// StartGC 按配置定期回收符号
+func StartGC() {
+	gcConf := &conf.Xml.SymbolStore.GC
+	if !gcConf.Enable {
+		return
+	}
+	job.Every("symbol gc", time.Duration(gcConf.Interval)*time.Hour, func() {
+		if _, err := GC(false); err != nil {
+			logrus.Errorf("Symbol GC failed: %v", err)
+		}
+	})
+}
+
+// GC 删除不再需要的符号。以下符号会被保留：
+// 最近crash_days天内的dump引用过的符号，最近crash_days天内有崩溃的版本上传的符号，
+// 每个程序最近keep_releases个版本上传的符号，以及min_age天内修改过的符号。
+// 没有上传记录或者上传时没有给出程序和版本的符号不知道属于哪个版本，不会被删除。
+// dryRun为true时只返回将要删除的符号
+func GC(dryRun bool) ([]Deletion, error) {
+	gcConf := &conf.Xml.SymbolStore.GC
+	now := time.Now()
+	since := now.AddDate(0, 0, -gcConf.CrashDays)
+	keep := make(map[db.SymbolKey]bool)
+	referenced, err := db.QuerySymbolsReferencedSince(since)
+	if err != nil {
+		return nil, err
+	}
+	crashed, err := db.QuerySymbolsOfCrashedVersions(since)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := db.QuerySymbolsOfLatestReleases(gcConf.KeepReleases)
+	if err != nil {
+		return nil, err
+	}
+	for _, keys := range [][]db.SymbolKey{referenced, crashed, latest} {
+		for _, key := range keys {
+			keep[key] = true
+		}
+	}
+	withRelease, err := db.QuerySymbolsWithRelease()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[db.SymbolKey]bool, len(withRelease))
+	for _, key := range withRelease {
+		known[key] = true
+	}
+
+	reason := fmt.Sprintf("not referenced by crashes in the last %d days or by the latest %d releases", gcConf.CrashDays, gcConf.KeepReleases)
+	minModTime := now.AddDate(0, 0, -gcConf.MinAge)
+	dirs, err := listDirs()
+	if err != nil {
+		return nil, err
+	}
+	var deletions []Deletion
+	for _, dir := range dirs {
+		if keep[dir.key] || !known[dir.key] || dir.modTime.After(minModTime) {
+			continue
+		}
+		deletion := Deletion{Entry: dir.key.Entry, DebugID: dir.key.DebugID, Size: dir.size}
+		if dryRun {
+			deletions = append(deletions, deletion)
+			continue
+		}
+		if err := removeDir(dir); err != nil {
+			logrus.Errorf("Remove symbols '%s/%s' failed: %v", dir.key.Entry, dir.key.DebugID, err)
+			continue
+		}
+		logrus.Infof("Symbol GC removed '%s/%s' (%d bytes): %s", dir.key.Entry, dir.key.DebugID, dir.size, reason)
+		if err := db.RecordSymbolDeletion(dir.key.Entry, dir.key.DebugID, dir.size, reason); err != nil {
+			return deletions, err
+		}
+		deletions = append(deletions, deletion)
+	}
+	return deletions, nil
+}
+
+// Delete 删除一个 <entry>/<id> 下的所有符号文件和它的上传记录，并写入审计记录，返回删除的字节数
+func Delete(entry string, id string, reason string) (int64, error) {
+	prefix := storage.Key(entry, id) + "/"
+	dir := &symbolDir{key: db.SymbolKey{Entry: entry, DebugID: id}}
+	err := storage.Symbols.List(context.Background(), prefix, func(info storage.ObjectInfo) error {
+		dir.keys = append(dir.keys, info.Key)
+		dir.size += info.Size
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := removeDir(dir); err != nil {
+		logrus.Errorf("Remove symbols '%s/%s' failed: %v", entry, id, err)
+		return 0, err
+	}
+	for _, key := range dir.keys {
+		_, rel := compress.FromName(key)
+		symCache.invalidate(rel)
+	}
+	logrus.Infof("Removed symbols '%s/%s' (%d bytes): %s", entry, id, dir.size, reason)
+	return dir.size, db.RecordSymbolDeletion(entry, id, dir.size, reason)
+}
+
+// symbolDir 是存储中一个 <entry>/<id> 下的所有文件
+type symbolDir struct {
+	key     db.SymbolKey
+	keys    []string
+	size    int64
+	modTime time.Time
+}
+
+func listDirs() ([]*symbolDir, error) {
+	var dirs []*symbolDir
+	index := make(map[db.SymbolKey]*symbolDir)
+	cachePrefix := cacheKeyPrefix()
+	err := storage.Symbols.List(context.Background(), "", func(info storage.ObjectInfo) error {
+		if cachePrefix != "" && strings.HasPrefix(info.Key, cachePrefix) {
+			return nil
+		}
+		parts := strings.SplitN(info.Key, "/", 3)
+		if len(parts) < 3 {
+			return nil
+		}
+		key := db.SymbolKey{Entry: parts[0], DebugID: parts[1]}
+		dir, ok := index[key]
+		if !ok {
+			dir = &symbolDir{key: key}
+			index[key] = dir
+			dirs = append(dirs, dir)
+		}
+		dir.keys = append(dir.keys, info.Key)
+		dir.size += info.Size
+		if info.ModTime.After(dir.modTime) {
+			dir.modTime = info.ModTime
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+func removeDir(dir *symbolDir) error {
+	for _, key := range dir.keys {
+		if err := storage.Symbols.Delete(context.Background(), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
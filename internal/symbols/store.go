@@ -0,0 +1,206 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package symbols
+
+import (
+	"bp-server/internal/compress"
+	"bp-server/internal/conf"
+	"bp-server/internal/minidump"
+	"bp-server/internal/storage"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var method string
+
+// Init 读取符号文件的压缩和缓存配置
+func Init() {
+	m, err := compress.Normalize(conf.Xml.SymbolStore.Compress)
+	if err != nil {
+		panic(fmt.Sprintf("config file 'symbol_store/compress': %v", err))
+	}
+	method = m
+	if conf.Xml.SymbolStore.CachePath == "" {
+		conf.Xml.SymbolStore.CachePath = filepath.Join(conf.Xml.SymbolPath, ".cache")
+	}
+	symCache = newCache(conf.Xml.SymbolStore.CachePath, conf.Xml.SymbolStore.CacheSize*1024*1024)
+}
+
+// Save 把上传的符号文件按配置的压缩方式写入 <entry>/<id>/，上传的是.gz、.zst文件时先解压。
+// 同名但压缩方式不同的旧文件会被删除。返回存储中的key
+func Save(entry string, id string, filename string, r io.Reader) (string, error) {
+	ctx := context.Background()
+	uploaded, base := compress.FromName(filename)
+	rel := storage.Key(entry, id, base)
+	if uploaded != compress.None {
+		decompressed, err := compress.NewReader(uploaded, r)
+		if err != nil {
+			return "", fmt.Errorf("decompress '%s': %w", filename, err)
+		}
+		defer decompressed.Close()
+		r = decompressed
+	}
+	reader := compress.Compressed(method, r)
+	defer reader.Close()
+	if _, err := storage.Symbols.Put(ctx, rel+compress.Ext(method), reader); err != nil {
+		return "", err
+	}
+	for _, m := range compress.Methods {
+		if m != method {
+			storage.Symbols.Delete(ctx, rel+compress.Ext(m))
+		}
+	}
+	symCache.invalidate(rel)
+	return rel + compress.Ext(method), nil
+}
+
+// Prepare 为minidump里的模块准备符号文件。本地存储中未压缩的符号直接使用，
+// 其它符号从存储中取出并解压到缓存目录。
+// 返回传给minidump_stackwalk的符号目录列表，以及stackwalk结束后必须调用的释放函数
+func Prepare(modules []minidump.Module) ([]string, func()) {
+	ctx := context.Background()
+	local, isLocal := storage.Symbols.(storage.LocalPather)
+	var used []string
+	for i := range modules {
+		module := &modules[i]
+		if module.DebugFile == "" || module.DebugID == "" {
+			continue
+		}
+		rel := storage.Key(module.DebugFile, module.DebugID, module.SymbolFile())
+		if isLocal {
+			if _, err := os.Stat(local.LocalPath(rel)); err == nil {
+				continue
+			}
+		}
+		for _, m := range compress.Methods {
+			if m == compress.None && isLocal {
+				continue
+			}
+			key := rel + compress.Ext(m)
+			info, err := storage.Symbols.Stat(ctx, key)
+			if err != nil {
+				continue
+			}
+			// 符号可能被别的实例重新上传过，缓存的版本和存储里的对象不一样时重新取
+			version := fmt.Sprintf("%s:%d:%d", key, info.Size, info.ModTime.UnixNano())
+			if symCache.acquireCached(rel, version) {
+				used = append(used, rel)
+				break
+			}
+			if err := symCache.acquire(rel, key, m, version); err != nil {
+				logrus.Warnf("Fetch symbol file '%s' failed: %v", key, err)
+			} else {
+				used = append(used, rel)
+			}
+			break
+		}
+	}
+	release := func() {
+		symCache.release(used)
+	}
+	paths := []string{symCache.dir}
+	if isLocal {
+		paths = append(paths, local.Root())
+	}
+	return paths, release
+}
+
+// cacheKeyPrefix 返回缓存目录在本地符号存储里的key前缀，缓存目录不在符号存储里时返回空。
+// 遍历符号存储时要跳过缓存的文件
+func cacheKeyPrefix() string {
+	local, ok := storage.Symbols.(storage.LocalPather)
+	if !ok {
+		return ""
+	}
+	rel, err := filepath.Rel(local.Root(), symCache.dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return filepath.ToSlash(rel) + "/"
+}
+
+// ConvertStore 把存储中已有的.sym文件转换成当前配置的压缩方式，返回转换的文件数
+func ConvertStore() (int, error) {
+	ctx := context.Background()
+	var keys []string
+	cachePrefix := cacheKeyPrefix()
+	err := storage.Symbols.List(ctx, "", func(info storage.ObjectInfo) error {
+		if cachePrefix != "" && strings.HasPrefix(info.Key, cachePrefix) {
+			return nil
+		}
+		m, base := compress.FromName(info.Key)
+		if m != method && strings.HasSuffix(base, ".sym") {
+			keys = append(keys, info.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	converted := 0
+	for _, key := range keys {
+		if err := convert(ctx, key); err != nil {
+			return converted, fmt.Errorf("convert '%s': %w", key, err)
+		}
+		converted++
+	}
+	return converted, nil
+}
+
+func convert(ctx context.Context, key string) error {
+	m, base := compress.FromName(key)
+	object, err := storage.Symbols.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+	reader, err := compress.NewReader(m, object)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	compressed := compress.Compressed(method, reader)
+	defer compressed.Close()
+	if _, err = storage.Symbols.Put(ctx, base+compress.Ext(method), compressed); err != nil {
+		return err
+	}
+	if err = storage.Symbols.Delete(ctx, key); err != nil {
+		return err
+	}
+	logrus.Infof("Converted symbol file '%s' to '%s'", key, base+compress.Ext(method))
+	return nil
+}
@@ -0,0 +1,373 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tracker
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/event"
+	"bp-server/internal/job"
+	"bp-server/internal/signature"
+	"bp-server/internal/version"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFrames   = 10
+	defaultInterval = 60
+	timeout         = 30 * time.Second
+	// responseLimit 是读取的响应内容的最大长度
+	responseLimit = 1 << 20
+	// errorLimit 是错误信息里响应内容的最大长度
+	errorLimit = 512
+	// dumpsTried 是查找栈帧时最多尝试的分组里最新的dump数
+	dumpsTried = 5
+	// defaultBody 是没有配置<tracker><body>时的请求内容，GitHub和GitLab都接受
+	defaultBody = `{"title": {{ json .Title }}, "body": {{ json .Body }}, "description": {{ json .Body }}}`
+)
+
+var (
+	ErrNotConfigured = errors.New("issue tracker is not configured")
+	ErrIssueExists   = errors.New("crash group already has an issue")
+)
+
+// descriptionTemplate 生成问题的描述，GitHub、GitLab和Jira Cloud都能显示这样的markdown
+const descriptionTemplate = `**Program:** {{ .Group.Program }}
+**Signature:** ` + "`{{ .Group.Signature }}`" + `
+**Crashes:** {{ .Group.Count }} on {{ .Group.Installs }} installations, first seen {{ .Group.FirstSeen.UTC.Format "2006-01-02 15:04 MST" }}, last seen {{ .Group.LastSeen.UTC.Format "2006-01-02 15:04 MST" }}
+{{- if .Versions }}
+**Versions:** {{ range $i, $v := .Versions }}{{ if $i }}, {{ end }}{{ $v.Version }} ({{ $v.Count }}){{ end }}
+{{- end }}
+{{ if .Frames }}
+Top frames:
+` + "```" + `
+{{ range .Frames }}{{ . }}
+{{ end }}` + "```" + `
+{{ end }}
+{{- if .URL }}
+[View in bp-server]({{ .URL }})
+{{ end }}`
+
+// Issue 是执行<tracker><body>模板的数据
+type Issue struct {
+	Title    string
+	Body     string
+	Group    *db.CrashGroup
+	Frames   []string
+	Versions []db.GroupVersion
+	URL      string
+}
+
+var (
+	description = template.Must(template.New("description").Parse(descriptionTemplate))
+	body        *template.Template
+	// mutex 防止同一个分组同时创建两个问题
+	mutex sync.Mutex
+)
+
+// Init 解析配置的问题模板
+func Init() {
+	text := conf.Xml.Tracker.Body
+	if strings.TrimSpace(text) == "" {
+		text = defaultBody
+	}
+	var err error
+	body, err = template.New("tracker").Funcs(template.FuncMap{"json": quote}).Parse(text)
+	if err != nil {
+		logrus.Fatalf("Parse <tracker><body> failed: %v", err)
+	}
+}
+
+// quote 把值编码成JSON，用于在模板里拼接请求内容
+func quote(v any) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// Enabled 判断是否配置了问题跟踪系统
+func Enabled() bool {
+	return conf.Xml.Tracker.URL != ""
+}
+
+// Name 是界面上显示的问题跟踪系统名称
+func Name() string {
+	if conf.Xml.Tracker.Name == "" {
+		return "issue tracker"
+	}
+	return conf.Xml.Tracker.Name
+}
+
+// Start 定期同步已创建问题的状态
+func Start() {
+	if !Enabled() || !conf.Xml.Tracker.Sync.Enable {
+		return
+	}
+	if conf.Xml.Tracker.IssueAPI == "" || conf.Xml.Tracker.Sync.State == "" {
+		logrus.Warn("Issue sync needs <tracker><issue_api> and <tracker><sync><state>, not scheduled")
+		return
+	}
+	interval := conf.Xml.Tracker.Sync.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	job.Every("issue sync", time.Duration(interval)*time.Minute, Sync)
+}
+
+func frames() int {
+	if conf.Xml.Tracker.Frames <= 0 {
+		return defaultFrames
+	}
+	return conf.Xml.Tracker.Frames
+}
+
+// topFrames 返回分组里最新的一个处理过的dump的栈顶帧
+func topFrames(groupID uint) ([]string, error) {
+	dumps, err := db.QueryGroupDumps(groupID, dumpsTried)
+	if err != nil {
+		return nil, err
+	}
+	for _, dump := range dumps {
+		report, err := db.QueryReport(dump.ID)
+		if err != nil {
+			continue
+		}
+		var result []string
+		if report.Frames != "" {
+			result = strings.Split(report.Frames, "\n")
+		} else {
+			result = signature.Frames(report.Text)
+		}
+		if len(result) > frames() {
+			result = result[:frames()]
+		}
+		return result, nil
+	}
+	return nil, nil
+}
+
+// NewIssue 收集分组创建问题需要的信息
+func NewIssue(group *db.CrashGroup) (*Issue, error) {
+	issue := &Issue{
+		Title: fmt.Sprintf("[%s] Crash in %s", group.Program, group.Signature),
+		Group: group,
+		URL:   event.GroupURL(group.ID),
+	}
+	var err error
+	if issue.Frames, err = topFrames(group.ID); err != nil {
+		return nil, err
+	}
+	if issue.Versions, err = db.QueryGroupVersions(group.ID); err != nil {
+		return nil, err
+	}
+	sort.Slice(issue.Versions, func(i, j int) bool {
+		return version.Compare(issue.Versions[i].Version, issue.Versions[j].Version) > 0
+	})
+	var buf bytes.Buffer
+	if err := description.Execute(&buf, issue); err != nil {
+		return nil, err
+	}
+	issue.Body = buf.String()
+	return issue, nil
+}
+
+// request 发送请求并解析JSON响应
+func request(method string, url string, content []byte) (any, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "bp-server")
+	if content != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, header := range conf.Xml.Tracker.Headers {
+		req.Header.Set(header.Name, strings.TrimSpace(header.Value))
+	}
+	client := &http.Client{Timeout: timeout}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, responseLimit))
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		if len(data) > errorLimit {
+			data = data[:errorLimit]
+		}
+		return nil, fmt.Errorf("unexpected status %s: %s", rsp.Status, strings.TrimSpace(string(data)))
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var result any
+	if err := decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("parse response failed: %w", err)
+	}
+	return result, nil
+}
+
+// Lookup 按用.分隔的路径取出JSON里的值，数组用下标，找不到或者值不是标量时返回false
+func Lookup(v any, path string) (string, bool) {
+	if path == "" {
+		return "", false
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = node[key]; !ok {
+				return "", false
+			}
+		case []any:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", false
+			}
+			v = node[index]
+		default:
+			return "", false
+		}
+	}
+	switch value := v.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+// CreateIssue 在问题跟踪系统里为分组创建问题，并把问题的地址保存到分组上
+func CreateIssue(groupID uint) (*db.CrashGroup, error) {
+	if !Enabled() {
+		return nil, ErrNotConfigured
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	group, err := db.QueryGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if group.IssueURL != "" || group.IssueAPI != "" {
+		return nil, ErrIssueExists
+	}
+	issue, err := NewIssue(group)
+	if err != nil {
+		return nil, err
+	}
+	var content bytes.Buffer
+	if err := body.Execute(&content, issue); err != nil {
+		return nil, fmt.Errorf("execute <tracker><body> failed: %w", err)
+	}
+	method := conf.Xml.Tracker.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	rsp, err := request(method, conf.Xml.Tracker.URL, content.Bytes())
+	if err != nil {
+		logrus.Errorf("Create issue for crash group %d failed: %v", groupID, err)
+		return nil, err
+	}
+	issueID, _ := Lookup(rsp, conf.Xml.Tracker.IssueID)
+	issueURL, _ := Lookup(rsp, conf.Xml.Tracker.IssueURL)
+	issueAPI, _ := Lookup(rsp, conf.Xml.Tracker.IssueAPI)
+	if issueURL == "" && issueAPI == "" {
+		return nil, fmt.Errorf("no issue address found in the response of %s", Name())
+	}
+	if issueURL == "" {
+		issueURL = issueAPI
+	}
+	if issueID == "" {
+		issueID = issueURL
+	}
+	group, err = db.SetGroupIssue(groupID, issueID, issueURL, issueAPI)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Created issue %s for crash group %d", issueURL, groupID)
+	return group, nil
+}
+
+// Closed 判断问题状态是否表示已关闭，不区分大小写
+func Closed(state string) bool {
+	for _, closed := range conf.Xml.Tracker.Sync.Closed {
+		if strings.EqualFold(strings.TrimSpace(closed), state) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sync 拉取所有问题的状态，只更新界面上显示的状态，不修改分组的处理状态
+func Sync() {
+	groups, err := db.QueryIssueGroups()
+	if err != nil {
+		return
+	}
+	for i := range groups {
+		group := &groups[i]
+		rsp, err := request(http.MethodGet, group.IssueAPI, nil)
+		if err != nil {
+			logrus.Warnf("Sync issue %s of crash group %d failed: %v", group.IssueAPI, group.ID, err)
+			continue
+		}
+		state, ok := Lookup(rsp, conf.Xml.Tracker.Sync.State)
+		if !ok {
+			logrus.Warnf("Sync issue %s of crash group %d: no state found at '%s'", group.IssueAPI, group.ID, conf.Xml.Tracker.Sync.State)
+			continue
+		}
+		closed := Closed(state)
+		if state == group.IssueState && closed == group.IssueClosed {
+			continue
+		}
+		if db.SetIssueState(group.ID, state, closed) == nil {
+			logrus.Infof("Issue %s of crash group %d is now %s", group.IssueURL, group.ID, state)
+		}
+	}
+}
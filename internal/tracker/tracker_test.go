@@ -0,0 +1,211 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tracker
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/conf/conftest"
+	"bp-server/internal/db"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	conftest.Load()
+	db.Init()
+	Init()
+	os.Exit(m.Run())
+}
+
+// fakeTracker 是测试用的问题跟踪系统，接口和GitHub的issues接口类似
+type fakeTracker struct {
+	mutex   sync.Mutex
+	issues  map[string]string
+	created []map[string]string
+	auth    []string
+	fail    bool
+}
+
+func (f *fakeTracker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.auth = append(f.auth, req.Header.Get("Authorization"))
+	if f.fail {
+		http.Error(w, "tracker is down", http.StatusServiceUnavailable)
+		return
+	}
+	switch {
+	case req.Method == http.MethodPost && req.URL.Path == "/issues":
+		content := map[string]string{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.created = append(f.created, content)
+		number := len(f.created)
+		f.issues[fmt.Sprint(number)] = "open"
+		json.NewEncoder(w).Encode(map[string]any{
+			"number":   number,
+			"html_url": fmt.Sprintf("http://%s/web/%d", req.Host, number),
+			"url":      fmt.Sprintf("http://%s/api/%d", req.Host, number),
+		})
+	case req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/api/"):
+		state, ok := f.issues[strings.TrimPrefix(req.URL.Path, "/api/")]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"state": state})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (f *fakeTracker) setState(number int, state string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.issues[fmt.Sprint(number)] = state
+}
+
+func newFakeTracker(t *testing.T) *fakeTracker {
+	fake := &fakeTracker{issues: make(map[string]string)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	old := conf.Xml.Tracker
+	t.Cleanup(func() { conf.Xml.Tracker = old })
+	conf.Xml.Tracker.URL = server.URL + "/issues"
+	conf.Xml.Tracker.Method = ""
+	conf.Xml.Tracker.Headers = []conf.TrackerHeader{{Name: "Authorization", Value: " Bearer secret "}}
+	conf.Xml.Tracker.IssueID = "number"
+	conf.Xml.Tracker.IssueURL = "html_url"
+	conf.Xml.Tracker.IssueAPI = "url"
+	conf.Xml.Tracker.Sync.State = "state"
+	conf.Xml.Tracker.Sync.Closed = []string{"closed"}
+	return fake
+}
+
+// testProgram 返回每次执行都不同的程序名，-count重复执行时不会用到上一次创建了问题的分组
+func testProgram() string {
+	return fmt.Sprintf("tracker-app-%d", time.Now().UnixNano())
+}
+
+// addGroup 上传并处理一个dump，返回它所在的分组
+func addGroup(t *testing.T, program string, sig string) *db.CrashGroup {
+	dump := &db.Dump{OS: "windows", Program: program, Version: "1.2.0", Filename: "test.dmp", Build: "b"}
+	if err := db.AddDump(dump); err != nil {
+		t.Fatalf("AddDump failed: %v", err)
+	}
+	frames := sig + "\nmain"
+	group, err := db.SaveReport(dump, "Thread 0 (crashed)\n", frames, sig, frames)
+	if err != nil {
+		t.Fatalf("SaveReport failed: %v", err)
+	}
+	return group
+}
+
+func TestCreateIssueAndSync(t *testing.T) {
+	fake := newFakeTracker(t)
+	group := addGroup(t, testProgram(), "app!Crash")
+	updated, err := CreateIssue(group.ID)
+	if err != nil {
+		t.Fatalf("CreateIssue failed: %v", err)
+	}
+	if len(fake.created) != 1 {
+		t.Fatalf("tracker got %d issues, want 1", len(fake.created))
+	}
+	content := fake.created[0]
+	if !strings.Contains(content["title"], "app!Crash") || !strings.Contains(content["body"], "tracker-app") ||
+		!strings.Contains(content["body"], "1.2.0") {
+		t.Errorf("unexpected issue content %v", content)
+	}
+	if fake.auth[0] != "Bearer secret" {
+		t.Errorf("configured header sent as '%s'", fake.auth[0])
+	}
+	if !strings.HasSuffix(updated.IssueURL, "/web/1") || !strings.HasSuffix(updated.IssueAPI, "/api/1") || updated.BugID != "1" {
+		t.Errorf("issue saved as url '%s', api '%s', bug '%s'", updated.IssueURL, updated.IssueAPI, updated.BugID)
+	}
+	if _, err := CreateIssue(group.ID); !errors.Is(err, ErrIssueExists) {
+		t.Errorf("second CreateIssue returned %v", err)
+	}
+
+	fake.setState(1, "closed")
+	Sync()
+	synced, err := db.QueryGroup(group.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synced.IssueState != "closed" || !synced.IssueClosed {
+		t.Errorf("synced issue state '%s', closed %v", synced.IssueState, synced.IssueClosed)
+	}
+	if synced.Status != group.Status {
+		t.Errorf("sync changed the group status from '%s' to '%s'", group.Status, synced.Status)
+	}
+
+	fake.setState(1, "open")
+	Sync()
+	if synced, _ = db.QueryGroup(group.ID); synced.IssueState != "open" || synced.IssueClosed {
+		t.Errorf("reopened issue synced as '%s', closed %v", synced.IssueState, synced.IssueClosed)
+	}
+}
+
+func TestCreateIssueFailure(t *testing.T) {
+	fake := newFakeTracker(t)
+	fake.fail = true
+	group := addGroup(t, testProgram(), "app!Fail")
+	_, err := CreateIssue(group.ID)
+	if err == nil || !strings.Contains(err.Error(), "tracker is down") {
+		t.Fatalf("CreateIssue returned %v", err)
+	}
+	saved, err := db.QueryGroup(group.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.IssueURL != "" || saved.IssueAPI != "" {
+		t.Errorf("failed issue saved as '%s'", saved.IssueURL)
+	}
+}
+
+func TestCreateIssueNotConfigured(t *testing.T) {
+	old := conf.Xml.Tracker.URL
+	conf.Xml.Tracker.URL = ""
+	defer func() { conf.Xml.Tracker.URL = old }()
+	if _, err := CreateIssue(1); !errors.Is(err, ErrNotConfigured) {
+		t.Fatalf("CreateIssue returned %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package usage
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/job"
+	"bp-server/internal/stats"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MaxSessions 是一次上报最多可以累加的会话数
+const MaxSessions = 1000000
+
+// Start 定期删除超过<usage><keep_days>的每日安装记录
+func Start() {
+	if conf.Xml.Usage.KeepDays <= 0 {
+		return
+	}
+	job.Every("usage cleanup", 24*time.Hour, func() {
+		before := stats.Day(time.Now().AddDate(0, 0, -conf.Xml.Usage.KeepDays))
+		if n, err := db.DeleteUsageInstalls(before); err == nil && n > 0 {
+			logrus.Infof("Deleted %d daily installations before %s", n, before)
+		}
+	})
+}
+
+// HashInstall 返回安装ID的哈希，服务器不保存原始的安装ID。id为空时返回空字符串
+func HashInstall(id string) string {
+	if id == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(conf.Xml.Usage.Salt))
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Record 把一次使用上报累加到今天的统计里，installID可以为空
+func Record(program string, version string, installID string, sessions int64) error {
+	return db.AddUsage(stats.Day(time.Now()), program, version, HashInstall(installID), sessions)
+}
+
+// Rate 返回无崩溃比例，total为0时没有意义，返回-1
+func Rate(crashed int64, total int64) float64 {
+	if total <= 0 {
+		return -1
+	}
+	if crashed >= total {
+		return 0
+	}
+	return 1 - float64(crashed)/float64(total)
+}
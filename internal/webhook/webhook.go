@@ -0,0 +1,268 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2024 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package webhook
+
+import (
+	"bp-server/internal/conf"
+	"bp-server/internal/db"
+	"bp-server/internal/event"
+	"bp-server/internal/job"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRetries = 8
+	defaultBackoff = 30
+	defaultTimeout = 10
+	maxBackoff     = 6 * time.Hour
+	pollInterval   = 5 * time.Second
+	batchSize      = 100
+	// responseLimit 是记录在发送日志里的响应内容的最大长度
+	responseLimit = 1024
+)
+
+// Start 订阅事件并在后台发送到期的webhook，没有配置webhook时只发送以前留下的记录
+func Start() {
+	if len(conf.Xml.Webhooks.Hooks) > 0 {
+		event.Subscribe(enqueue)
+	}
+	job.Every("webhook delivery", pollInterval, deliverDue)
+}
+
+func find(name string) *conf.WebhookConf {
+	for i := range conf.Xml.Webhooks.Hooks {
+		if conf.Xml.Webhooks.Hooks[i].Name == name {
+			return &conf.Xml.Webhooks.Hooks[i]
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matches 判断webhook是否接收这个事件
+func matches(hook *conf.WebhookConf, ev event.Event) bool {
+	if len(hook.Events) > 0 && !contains(hook.Events, ev.Type) {
+		return false
+	}
+	if len(hook.Programs) > 0 && !contains(hook.Programs, ev.Program) {
+		return false
+	}
+	return true
+}
+
+// enqueue 为每个接收事件的webhook生成一条发送记录
+func enqueue(ev event.Event) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		logrus.Errorf("Marshal event %s failed: %v", ev.Type, err)
+		return
+	}
+	for i := range conf.Xml.Webhooks.Hooks {
+		hook := &conf.Xml.Webhooks.Hooks[i]
+		if !matches(hook, ev) {
+			continue
+		}
+		db.AddDelivery(&db.WebhookDelivery{Webhook: hook.Name, Event: ev.Type, Payload: string(payload)})
+	}
+}
+
+// Sign 返回X-BP-Signature头的值
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff 返回第attempts次失败之后等待的时间
+func backoff(attempts int) time.Duration {
+	seconds := conf.Xml.Webhooks.Backoff
+	if seconds <= 0 {
+		seconds = defaultBackoff
+	}
+	wait := time.Duration(seconds) * time.Second
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait
+}
+
+func retries() int {
+	if conf.Xml.Webhooks.Retries < 0 {
+		return 0
+	}
+	if conf.Xml.Webhooks.Retries == 0 {
+		return defaultRetries
+	}
+	return conf.Xml.Webhooks.Retries
+}
+
+func client() *http.Client {
+	timeout := conf.Xml.Webhooks.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &http.Client{Timeout: time.Duration(timeout) * time.Second}
+}
+
+// deliverDue 每个webhook在单独的goroutine里发送，一个webhook不可用时不会耽误其他webhook
+func deliverDue() {
+	now := time.Now()
+	names, err := db.QueryDueWebhooks(now)
+	if err != nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			deliverHook(name, now)
+		}(name)
+	}
+	wg.Wait()
+}
+
+// deliverHook 按顺序发送一个webhook到期的记录。一次发送失败后剩下的记录留到下一次轮询，
+// 不可用的地址每次轮询最多等待一次超时
+func deliverHook(name string, now time.Time) {
+	deliveries, err := db.QueryDueDeliveries(name, now, batchSize)
+	if err != nil {
+		return
+	}
+	for i := range deliveries {
+		if !deliver(&deliveries[i]) {
+			return
+		}
+	}
+}
+
+// post 发送一次，返回响应的状态码和内容
+func post(hook *conf.WebhookConf, delivery *db.WebhookDelivery) (int, string, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bp-server")
+	req.Header.Set("X-BP-Event", delivery.Event)
+	req.Header.Set("X-BP-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	if hook.Secret != "" {
+		req.Header.Set("X-BP-Signature", Sign(hook.Secret, body))
+	}
+	rsp, err := client().Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer rsp.Body.Close()
+	content, _ := io.ReadAll(io.LimitReader(rsp.Body, responseLimit))
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return rsp.StatusCode, string(content), fmt.Errorf("unexpected status %s", rsp.Status)
+	}
+	return rsp.StatusCode, string(content), nil
+}
+
+// deliver 发送一条记录，失败时按指数退避安排下一次发送，超过重试次数后标记为失败。发送成功时返回true
+func deliver(delivery *db.WebhookDelivery) bool {
+	attempt := &db.WebhookAttempt{}
+	start := time.Now()
+	hook := find(delivery.Webhook)
+	var err error
+	if hook == nil {
+		err = fmt.Errorf("webhook '%s' is not configured", delivery.Webhook)
+	} else {
+		attempt.StatusCode, attempt.Response, err = post(hook, delivery)
+	}
+	attempt.Duration = time.Since(start).Milliseconds()
+	delivery.Attempts++
+	switch {
+	case err == nil:
+		now := time.Now()
+		delivery.Status = db.DeliveryDelivered
+		delivery.DeliveredAt = &now
+		logrus.Infof("Webhook delivery %d of %s to '%s' succeeded", delivery.ID, delivery.Event, delivery.Webhook)
+	case hook == nil || delivery.Attempts > retries():
+		attempt.Error = err.Error()
+		delivery.Status = db.DeliveryFailed
+		logrus.Errorf("Webhook delivery %d of %s to '%s' failed after %d attempts: %v", delivery.ID, delivery.Event, delivery.Webhook, delivery.Attempts, err)
+	default:
+		attempt.Error = err.Error()
+		delivery.NextAttempt = time.Now().Add(backoff(delivery.Attempts))
+		logrus.Warnf("Webhook delivery %d of %s to '%s' failed, retry at %v: %v", delivery.ID, delivery.Event, delivery.Webhook, delivery.NextAttempt, err)
+	}
+	db.SaveAttempt(delivery, attempt)
+	return err == nil
+}
+
+// Replay 把一条发送记录的内容重新发送一次，生成新的发送记录
+func Replay(id uint) (*db.WebhookDelivery, error) {
+	original, err := db.QueryDelivery(id)
+	if err != nil {
+		return nil, err
+	}
+	if find(original.Webhook) == nil {
+		return nil, fmt.Errorf("webhook '%s' is not configured", original.Webhook)
+	}
+	delivery := &db.WebhookDelivery{
+		Webhook:  original.Webhook,
+		Event:    original.Event,
+		Payload:  original.Payload,
+		ReplayOf: original.ID,
+	}
+	if err := db.AddDelivery(delivery); err != nil {
+		return nil, err
+	}
+	logrus.Infof("Webhook delivery %d replayed as %d", original.ID, delivery.ID)
+	return delivery, nil
+}